@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth protects the admin API with the bearer token from the configuration.
+// The admin API is disabled while no token is configured.
+func adminAuth(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := service.Settings().AdminToken
+		if token == "" {
+			respondError(c, http.StatusForbidden, "admin_disabled", "The admin API is disabled. Configure admin.token to enable it.")
+			c.Abort()
+			return
+		}
+
+		provided, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+			respondError(c, http.StatusUnauthorized, "unauthorized", "A valid admin token is required.")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultCatalogData is the built-in catalog used when no catalog file is configured
+//
+//go:embed catalog.yaml
+var defaultCatalogData []byte
+
+// defaultLocale is the UI locale every catalog entry must have a display name for
+const defaultLocale = "en"
+
+// CatalogEntry describes one genre, emotion or language
+type CatalogEntry struct {
+	ID           string            `yaml:"id" toml:"id"`
+	DisplayNames map[string]string `yaml:"display_names" toml:"display_names"`
+	Aliases      []string          `yaml:"aliases" toml:"aliases"`
+	StyleGuide   string            `yaml:"style_guide" toml:"style_guide"`
+	// Parent is the root entry a sub-genre belongs to; empty for roots
+	Parent string `yaml:"parent" toml:"parent"`
+	// TokensPerWord is the average number of model tokens per word of a language
+	TokensPerWord float64 `yaml:"tokens_per_word" toml:"tokens_per_word"`
+	// QualityWeights tunes the quality score of a genre: the weight of each sub-score,
+	// 1 when not given
+	QualityWeights map[string]float64 `yaml:"quality_weights" toml:"quality_weights"`
+}
+
+// DisplayName returns the name for the UI locale, falling back to English
+func (e CatalogEntry) DisplayName(locale string) string {
+	if name := e.DisplayNames[locale]; name != "" {
+		return name
+	}
+	return e.DisplayNames[defaultLocale]
+}
+
+// CatalogSet is a sorted list of entries that can be looked up by ID or alias
+type CatalogSet struct {
+	entries []CatalogEntry
+	index   map[string]int
+}
+
+// Catalog holds the genres, emotions and languages accepted by the service
+type Catalog struct {
+	Genres    *CatalogSet
+	Emotions  *CatalogSet
+	Languages *CatalogSet
+}
+
+// catalogFile is the on-disk layout of a catalog
+type catalogFile struct {
+	Genres    []CatalogEntry `yaml:"genres" toml:"genres"`
+	Emotions  []CatalogEntry `yaml:"emotions" toml:"emotions"`
+	Languages []CatalogEntry `yaml:"languages" toml:"languages"`
+}
+
+var (
+	defaultCatalog     *Catalog
+	defaultCatalogOnce sync.Once
+)
+
+// DefaultCatalog returns the built-in catalog
+func DefaultCatalog() *Catalog {
+	defaultCatalogOnce.Do(func() {
+		var file catalogFile
+		if err := yaml.Unmarshal(defaultCatalogData, &file); err != nil {
+			panic(fmt.Sprintf("invalid built-in catalog: %v", err))
+		}
+		catalog, err := newCatalog(file)
+		if err != nil {
+			panic(fmt.Sprintf("invalid built-in catalog: %v", err))
+		}
+		defaultCatalog = catalog
+	})
+	return defaultCatalog
+}
+
+// LoadCatalog reads a YAML or TOML catalog file; an empty path returns the built-in catalog
+func LoadCatalog(path string) (*Catalog, error) {
+	if path == "" {
+		return DefaultCatalog(), nil
+	}
+	var file catalogFile
+	if err := decodeFile(path, &file); err != nil {
+		return nil, err
+	}
+	return newCatalog(file)
+}
+
+// newCatalog validates and indexes the entries of a catalog file
+func newCatalog(file catalogFile) (*Catalog, error) {
+	genres, genreErr := newCatalogSet("genres", file.Genres)
+	emotions, emotionErr := newCatalogSet("emotions", file.Emotions)
+	languages, languageErr := newCatalogSet("languages", file.Languages)
+	if err := errors.Join(genreErr, emotionErr, languageErr); err != nil {
+		return nil, err
+	}
+	return &Catalog{Genres: genres, Emotions: emotions, Languages: languages}, nil
+}
+
+func newCatalogSet(kind string, entries []CatalogEntry) (*CatalogSet, error) {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(kind+": "+format, args...))
+	}
+	if len(entries) == 0 {
+		fail("at least one entry is required")
+	}
+
+	set := &CatalogSet{index: map[string]int{}}
+	for _, entry := range entries {
+		entry.ID = normalizeCatalogKey(entry.ID)
+		entry.Parent = normalizeCatalogKey(entry.Parent)
+		if entry.ID == "" {
+			fail("entry without id")
+			continue
+		}
+		if entry.DisplayNames[defaultLocale] == "" {
+			fail("%q has no %q display name", entry.ID, defaultLocale)
+		}
+		if entry.TokensPerWord < 0 {
+			fail("%q has negative tokens_per_word %v", entry.ID, entry.TokensPerWord)
+		}
+		for metric, weight := range entry.QualityWeights {
+			if !slices.Contains(qualityMetrics, metric) {
+				fail("%q has unknown quality weight %q (known: %s)", entry.ID, metric, strings.Join(qualityMetrics, ", "))
+			} else if weight < 0 {
+				fail("%q has negative quality weight %s %v", entry.ID, metric, weight)
+			}
+		}
+		set.entries = append(set.entries, entry)
+	}
+	sort.Slice(set.entries, func(i, j int) bool { return set.entries[i].ID < set.entries[j].ID })
+
+	// IDs take precedence, so index them before any alias
+	for i, entry := range set.entries {
+		if _, exists := set.index[entry.ID]; exists {
+			fail("duplicate id %q", entry.ID)
+		}
+		set.index[entry.ID] = i
+	}
+	for _, entry := range set.entries {
+		if entry.Parent == "" {
+			continue
+		}
+		// Sub-genres hang directly off a root so the hierarchy stays two levels deep
+		if parent, ok := set.index[entry.Parent]; !ok {
+			fail("%q has unknown parent %q", entry.ID, entry.Parent)
+		} else if set.entries[parent].Parent != "" {
+			fail("%q has parent %q which is not a root entry", entry.ID, entry.Parent)
+		}
+	}
+	for i, entry := range set.entries {
+		for _, alias := range entry.Aliases {
+			key := normalizeCatalogKey(alias)
+			if existing, exists := set.index[key]; exists && existing != i {
+				fail("alias %q of %q is already used by %q", alias, entry.ID, set.entries[existing].ID)
+				continue
+			}
+			set.index[key] = i
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return set, nil
+}
+
+// Lookup resolves an ID or alias, case-insensitively, to its entry
+func (s *CatalogSet) Lookup(name string) (CatalogEntry, bool) {
+	i, ok := s.index[normalizeCatalogKey(name)]
+	if !ok {
+		return CatalogEntry{}, false
+	}
+	return s.entries[i], true
+}
+
+// IDs returns the canonical IDs in sorted order
+func (s *CatalogSet) IDs() []string {
+	ids := make([]string, len(s.entries))
+	for i, entry := range s.entries {
+		ids[i] = entry.ID
+	}
+	return ids
+}
+
+// Entries returns the entries sorted by ID
+func (s *CatalogSet) Entries() []CatalogEntry {
+	return s.entries
+}
+
+// promptData prepares the template data for a request, resolving the genre blend
+// and the style guides of its catalog entries
+func (c *Catalog) promptData(req LyricsRequest) PromptData {
+	blend := req.genreBlend()
+	styleGuide := c.genreGuidance(blend)
+	type guided struct {
+		label string
+		set   *CatalogSet
+		name  string
+	}
+	items := []guided{{"Emotion", c.Emotions, req.Emotion}}
+	for _, language := range req.languageIDs() {
+		items = append(items, guided{"Language", c.Languages, language})
+	}
+	for _, item := range items {
+		if entry, ok := item.set.Lookup(item.name); ok && entry.StyleGuide != "" {
+			styleGuide = append(styleGuide, fmt.Sprintf("%s (%s): %s", item.label, entry.ID, entry.StyleGuide))
+		}
+	}
+
+	data := PromptData{
+		Language:     req.Language,
+		Languages:    req.Languages,
+		Genre:        c.genreLabel(blend),
+		Emotion:      req.Emotion,
+		Keywords:     req.Keywords,
+		Verses:       req.Structure.Verses,
+		Chorus:       req.Structure.Chorus,
+		Bridge:       req.Structure.Bridge,
+		EmotionArc:   req.EmotionArc,
+		MaxIntensity: maxIntensity,
+		StyleGuide:   styleGuide,
+	}
+	if len(req.Languages) > 0 {
+		data.Language = languageNames(req.Languages)
+	}
+	if req.WordRange != nil {
+		data.MinWords, data.MaxWords = req.WordRange.Min, req.WordRange.Max
+	}
+	return data
+}
+
+func normalizeCatalogKey(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// CatalogOption is a catalog entry as returned by the discovery endpoints
+type CatalogOption struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+	Parent  string   `json:"parent,omitempty"`
+}
+
+// CatalogResponse lists the options of one catalog section
+type CatalogResponse struct {
+	Locale  string          `json:"locale"`
+	Options []CatalogOption `json:"options"`
+}
+
+// catalogHandler lists one section of the active catalog with display names for the
+// UI locale requested via ?locale= or Accept-Language
+func catalogHandler(service *LyricsService, section func(*Catalog) *CatalogSet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		locale := requestLocale(c)
+		set := section(service.Settings().Catalog)
+
+		options := make([]CatalogOption, 0, len(set.Entries()))
+		for _, entry := range set.Entries() {
+			options = append(options, CatalogOption{
+				ID:      entry.ID,
+				Name:    entry.DisplayName(locale),
+				Aliases: entry.Aliases,
+				Parent:  entry.Parent,
+			})
+		}
+		c.JSON(http.StatusOK, CatalogResponse{Locale: locale, Options: options})
+	}
+}
+
+// requestLocale returns the primary language subtag of the requested UI locale
+func requestLocale(c *gin.Context) string {
+	locale := c.Query("locale")
+	if locale == "" {
+		// Only the first, most preferred language range is considered
+		locale = strings.Split(c.GetHeader("Accept-Language"), ",")[0]
+		locale = strings.Split(locale, ";")[0]
+	}
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		locale = locale[:i]
+	}
+	if locale == "" || locale == "*" {
+		return defaultLocale
+	}
+	return locale
+}
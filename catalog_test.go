@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultCatalogLookup(t *testing.T) {
+	catalog := DefaultCatalog()
+
+	tests := []struct {
+		set  *CatalogSet
+		name string
+		want string
+	}{
+		{catalog.Genres, "hiphop", "hip-hop"},
+		{catalog.Genres, "Hip  Hop", "hip-hop"},
+		{catalog.Genres, "RnB", "r&b"},
+		{catalog.Genres, "r&b", "r&b"},
+		{catalog.Emotions, "joyful", "happy"},
+		{catalog.Languages, "español", "spanish"},
+		{catalog.Languages, "JA", "japanese"},
+	}
+	for _, tt := range tests {
+		entry, ok := tt.set.Lookup(tt.name)
+		require.True(t, ok, tt.name)
+		assert.Equal(t, tt.want, entry.ID, tt.name)
+	}
+
+	_, ok := catalog.Genres.Lookup("polka")
+	assert.False(t, ok)
+
+	for _, set := range []*CatalogSet{catalog.Genres, catalog.Emotions, catalog.Languages} {
+		assert.True(t, sort.StringsAreSorted(set.IDs()))
+	}
+}
+
+func TestLoadCatalogValidation(t *testing.T) {
+	path := writeConfigFile(t, "catalog.yaml", `
+genres:
+  - {id: pop, display_names: {en: Pop}, aliases: [mainstream]}
+  - {id: rock, display_names: {en: Rock}, aliases: [mainstream]}
+  - {id: pop, display_names: {en: Pop again}}
+emotions:
+  - {id: happy, display_names: {es: Feliz}}
+languages: []
+`)
+	_, err := LoadCatalog(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `genres: duplicate id "pop"`)
+	assert.Contains(t, err.Error(), `alias "mainstream"`)
+	assert.Contains(t, err.Error(), `emotions: "happy" has no "en" display name`)
+	assert.Contains(t, err.Error(), "languages: at least one entry is required")
+
+	catalog, err := LoadCatalog(writeConfigFile(t, "catalog.toml", `
+[[genres]]
+id = "Synthwave"
+display_names = { en = "Synthwave" }
+style_guide = "Retro-futurist neon imagery."
+
+[[emotions]]
+id = "happy"
+display_names = { en = "Happy" }
+
+[[languages]]
+id = "english"
+display_names = { en = "English" }
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"synthwave"}, catalog.Genres.IDs())
+}
+
+func TestCatalogHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/genres", catalogHandler(&LyricsService{}, func(c *Catalog) *CatalogSet { return c.Genres }))
+
+	get := func(target, acceptLanguage string) CatalogResponse {
+		req, _ := http.NewRequest("GET", target, nil)
+		if acceptLanguage != "" {
+			req.Header.Set("Accept-Language", acceptLanguage)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response CatalogResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := get("/genres", "")
+	assert.Equal(t, "en", response.Locale)
+	require.Len(t, response.Options, len(DefaultCatalog().Genres.IDs()))
+	for i, id := range DefaultCatalog().Genres.IDs() {
+		assert.Equal(t, id, response.Options[i].ID)
+	}
+
+	hipHop := func(response CatalogResponse) CatalogOption {
+		for _, option := range response.Options {
+			if option.ID == "hip-hop" {
+				return option
+			}
+		}
+		t.Fatal("hip-hop missing from catalog")
+		return CatalogOption{}
+	}
+	assert.Equal(t, "Hip-Hop", hipHop(response).Name)
+	assert.Contains(t, hipHop(response).Aliases, "hiphop")
+
+	assert.Equal(t, "ヒップホップ", hipHop(get("/genres", "ja-JP,en;q=0.8")).Name)
+	assert.Equal(t, "힙합", hipHop(get("/genres?locale=ko", "ja")).Name)
+
+	// Unknown locales fall back to English names
+	response = get("/genres?locale=sw", "")
+	assert.Equal(t, "sw", response.Locale)
+	assert.Equal(t, "Hip-Hop", hipHop(response).Name)
+}
+
+func TestBuildPromptIncludesStyleGuide(t *testing.T) {
+	service := &LyricsService{}
+	rendered, err := service.Settings().buildPrompt(LyricsRequest{
+		Keywords:  []string{"city"},
+		Genre:     "hip-hop",
+		Emotion:   "happy",
+		Language:  "english",
+		Structure: SongStructure{Verses: 2, Chorus: true},
+	}, defaultPromptVersion)
+	require.NoError(t, err)
+	prompt := rendered.User
+
+	genre, _ := DefaultCatalog().Genres.Lookup("hip-hop")
+	assert.Contains(t, prompt, "Style guide:")
+	assert.Contains(t, prompt, "- Genre (hip-hop): "+genre.StyleGuide)
+}
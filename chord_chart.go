@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PlacedChord is a chord sung from a position in a lyric line, in characters
+type PlacedChord struct {
+	Chord    string `json:"chord"`
+	Position int    `json:"position"`
+}
+
+// ChordLine is a lyric line with its chords
+type ChordLine struct {
+	Lyric  string        `json:"lyric"`
+	Chords []PlacedChord `json:"chords"`
+}
+
+// ChartSection is a section of a song with chords placed over its lines
+type ChartSection struct {
+	Section  string      `json:"section"`
+	Numerals []string    `json:"numerals"`
+	Chords   []string    `json:"chords"`
+	Lines    []ChordLine `json:"lines"`
+}
+
+// ChordChart is a song with its chords placed over the lyrics, as data, as a
+// chord-over-lyric text layout and as ChordPro with inline chords
+type ChordChart struct {
+	ID       string         `json:"id"`
+	Key      string         `json:"key"`
+	Mode     string         `json:"mode"`
+	Tempo    TempoRange     `json:"tempo"`
+	Sections []ChartSection `json:"sections"`
+	Layout   string         `json:"layout"`
+	ChordPro string         `json:"chordpro"`
+}
+
+// Words that are usually sung unstressed, in the supported Latin-script languages
+var unstressedWords = map[string]bool{
+	// English
+	"a": true, "an": true, "the": true, "and": true, "but": true, "or": true, "of": true, "to": true,
+	"in": true, "on": true, "at": true, "by": true, "for": true, "from": true, "with": true, "as": true,
+	"is": true, "am": true, "are": true, "was": true, "were": true, "be": true, "my": true, "your": true,
+	"his": true, "her": true, "its": true, "our": true, "their": true, "i": true, "you": true, "he": true,
+	"she": true, "it": true, "we": true, "they": true, "me": true, "him": true, "us": true, "them": true,
+	"that": true, "than": true, "if": true, "so": true, "do": true, "can": true, "will": true,
+	// French, Spanish, Italian, Portuguese and German articles and conjunctions
+	"le": true, "la": true, "les": true, "de": true, "des": true, "du": true, "un": true, "une": true,
+	"et": true, "el": true, "los": true, "las": true, "y": true, "en": true, "il": true, "lo": true,
+	"di": true, "e": true, "o": true, "os": true, "um": true, "uma": true, "der": true, "die": true,
+	"das": true, "und": true, "ein": true, "eine": true,
+}
+
+// Unstressed English prefixes that move the stress to the second syllable, as in "again"
+var unstressedPrefixes = []string{"a", "be", "de", "re"}
+
+const vowels = "aeiouyáéíóúàèìòùâêîôûäëïöüãõœæ"
+
+// isWide reports whether a character is CJK, where each character is sung on its own beat
+func isWide(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		r >= 0xFF01 && r <= 0xFF60
+}
+
+// syllablePositions returns the character offsets where the syllables of a line start,
+// and which of them are stressed. CJK characters are each a syllable and count as
+// stressed; in other scripts a word's stressed syllable follows the language's
+// usual rule, and common function words are unstressed.
+func syllablePositions(line, language string) (stressed, all []int) {
+	runes := []rune(line)
+	for start := 0; start < len(runes); {
+		if isWide(runes[start]) {
+			all = append(all, start)
+			stressed = append(stressed, start)
+			start++
+			continue
+		}
+		if !unicode.IsLetter(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && (unicode.IsLetter(runes[end]) || runes[end] == '\'') && !isWide(runes[end]) {
+			end++
+		}
+
+		word := []rune(strings.ToLower(string(runes[start:end])))
+		syllables := wordSyllables(word, language)
+		for _, offset := range syllables {
+			all = append(all, start+offset)
+		}
+		if !unstressedWords[string(word)] {
+			stressed = append(stressed, start+syllables[stressedSyllable(word, syllables, language)])
+		}
+		start = end
+	}
+	return stressed, all
+}
+
+// wordSyllables returns the offsets where the syllables of a lowercase word start: one
+// per group of vowels, starting at the consonant before it
+func wordSyllables(word []rune, language string) []int {
+	var groups []int
+	for i, r := range word {
+		vowel := strings.ContainsRune(vowels, r) && (r != 'y' || i > 0)
+		previous := i > 0 && strings.ContainsRune(vowels, word[i-1]) && (word[i-1] != 'y' || i > 1)
+		if vowel && !previous {
+			groups = append(groups, i)
+		}
+	}
+	// A final "e" is silent in English and French, as in "love" and "belle"
+	if n := len(groups); n > 1 && groups[n-1] == len(word)-1 && word[len(word)-1] == 'e' &&
+		(language == "english" || language == "french") {
+		groups = groups[:n-1]
+	}
+
+	if len(groups) == 0 {
+		return []int{0}
+	}
+	syllables := []int{0}
+	for _, group := range groups[1:] {
+		syllables = append(syllables, group-1)
+	}
+	return syllables
+}
+
+// stressedSyllable returns the index of the stressed syllable of a word: the last one
+// in French; in Spanish, Italian and Portuguese the one with a written accent, else
+// the second to last; and otherwise the first one unless the word starts with an
+// unstressed English prefix
+func stressedSyllable(word []rune, syllables []int, language string) int {
+	n := len(syllables)
+	switch {
+	case n == 1:
+		return 0
+	case language == "french":
+		return n - 1
+	case language == "spanish" || language == "italian" || language == "portuguese":
+		for i := n - 1; i >= 0; i-- {
+			if strings.ContainsAny(string(word[syllables[i]:]), "áéíóúàèìòùâêôãõ") {
+				return i
+			}
+		}
+		return n - 2
+	case language == "english":
+		for _, prefix := range unstressedPrefixes {
+			if string(word[:syllables[1]]) == prefix {
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+// placeChords spreads a progression over the lines of a section, continuing it from
+// line to line and starting it again when it runs out. Each line gets an equal share
+// of chords, placed on evenly spaced stressed syllables, or on any syllables when
+// there are too few stressed ones. Chords left over on a short line are placed at
+// its end.
+func placeChords(lines []string, progression []string, language string) []ChordLine {
+	placed := make([]ChordLine, len(lines))
+	if len(progression) == 0 || len(lines) == 0 {
+		for i, line := range lines {
+			placed[i] = ChordLine{Lyric: line}
+		}
+		return placed
+	}
+
+	perLine := (len(progression) + len(lines) - 1) / len(lines)
+	next := 0
+	for i, line := range lines {
+		candidates, all := syllablePositions(line, language)
+		if len(candidates) < perLine {
+			candidates = all
+		}
+
+		placed[i].Lyric = line
+		for j := 0; j < perLine; j++ {
+			position := len([]rune(line))
+			if j < len(candidates) {
+				position = candidates[j*len(candidates)/min(perLine, len(candidates))]
+			}
+			placed[i].Chords = append(placed[i].Chords, PlacedChord{Chord: progression[next%len(progression)], Position: position})
+			next++
+		}
+	}
+	return placed
+}
+
+// displayWidth returns the width of text in a monospaced font, where CJK characters
+// take two columns
+func displayWidth(text string) int {
+	width := 0
+	for _, r := range text {
+		if isWide(r) {
+			width += 2
+		} else {
+			width++
+		}
+	}
+	return width
+}
+
+// chordOverLyric writes the chords on a line above the lyric, aligned with the
+// characters they are placed on and at least one space apart
+func chordOverLyric(line ChordLine) string {
+	runes := []rune(line.Lyric)
+	var chords strings.Builder
+	column := 0
+	for _, placed := range line.Chords {
+		target := displayWidth(string(runes[:min(placed.Position, len(runes))]))
+		if column > 0 && target <= column {
+			target = column + 1
+		}
+		chords.WriteString(strings.Repeat(" ", target-column))
+		chords.WriteString(placed.Chord)
+		column = target + displayWidth(placed.Chord)
+	}
+	return chords.String() + "\n" + line.Lyric
+}
+
+// inlineChordPro writes the lyric with each chord in brackets before the character it
+// is placed on, as in "[C]Walking [G]down", and chords placed at the end after it
+func inlineChordPro(line ChordLine) string {
+	var b strings.Builder
+	next := 0
+	for i, r := range []rune(line.Lyric) {
+		for ; next < len(line.Chords) && line.Chords[next].Position <= i; next++ {
+			b.WriteString("[" + line.Chords[next].Chord + "]")
+		}
+		b.WriteRune(r)
+	}
+	for ; next < len(line.Chords); next++ {
+		if b.Len() > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString("[" + line.Chords[next].Chord + "]")
+	}
+	return b.String()
+}
+
+var keyPattern = regexp.MustCompile(`^([A-Ga-g])([#b]?)\s*(m|min|minor|maj|major)?$`)
+
+// parseKey parses a key such as "A", "F#m", "Bb major" or "c minor". The mode is
+// empty when the key does not give one.
+func parseKey(key string) (tonic, mode string, err error) {
+	match := keyPattern.FindStringSubmatch(strings.TrimSpace(key))
+	if match == nil {
+		return "", "", fmt.Errorf("unknown key %q; use a note name such as C, F# or Bb, with \"m\" for minor keys", key)
+	}
+	tonic = strings.ToUpper(match[1]) + match[2]
+	if _, ok := noteIndex(tonic); !ok {
+		return "", "", fmt.Errorf("unknown key %q; use a note name such as C, F# or Bb, with \"m\" for minor keys", key)
+	}
+	switch match[3] {
+	case "m", "min", "minor":
+		mode = modeMinor
+	case "maj", "major":
+		mode = modeMajor
+	}
+	return tonic, mode, nil
+}
+
+// transposeChords returns the suggestions in another key of the same mode, respelling
+// each progression from its Roman numerals
+func transposeChords(chords *ChordSuggestions, key string) (*ChordSuggestions, error) {
+	tonic, mode, err := parseKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" && mode != chords.Mode {
+		return nil, fmt.Errorf("the song is in a %s key; ask for a %s key instead of %q", chords.Mode, chords.Mode, key)
+	}
+
+	transposed := &ChordSuggestions{Key: tonic, Mode: chords.Mode, Tempo: chords.Tempo}
+	for _, section := range chords.Sections {
+		respelled := SectionChords{Section: section.Section, Numerals: section.Numerals, Chords: make([]string, len(section.Numerals))}
+		for i, numeral := range section.Numerals {
+			if respelled.Chords[i], err = spellChord(tonic, chords.Mode, numeral); err != nil {
+				return nil, err
+			}
+		}
+		transposed.Sections = append(transposed.Sections, respelled)
+	}
+	return transposed, nil
+}
+
+// chordChart places the song's chords over every section, in song order
+func chordChart(song StoredLyrics) ChordChart {
+	chords := song.Response.Chords
+	chart := ChordChart{
+		ID:       song.Response.ID,
+		Key:      chords.Key,
+		Mode:     chords.Mode,
+		Tempo:    chords.Tempo,
+		ChordPro: renderChordPro(song),
+	}
+
+	var layout strings.Builder
+	for i, section := range song.Response.Lyrics.Sections {
+		chartSection := ChartSection{Section: section.Name}
+		for _, suggested := range chords.Sections {
+			if suggested.Section == section.Name {
+				chartSection.Numerals, chartSection.Chords = suggested.Numerals, suggested.Chords
+			}
+		}
+		chartSection.Lines = placeChords(section.Lines, chartSection.Chords, song.Response.sectionLanguage(section))
+		chart.Sections = append(chart.Sections, chartSection)
+
+		if i > 0 {
+			layout.WriteString("\n")
+		}
+		fmt.Fprintf(&layout, "[%s]\n", sectionLabel(section.Name))
+		for _, line := range chartSection.Lines {
+			layout.WriteString(chordOverLyric(line) + "\n")
+		}
+	}
+	chart.Layout = layout.String()
+	return chart
+}
+
+// getChords returns a stored song's chord chart, transposed to the key query parameter
+// if given. Songs generated without include_chords get suggestions on the fly.
+func getChords(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		song, ok := service.store.Get(c.Param("id"))
+		if !ok {
+			respondError(c, http.StatusNotFound, "not_found", "No lyrics found with this ID.")
+			return
+		}
+
+		chords := song.Response.Chords
+		if chords == nil {
+			chords = suggestChords(service.Settings().Catalog, song.Request, song.Response.Lyrics.Sections)
+		}
+		if key := c.Query("key"); key != "" {
+			transposed, err := transposeChords(chords, key)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, "invalid_key", errorMessage(err))
+				return
+			}
+			chords = transposed
+		}
+
+		song.Response.Chords = chords
+		c.JSON(http.StatusOK, chordChart(song))
+	}
+}
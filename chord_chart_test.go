@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyllablePositions(t *testing.T) {
+	stressed, all := syllablePositions("Walking down the road again", "english")
+	assert.Equal(t, []int{0, 3, 8, 13, 17, 22, 23}, all)
+	assert.Equal(t, []int{0, 8, 17, 23}, stressed)
+
+	// Silent final e, and no stress on function words
+	stressed, all = syllablePositions("I love you", "english")
+	assert.Equal(t, []int{0, 2, 7}, all)
+	assert.Equal(t, []int{2}, stressed)
+
+	// Romance languages stress the second to last syllable, French the last
+	stressed, _ = syllablePositions("noche corazón", "spanish")
+	assert.Equal(t, []int{0, 10}, stressed)
+	stressed, _ = syllablePositions("chanson", "french")
+	assert.Equal(t, []int{4}, stressed)
+
+	// Every CJK character is a beat
+	stressed, all = syllablePositions("夜明けの道", "japanese")
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, stressed)
+	assert.Equal(t, stressed, all)
+}
+
+func TestPlaceChords(t *testing.T) {
+	lines := []string{"Walking down the road again", "Every step a story told"}
+	placed := placeChords(lines, []string{"G", "D", "Em", "C"}, "english")
+	require.Len(t, placed, 2)
+	assert.Equal(t, []PlacedChord{{"G", 0}, {"D", 17}}, placed[0].Chords)
+	assert.Equal(t, []PlacedChord{{"Em", 0}, {"C", 13}}, placed[1].Chords)
+
+	assert.Equal(t, "[G]Walking down the [D]road again", inlineChordPro(placed[0]))
+	assert.Equal(t, "G                D\nWalking down the road again", chordOverLyric(placed[0]))
+
+	// The progression carries on over more lines than chords, and chords left over on
+	// a short line go at its end
+	placed = placeChords([]string{"Stay", "Stay", "Stay"}, []string{"C", "G"}, "english")
+	assert.Equal(t, "[C]Stay", inlineChordPro(placed[0]))
+	assert.Equal(t, "[G]Stay", inlineChordPro(placed[1]))
+	assert.Equal(t, "[C]Stay", inlineChordPro(placed[2]))
+	placed = placeChords([]string{"Stay"}, []string{"C", "G", "Am"}, "english")
+	assert.Equal(t, "[C]Stay [G] [Am]", inlineChordPro(placed[0]))
+	assert.Equal(t, "C   G Am\nStay", chordOverLyric(placed[0]))
+
+	// CJK characters take two columns
+	placed = placeChords([]string{"夜明けの道"}, []string{"Am", "F"}, "japanese")
+	assert.Equal(t, "[Am]夜明[F]けの道", inlineChordPro(placed[0]))
+	assert.Equal(t, "Am  F\n夜明けの道", chordOverLyric(placed[0]))
+
+	assert.Equal(t, []ChordLine{{Lyric: "No chords"}}, placeChords([]string{"No chords"}, nil, "english"))
+}
+
+func TestTransposeChords(t *testing.T) {
+	chords := &ChordSuggestions{Key: "E", Mode: modeMinor, Tempo: TempoRange{70, 100}, Sections: []SectionChords{
+		{Section: "verse 1", Numerals: []string{"i", "VII", "VI", "V7"}, Chords: []string{"Em", "D", "C", "B7"}},
+	}}
+
+	transposed, err := transposeChords(chords, "g minor")
+	require.NoError(t, err)
+	assert.Equal(t, "G", transposed.Key)
+	assert.Equal(t, []string{"Gm", "F", "Eb", "D7"}, transposed.Sections[0].Chords)
+	assert.Equal(t, []string{"Em", "D", "C", "B7"}, chords.Sections[0].Chords, "the original is unchanged")
+
+	transposed, err = transposeChords(chords, "F#")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"F#m", "E", "D", "C#7"}, transposed.Sections[0].Chords)
+
+	_, err = transposeChords(chords, "C")
+	require.NoError(t, err)
+	_, err = transposeChords(chords, "C major")
+	assert.EqualError(t, err, `the song is in a minor key; ask for a minor key instead of "C major"`)
+	_, err = transposeChords(chords, "H")
+	assert.ErrorContains(t, err, `unknown key "H";`)
+	_, err = transposeChords(chords, "Fb")
+	assert.ErrorContains(t, err, `unknown key "Fb";`)
+}
+
+func TestGetChords(t *testing.T) {
+	service, id := testStoredSong(t, "Home")
+	service.settings.Store(&ServiceSettings{Catalog: DefaultCatalog()})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/lyrics/:id/chords", getChords(service))
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Songs generated without chords get suggestions on request
+	w := get("/lyrics/" + id + "/chords")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var chart ChordChart
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &chart))
+	assert.Equal(t, id, chart.ID)
+	require.Len(t, chart.Sections, 5)
+	assert.Equal(t, "chorus", chart.Sections[3].Section)
+	assert.Equal(t, chart.Sections[1].Lines, chart.Sections[3].Lines)
+	assert.Contains(t, chart.Layout, "[Verse 1]\n")
+	assert.Contains(t, chart.ChordPro, "{key: "+chart.Key+"}")
+
+	w = get("/lyrics/" + id + "/chords?key=Bb")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var transposed ChordChart
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &transposed))
+	assert.Equal(t, "Bb", transposed.Key)
+	assert.Equal(t, chart.Sections[0].Numerals, transposed.Sections[0].Numerals)
+	assert.Equal(t, "Bb", transposed.Sections[0].Chords[0])
+
+	w = get("/lyrics/" + id + "/chords?key=X")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_key")
+	assert.Equal(t, http.StatusNotFound, get("/lyrics/missing/chords").Code)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// Key modes
+const (
+	modeMajor = "major"
+	modeMinor = "minor"
+)
+
+// ChordSuggestions is a harmonic starting point for a song: a key, a tempo range and a
+// chord progression per section, from the genre and emotion rather than the model
+type ChordSuggestions struct {
+	// Key is the tonic, e.g. "G" or "F#"
+	Key      string          `json:"key"`
+	Mode     string          `json:"mode"`
+	Tempo    TempoRange      `json:"tempo"`
+	Sections []SectionChords `json:"sections"`
+}
+
+// TempoRange is a suggested tempo in beats per minute
+type TempoRange struct {
+	Min int `json:"min_bpm"`
+	Max int `json:"max_bpm"`
+}
+
+// SectionChords is the progression suggested for one section, as Roman numerals and
+// as chords in the song's key
+type SectionChords struct {
+	Section  string   `json:"section"`
+	Numerals []string `json:"numerals"`
+	Chords   []string `json:"chords"`
+}
+
+// KeyName returns the key as written in chord charts, e.g. "G" or "Em"
+func (c *ChordSuggestions) KeyName() string {
+	if c.Mode == modeMinor {
+		return c.Key + "m"
+	}
+	return c.Key
+}
+
+// ForSection returns the chords of a section, or nil if it has no suggestion
+func (c *ChordSuggestions) ForSection(name string) []string {
+	for _, section := range c.Sections {
+		if section.Section == name {
+			return section.Chords
+		}
+	}
+	return nil
+}
+
+// harmonyStyle lists candidate progressions per section kind and mode, as Roman
+// numerals relative to the major or natural minor scale of the key
+type harmonyStyle struct {
+	major map[string][]string
+	minor map[string][]string
+}
+
+var (
+	popHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":      {"I V vi IV", "I IV vi V", "vi IV I V"},
+			"pre-chorus": {"IV V IV V", "ii iii IV V"},
+			"chorus":     {"I V vi IV", "IV I V vi", "I IV V IV"},
+			"bridge":     {"vi IV I V", "IV V iii vi", "ii V I vi"},
+		},
+		minor: map[string][]string{
+			"verse":      {"i VI III VII", "i VII VI VII", "i iv VI V"},
+			"pre-chorus": {"iv VI VII VII", "VI VII iv V"},
+			"chorus":     {"VI VII i i", "i VI III VII", "VI III VII i"},
+			"bridge":     {"iv i VI V", "III VII VI VII"},
+		},
+	}
+	rockHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":  {"I bVII IV I", "I IV I V", "I V IV IV"},
+			"chorus": {"IV I V vi", "I V IV I", "I bVII IV I"},
+			"bridge": {"vi IV V V", "IV bVII I I"},
+		},
+		minor: map[string][]string{
+			"verse":  {"i VII VI VII", "i VI VII i", "i i VII VI"},
+			"chorus": {"VI VII i i", "i VI III VII", "III VII i i"},
+			"bridge": {"iv VI VII V", "VI iv VII V"},
+		},
+	}
+	folkHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":  {"I IV I V", "I I IV I", "I V IV I"},
+			"chorus": {"IV I V I", "I V IV I", "I IV V I"},
+			"bridge": {"vi IV I V", "IV V vi V"},
+		},
+		minor: map[string][]string{
+			"verse":  {"i VII i VII", "i iv VII III", "i III VII i"},
+			"chorus": {"VI VII i i", "III VII i i", "i iv VI V"},
+			"bridge": {"III VII iv V", "VI III VII V"},
+		},
+	}
+	bluesHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":  {"I7 I7 I7 I7 IV7 IV7 I7 I7 V7 IV7 I7 V7"},
+			"chorus": {"IV7 IV7 I7 I7 V7 IV7 I7 V7", "I7 I7 I7 I7 IV7 IV7 I7 I7 V7 IV7 I7 V7"},
+			"bridge": {"IV7 IV7 I7 I7", "V7 V7 IV7 IV7"},
+		},
+		minor: map[string][]string{
+			"verse":  {"i7 i7 i7 i7 iv7 iv7 i7 i7 VI7 V7 i7 V7"},
+			"chorus": {"iv7 iv7 i7 i7 VI7 V7 i7 V7", "i7 i7 i7 i7 iv7 iv7 i7 i7 VI7 V7 i7 V7"},
+			"bridge": {"iv7 iv7 i7 i7", "VI7 VI7 V7 V7"},
+		},
+	}
+	jazzHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":  {"ii7 V7 Imaj7 vi7", "Imaj7 vi7 ii7 V7"},
+			"chorus": {"Imaj7 vi7 ii7 V7", "IVmaj7 iii7 ii7 V7"},
+			"bridge": {"iii7 vi7 ii7 V7", "IVmaj7 IVmaj7 iii7 vi7"},
+		},
+		minor: map[string][]string{
+			"verse":  {"i7 iv7 VII7 IIImaj7", "i7 VImaj7 iv7 V7"},
+			"chorus": {"VImaj7 iv7 V7 i7", "iv7 VII7 IIImaj7 VImaj7"},
+			"bridge": {"IIImaj7 VImaj7 iv7 V7", "iv7 iv7 i7 i7"},
+		},
+	}
+	rnbHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":  {"Imaj7 iii7 vi7 IVmaj7", "IVmaj7 iii7 vi7 ii7"},
+			"chorus": {"IVmaj7 iii7 ii7 Imaj7", "ii7 iii7 IVmaj7 V7"},
+			"bridge": {"ii7 V7 iii7 vi7", "IVmaj7 V7 iii7 vi7"},
+		},
+		minor: map[string][]string{
+			"verse":  {"i7 iv7 i7 VImaj7", "i7 VII7 VImaj7 v7"},
+			"chorus": {"VImaj7 v7 iv7 i7", "iv7 v7 VImaj7 VII7"},
+			"bridge": {"IIImaj7 VImaj7 iv7 V7", "VImaj7 VII7 i7 i7"},
+		},
+	}
+	electronicHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":  {"vi IV I V", "I iii vi IV"},
+			"chorus": {"IV V vi vi", "IV I V vi", "I V vi IV"},
+			"bridge": {"IV IV vi V", "ii IV vi V"},
+		},
+		minor: map[string][]string{
+			"verse":  {"i VI III VII", "i i VI VII", "i VII VI VII"},
+			"chorus": {"VI VII i v", "VI III VII i", "i VI III VII"},
+			"bridge": {"iv VI VII VII", "VI VI VII VII"},
+		},
+	}
+	hipHopHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":  {"Imaj7 vi7 Imaj7 vi7", "ii7 V7 ii7 V7"},
+			"chorus": {"IVmaj7 iii7 vi7 vi7", "Imaj7 vi7 ii7 V7"},
+			"bridge": {"IVmaj7 IVmaj7 iii7 vi7"},
+		},
+		minor: map[string][]string{
+			"verse":  {"i VI i VI", "i iv i iv", "i VII VI VII"},
+			"chorus": {"VI VII i i", "i iv VI v"},
+			"bridge": {"iv v VI VII", "VI VI v v"},
+		},
+	}
+	reggaeHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":  {"I IV I IV", "I vi IV V", "I V I V"},
+			"chorus": {"IV V I vi", "I V vi IV", "IV I V I"},
+			"bridge": {"ii V ii V", "vi V IV V"},
+		},
+		minor: map[string][]string{
+			"verse":  {"i iv i iv", "i VII i VII"},
+			"chorus": {"VI VII i i", "iv VII i i"},
+			"bridge": {"iv v iv v", "VI VII III VI"},
+		},
+	}
+	classicalHarmony = harmonyStyle{
+		major: map[string][]string{
+			"verse":  {"I IV V I", "I vi ii V", "I V vi iii IV I IV V"},
+			"chorus": {"I IV I V", "IV V iii vi", "I vi IV V"},
+			"bridge": {"vi iii IV I", "ii V iii vi"},
+		},
+		minor: map[string][]string{
+			"verse":  {"i iv V i", "i VI iv V", "i VII VI V"},
+			"chorus": {"VI III iv V", "i iv VII III"},
+			"bridge": {"i VII VI V", "iv i V i"},
+		},
+	}
+)
+
+// genreHarmony is the harmonic profile of a root genre: its progressions, its tempo
+// range and the keys it is commonly played in, by mode
+type genreHarmony struct {
+	style     harmonyStyle
+	tempo     TempoRange
+	majorKeys []string
+	minorKeys []string
+}
+
+var genreHarmonies = map[string]genreHarmony{
+	"blues":      {bluesHarmony, TempoRange{70, 110}, []string{"E", "A", "G", "C"}, []string{"A", "E", "G"}},
+	"classical":  {classicalHarmony, TempoRange{60, 100}, []string{"C", "G", "D", "F", "Bb"}, []string{"A", "D", "G", "C"}},
+	"country":    {folkHarmony, TempoRange{90, 130}, []string{"G", "D", "A", "C", "E"}, []string{"E", "A", "B"}},
+	"electronic": {electronicHarmony, TempoRange{118, 130}, []string{"C", "F", "G", "A"}, []string{"A", "F", "C", "G"}},
+	"folk":       {folkHarmony, TempoRange{80, 115}, []string{"G", "D", "C", "A"}, []string{"E", "A", "D"}},
+	"hip-hop":    {hipHopHarmony, TempoRange{80, 100}, []string{"C", "F", "Bb", "Eb"}, []string{"C", "F", "G", "D"}},
+	"indie":      {popHarmony, TempoRange{90, 125}, []string{"D", "A", "E", "G"}, []string{"B", "E", "F#"}},
+	"jazz":       {jazzHarmony, TempoRange{90, 150}, []string{"F", "Bb", "Eb", "C"}, []string{"D", "G", "C"}},
+	"metal":      {rockHarmony, TempoRange{100, 160}, []string{"E", "D"}, []string{"E", "D", "C#"}},
+	"pop":        {popHarmony, TempoRange{100, 128}, []string{"C", "G", "D", "A", "F"}, []string{"A", "E", "B", "F#"}},
+	"r&b":        {rnbHarmony, TempoRange{65, 95}, []string{"Eb", "Ab", "Db", "Bb"}, []string{"C", "F", "Bb"}},
+	"reggae":     {reggaeHarmony, TempoRange{70, 90}, []string{"G", "C", "D", "A"}, []string{"A", "D", "E"}},
+	"rock":       {rockHarmony, TempoRange{110, 140}, []string{"E", "A", "D", "G"}, []string{"E", "A", "B"}},
+}
+
+// subGenreTempos overrides the tempo of sub-genres that are played much faster or
+// slower than their root genre
+var subGenreTempos = map[string]TempoRange{
+	"bluegrass":     {120, 160},
+	"boom-bap":      {85, 95},
+	"delta-blues":   {60, 100},
+	"drum-and-bass": {160, 180},
+	"house":         {120, 128},
+	"j-pop":         {110, 150},
+	"punk":          {160, 200},
+	"smooth-jazz":   {70, 100},
+	"synthwave":     {80, 118},
+	"thrash-metal":  {160, 220},
+	"trap":          {130, 160},
+}
+
+// emotionHarmony ties an emotion to a mode and scales the genre's tempo range
+type emotionHarmony struct {
+	mode  string
+	tempo float64
+}
+
+var emotionHarmonies = map[string]emotionHarmony{
+	"contemplative": {modeMinor, 0.9},
+	"energetic":     {modeMajor, 1.1},
+	"excited":       {modeMajor, 1.1},
+	"happy":         {modeMajor, 1},
+	"hopeful":       {modeMajor, 1},
+	"melancholic":   {modeMinor, 0.9},
+	"nostalgic":     {modeMajor, 0.95},
+	"peaceful":      {modeMajor, 0.85},
+	"romantic":      {modeMajor, 0.9},
+	"sad":           {modeMinor, 0.85},
+}
+
+// suggestChords picks a key, tempo and progressions for the song's sections. The
+// dominant genre (or its root genre) chooses the style, the emotion chooses the mode,
+// and the choices among candidates are seeded from the request, so the same request
+// always gets the same suggestions. Genres and emotions outside the built-in catalog
+// use the pop profile and a major key.
+func suggestChords(catalog *Catalog, req LyricsRequest, sections []LyricsSection) *ChordSuggestions {
+	genre := strings.ToLower(req.Genre)
+	harmony, ok := genreHarmonies[genre]
+	if !ok {
+		if entry, found := catalog.Genres.Lookup(genre); found {
+			harmony, ok = genreHarmonies[entry.Parent]
+		}
+	}
+	if !ok {
+		harmony = genreHarmonies["pop"]
+	}
+	tempo := harmony.tempo
+	if override, ok := subGenreTempos[genre]; ok {
+		tempo = override
+	}
+
+	emotion, ok := emotionHarmonies[strings.ToLower(req.Emotion)]
+	if !ok {
+		emotion = emotionHarmony{modeMajor, 1}
+	}
+	keys, progressions := harmony.majorKeys, harmony.style.major
+	if emotion.mode == modeMinor {
+		keys, progressions = harmony.minorKeys, harmony.style.minor
+	}
+
+	seed := genre + "|" + strings.ToLower(req.Emotion) + "|" + strings.ToLower(strings.Join(req.Keywords, ","))
+	suggestions := &ChordSuggestions{
+		Key:  keys[pick(seed, len(keys))],
+		Mode: emotion.mode,
+		Tempo: TempoRange{
+			Min: int(math.Round(float64(tempo.Min) * emotion.tempo)),
+			Max: int(math.Round(float64(tempo.Max) * emotion.tempo)),
+		},
+	}
+
+	seen := map[string]bool{}
+	for _, section := range sections {
+		if seen[section.Name] {
+			continue
+		}
+		seen[section.Name] = true
+
+		candidates := progressions[progressionKind(sectionKind(section.Name))]
+		if len(candidates) == 0 {
+			candidates = progressions["verse"]
+		}
+		numerals := strings.Fields(candidates[pick(seed+"|"+sectionKind(section.Name), len(candidates))])
+		chords := make([]string, len(numerals))
+		for i, numeral := range numerals {
+			chords[i], _ = spellChord(suggestions.Key, suggestions.Mode, numeral)
+		}
+		suggestions.Sections = append(suggestions.Sections, SectionChords{Section: section.Name, Numerals: numerals, Chords: chords})
+	}
+	return suggestions
+}
+
+// progressionKind maps a section kind to the kind of progression it uses
+func progressionKind(kind string) string {
+	switch kind {
+	case "chorus", "hook", "refrain", "outro":
+		return "chorus"
+	case "pre-chorus", "bridge":
+		return kind
+	default:
+		return "verse"
+	}
+}
+
+// pick deterministically chooses an index below n from the seed
+func pick(seed string, n int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(seed))
+	return int(hash.Sum32() % uint32(n))
+}
+
+var (
+	sharpNotes = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+	flatNotes  = []string{"C", "Db", "D", "Eb", "E", "F", "Gb", "G", "Ab", "A", "Bb", "B"}
+
+	// Keys whose signatures have flats; the others are spelled with sharps
+	flatKeys = map[string]bool{
+		"F": true, "Bb": true, "Eb": true, "Ab": true, "Db": true, "Gb": true,
+		"Dm": true, "Gm": true, "Cm": true, "Fm": true, "Bbm": true, "Ebm": true,
+	}
+
+	majorScale = []int{0, 2, 4, 5, 7, 9, 11}
+	minorScale = []int{0, 2, 3, 5, 7, 8, 10}
+
+	numeralPattern = regexp.MustCompile(`^([b#]?)(VII|VI|V|IV|III|II|I|vii|vi|v|iv|iii|ii|i)(maj7|7|°|sus4)?$`)
+	romanDegrees   = map[string]int{"i": 0, "ii": 1, "iii": 2, "iv": 3, "v": 4, "vi": 5, "vii": 6}
+)
+
+// noteIndex returns the pitch class of a note name such as "F#" or "Bb"
+func noteIndex(note string) (int, bool) {
+	for _, notes := range [][]string{sharpNotes, flatNotes} {
+		for i, name := range notes {
+			if strings.EqualFold(name, note) {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// spellChord returns the chord of a Roman numeral in a key. Uppercase numerals are
+// major chords and lowercase ones minor; "°" makes a diminished chord, "7" a dominant
+// seventh (minor seventh when lowercase) and "maj7" a major seventh.
+func spellChord(key, mode, numeral string) (string, error) {
+	tonic, ok := noteIndex(key)
+	if !ok {
+		return "", fmt.Errorf("unknown key %q", key)
+	}
+	match := numeralPattern.FindStringSubmatch(numeral)
+	if match == nil {
+		return "", fmt.Errorf("invalid numeral %q", numeral)
+	}
+	accidental, roman, extension := match[1], match[2], match[3]
+
+	scale := majorScale
+	if mode == modeMinor {
+		scale = minorScale
+	}
+	root := tonic + scale[romanDegrees[strings.ToLower(roman)]]
+	switch accidental {
+	case "b":
+		root--
+	case "#":
+		root++
+	}
+
+	notes := sharpNotes
+	keyName := key
+	if mode == modeMinor {
+		keyName += "m"
+	}
+	if flatKeys[keyName] || accidental == "b" {
+		notes = flatNotes
+	}
+	name := notes[(root%12+12)%12]
+
+	minor := roman == strings.ToLower(roman)
+	switch {
+	case extension == "°":
+		return name + "dim", nil
+	case minor && extension == "7":
+		return name + "m7", nil
+	case minor && extension == "":
+		return name + "m", nil
+	case minor:
+		return "", fmt.Errorf("invalid numeral %q", numeral)
+	default:
+		return name + extension, nil
+	}
+}
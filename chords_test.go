@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpellChord(t *testing.T) {
+	tests := []struct {
+		key, mode, numeral, chord string
+	}{
+		{"G", modeMajor, "vi", "Em"},
+		{"G", modeMajor, "V", "D"},
+		{"E", modeMinor, "VI", "C"},
+		{"E", modeMinor, "VII", "D"},
+		{"A", modeMinor, "V7", "E7"},
+		{"F", modeMajor, "bVII", "Eb"},
+		{"E", modeMajor, "bVII", "D"},
+		{"A", modeMajor, "I7", "A7"},
+		{"Bb", modeMajor, "ii7", "Cm7"},
+		{"C", modeMajor, "IVmaj7", "Fmaj7"},
+		{"D", modeMinor, "ii°", "Edim"},
+		{"F#", modeMinor, "III", "A"},
+		{"B", modeMajor, "iii", "D#m"},
+		{"Eb", modeMajor, "V", "Bb"},
+	}
+	for _, test := range tests {
+		chord, err := spellChord(test.key, test.mode, test.numeral)
+		require.NoError(t, err)
+		assert.Equal(t, test.chord, chord, "%s in %s %s", test.numeral, test.key, test.mode)
+	}
+
+	_, err := spellChord("H", modeMajor, "I")
+	assert.EqualError(t, err, `unknown key "H"`)
+	_, err = spellChord("C", modeMajor, "VIII")
+	assert.EqualError(t, err, `invalid numeral "VIII"`)
+	_, err = spellChord("C", modeMajor, "iimaj7")
+	assert.EqualError(t, err, `invalid numeral "iimaj7"`)
+}
+
+func TestHarmonyCoversCatalog(t *testing.T) {
+	catalog := DefaultCatalog()
+	for _, genre := range catalog.Genres.Entries() {
+		if genre.Parent == "" {
+			assert.Contains(t, genreHarmonies, genre.ID)
+		}
+	}
+	for _, emotion := range catalog.Emotions.Entries() {
+		assert.Contains(t, emotionHarmonies, emotion.ID)
+	}
+
+	for genre, harmony := range genreHarmonies {
+		for mode, keys := range map[string][]string{modeMajor: harmony.majorKeys, modeMinor: harmony.minorKeys} {
+			progressions := harmony.style.major
+			if mode == modeMinor {
+				progressions = harmony.style.minor
+			}
+			require.NotEmpty(t, progressions["verse"], "%s %s", genre, mode)
+			for _, key := range keys {
+				for _, candidates := range progressions {
+					for _, progression := range candidates {
+						for _, numeral := range strings.Fields(progression) {
+							_, err := spellChord(key, mode, numeral)
+							assert.NoError(t, err, "%s %s %s", genre, key, mode)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSuggestChords(t *testing.T) {
+	catalog := DefaultCatalog()
+	sections := []LyricsSection{{Name: "verse 1"}, {Name: "chorus"}, {Name: "verse 2"}, {Name: "chorus"}, {Name: "bridge"}}
+	req := LyricsRequest{Keywords: []string{"rain", "window"}, Genre: "pop", Emotion: "sad"}
+
+	chords := suggestChords(catalog, req, sections)
+	assert.Equal(t, modeMinor, chords.Mode)
+	assert.Contains(t, genreHarmonies["pop"].minorKeys, chords.Key)
+	assert.Equal(t, TempoRange{Min: 85, Max: 109}, chords.Tempo)
+	var names []string
+	for _, section := range chords.Sections {
+		names = append(names, section.Section)
+		assert.Len(t, section.Chords, len(section.Numerals))
+	}
+	assert.Equal(t, []string{"verse 1", "chorus", "verse 2", "bridge"}, names)
+	assert.Equal(t, chords.Sections[0].Chords, chords.Sections[2].Chords, "verses share a progression")
+
+	// The same request always gets the same suggestions
+	assert.Equal(t, chords, suggestChords(catalog, req, sections))
+
+	// Sub-genres use their root genre's style with their own tempo
+	dnb := suggestChords(catalog, LyricsRequest{Genre: "drum-and-bass", Emotion: "energetic"}, sections)
+	assert.Equal(t, modeMajor, dnb.Mode)
+	assert.Contains(t, genreHarmonies["electronic"].majorKeys, dnb.Key)
+	assert.Equal(t, TempoRange{Min: 176, Max: 198}, dnb.Tempo)
+
+	// Blues verses are twelve bars
+	blues := suggestChords(catalog, LyricsRequest{Genre: "delta-blues", Emotion: "happy"}, sections[:1])
+	assert.Len(t, blues.Sections[0].Chords, 12)
+	assert.Equal(t, "I7", blues.Sections[0].Numerals[0])
+}
+
+func TestGenerateLyricsIncludesChords(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newTestGateway(t, "[Title: Rain]\n[Verse 1]\nRain on the glass\n[Chorus]\nStay\n[Verse 2]\nGrey skies\n[Chorus]\nStay", &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+	router.GET("/lyrics/:id/export", exportLyrics(service))
+	generate := func(body string) LyricsResponse {
+		req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response LyricsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := generate(`{"keywords":["rain"],"genre":"folk","emotion":"melancholic","language":"english"}`)
+	assert.Nil(t, response.Chords)
+
+	response = generate(`{"keywords":["rain"],"genre":"folk","emotion":"melancholic","language":"english","include_chords":true}`)
+	require.NotNil(t, response.Chords)
+	assert.Equal(t, modeMinor, response.Chords.Mode)
+	require.Len(t, response.Chords.Sections, 3)
+	verse := response.Chords.Sections[0]
+	assert.Equal(t, "verse 1", verse.Section)
+
+	// The suggestions are carried into the ChordPro export
+	req, _ := http.NewRequest("GET", "/lyrics/"+response.ID+"/export?format=chordpro", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "{key: "+response.Chords.KeyName()+"}\n{tempo: ")
+	assert.Contains(t, w.Body.String(), fmt.Sprintf("{start_of_verse: Verse 1}\n[%s]Rain [%s]on [%s]the [%s]glass\n", verse.Chords[0], verse.Chords[1], verse.Chords[2], verse.Chords[3]))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ClientAuthMethod is the OAuth client authentication method used at the token endpoint
+type ClientAuthMethod string
+
+const (
+	// ClientAuthSecretPost sends client_id and client_secret in the form body
+	ClientAuthSecretPost ClientAuthMethod = "client_secret_post"
+	// ClientAuthSecretBasic sends the client credentials in an HTTP Basic header
+	ClientAuthSecretBasic ClientAuthMethod = "client_secret_basic"
+	// ClientAuthPrivateKeyJWT sends a signed JWT assertion (RFC 7523)
+	ClientAuthPrivateKeyJWT ClientAuthMethod = "private_key_jwt"
+)
+
+// jwtBearerAssertionType is the client_assertion_type for private_key_jwt
+const jwtBearerAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionLifetime bounds how long a signed client assertion is accepted
+const clientAssertionLifetime = 5 * time.Minute
+
+// ParseClientAuthMethod validates a configured client authentication method
+func ParseClientAuthMethod(value string) (ClientAuthMethod, error) {
+	switch method := ClientAuthMethod(strings.ToLower(strings.TrimSpace(value))); method {
+	case "":
+		return ClientAuthSecretPost, nil
+	case ClientAuthSecretPost, ClientAuthSecretBasic, ClientAuthPrivateKeyJWT:
+		return method, nil
+	default:
+		return "", fmt.Errorf("unsupported client auth method %q (supported: %s, %s, %s)",
+			value, ClientAuthSecretPost, ClientAuthSecretBasic, ClientAuthPrivateKeyJWT)
+	}
+}
+
+// WithClientSecretBasic authenticates with an HTTP Basic header instead of form fields
+func WithClientSecretBasic() OAuthClientOption {
+	return func(o *OAuthClient) {
+		o.authMethod = ClientAuthSecretBasic
+	}
+}
+
+// WithPrivateKeyJWT authenticates with a client assertion signed by key. The key ID,
+// if set, is sent in the JWT header so the provider can select the verification key.
+func WithPrivateKeyJWT(key crypto.Signer, keyID string) OAuthClientOption {
+	return func(o *OAuthClient) {
+		o.authMethod = ClientAuthPrivateKeyJWT
+		o.credentials.SigningKey = key
+		o.credentials.SigningKeyID = keyID
+	}
+}
+
+// LoadPrivateKeyPEM loads an RSA or ECDSA (P-256) private key from a PEM file
+func LoadPrivateKeyPEM(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	return parsePrivateKeyPEM(data)
+}
+
+// parsePrivateKeyPEM parses PKCS#1, PKCS#8 and SEC 1 encoded private keys
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in private key")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s (only P-256 is supported)", k.Curve.Params().Name)
+		}
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// clientAuthentication adds the client credentials to the token request form and
+// returns the Authorization header value to send, if the method uses one
+func (o *OAuthClient) clientAuthentication(data url.Values, creds ClientCredentials) (string, error) {
+	switch o.authMethod {
+	case ClientAuthSecretBasic:
+		// RFC 6749 section 2.3.1: credentials are form-encoded before base64
+		credentials := url.QueryEscape(creds.ClientID) + ":" + url.QueryEscape(creds.ClientSecret)
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)), nil
+	case ClientAuthPrivateKeyJWT:
+		assertion, err := o.signClientAssertion(creds, time.Now())
+		if err != nil {
+			return "", fmt.Errorf("failed to sign client assertion: %w", err)
+		}
+		data.Set("client_id", creds.ClientID)
+		data.Set("client_assertion_type", jwtBearerAssertionType)
+		data.Set("client_assertion", assertion)
+		return "", nil
+	default:
+		data.Set("client_id", creds.ClientID)
+		data.Set("client_secret", creds.ClientSecret)
+		return "", nil
+	}
+}
+
+// signClientAssertion builds a private_key_jwt client assertion (RFC 7523 section 3)
+func (o *OAuthClient) signClientAssertion(creds ClientCredentials, now time.Time) (string, error) {
+	if creds.SigningKey == nil {
+		return "", fmt.Errorf("no signing key configured")
+	}
+
+	var alg string
+	switch creds.SigningKey.(type) {
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		alg = "ES256"
+	default:
+		return "", fmt.Errorf("unsupported signing key type %T", creds.SigningKey)
+	}
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if creds.SigningKeyID != "" {
+		header["kid"] = creds.SigningKeyID
+	}
+	claims := map[string]interface{}{
+		"iss": creds.ClientID,
+		"sub": creds.ClientID,
+		"aud": o.tokenEndpoint,
+		"jti": uuid.New().String(),
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := creds.SigningKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	// JWS uses the fixed-size r||s encoding for ECDSA rather than ASN.1
+	if alg == "ES256" {
+		signature, err = ecdsaASN1ToRaw(signature, 32)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ecdsaASN1ToRaw converts an ASN.1 DER ECDSA signature into r||s with fixed-size halves
+func ecdsaASN1ToRaw(der []byte, size int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("invalid ECDSA signature: %w", err)
+	}
+
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCapturingTokenServer records the last token request it received
+func newCapturingTokenServer(t *testing.T) (*httptest.Server, *http.Request, *url.Values) {
+	captured := &http.Request{}
+	form := &url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		*captured = *r.Clone(context.Background())
+		*form = r.PostForm
+		json.NewEncoder(w).Encode(OAuthTokenResponse{AccessToken: "token", TokenType: "Bearer", ExpiresIn: 3600})
+	}))
+	t.Cleanup(server.Close)
+	return server, captured, form
+}
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+// decodeAssertion splits a compact JWS and returns its header, claims and signing input
+func decodeAssertion(t *testing.T, assertion string) (map[string]interface{}, map[string]interface{}, string, []byte) {
+	parts := strings.Split(assertion, ".")
+	require.Len(t, parts, 3)
+
+	var header, claims map[string]interface{}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(headerJSON, &header))
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(claimsJSON, &claims))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+
+	return header, claims, parts[0] + "." + parts[1], signature
+}
+
+func TestParseClientAuthMethod(t *testing.T) {
+	method, err := ParseClientAuthMethod("")
+	assert.NoError(t, err)
+	assert.Equal(t, ClientAuthSecretPost, method)
+
+	method, err = ParseClientAuthMethod("Client_Secret_Basic")
+	assert.NoError(t, err)
+	assert.Equal(t, ClientAuthSecretBasic, method)
+
+	_, err = ParseClientAuthMethod("tls_client_auth")
+	assert.Error(t, err)
+}
+
+func TestClientSecretPost(t *testing.T) {
+	server, captured, form := newCapturingTokenServer(t)
+	client := NewOAuthClient(server.URL, "my-client", "my-secret", "openai:chat")
+
+	_, err := client.GetAccessToken(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, "my-client", form.Get("client_id"))
+	assert.Equal(t, "my-secret", form.Get("client_secret"))
+	assert.Equal(t, "openai:chat", form.Get("scope"))
+	assert.Empty(t, captured.Header.Get("Authorization"))
+}
+
+func TestClientSecretBasic(t *testing.T) {
+	server, captured, form := newCapturingTokenServer(t)
+	client := NewOAuthClient(server.URL, "my client", "s3cr3t:&", "", WithClientSecretBasic())
+
+	_, err := client.GetAccessToken(context.Background())
+	require.NoError(t, err)
+
+	user, pass, ok := captured.BasicAuth()
+	require.True(t, ok)
+	assert.Equal(t, url.QueryEscape("my client"), user)
+	assert.Equal(t, url.QueryEscape("s3cr3t:&"), pass)
+	assert.Empty(t, form.Get("client_secret"))
+	assert.Empty(t, form.Get("client_id"))
+}
+
+func TestPrivateKeyJWTWithRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signer, err := LoadPrivateKeyPEM(writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)))
+	require.NoError(t, err)
+
+	server, _, form := newCapturingTokenServer(t)
+	client := NewOAuthClient(server.URL, "my-client", "", "", WithPrivateKeyJWT(signer, "key-1"))
+
+	_, err = client.GetAccessToken(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, jwtBearerAssertionType, form.Get("client_assertion_type"))
+	assert.Empty(t, form.Get("client_secret"))
+
+	header, claims, signingInput, signature := decodeAssertion(t, form.Get("client_assertion"))
+	assert.Equal(t, "RS256", header["alg"])
+	assert.Equal(t, "key-1", header["kid"])
+	assert.Equal(t, "my-client", claims["iss"])
+	assert.Equal(t, "my-client", claims["sub"])
+	assert.Equal(t, server.URL, claims["aud"])
+	assert.NotEmpty(t, claims["jti"])
+
+	digest := sha256.Sum256([]byte(signingInput))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+}
+
+func TestPrivateKeyJWTWithECKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	signer, err := LoadPrivateKeyPEM(writePEM(t, "PRIVATE KEY", der))
+	require.NoError(t, err)
+
+	server, _, form := newCapturingTokenServer(t)
+	client := NewOAuthClient(server.URL, "my-client", "", "", WithPrivateKeyJWT(signer, ""))
+
+	_, err = client.GetAccessToken(context.Background())
+	require.NoError(t, err)
+
+	header, _, signingInput, signature := decodeAssertion(t, form.Get("client_assertion"))
+	assert.Equal(t, "ES256", header["alg"])
+	assert.NotContains(t, header, "kid")
+	require.Len(t, signature, 64)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	assert.True(t, ecdsa.Verify(&key.PublicKey, digest[:], r, s))
+}
+
+func TestLoadPrivateKeyPEMRejectsInvalidInput(t *testing.T) {
+	_, err := LoadPrivateKeyPEM(filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+
+	_, err = LoadPrivateKeyPEM(writePEM(t, "CERTIFICATE", []byte("not a key")))
+	assert.Error(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	_, err = LoadPrivateKeyPEM(writePEM(t, "EC PRIVATE KEY", der))
+	assert.ErrorContains(t, err, "P-256")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// complianceScore measures from 0 to 1 how closely the lyrics follow the request:
+// the share of keywords that appear in the text, averaged with the share of the
+// requested sections that were produced
+func complianceScore(req LyricsRequest, lyrics GeneratedLyrics) float64 {
+	text := strings.ToLower(lyrics.Title)
+	present := map[string]bool{}
+	for section, content := range lyrics.Structure {
+		present[normalizeSectionName(section)] = true
+		text += "\n" + strings.ToLower(content)
+	}
+
+	keywordScore := 1.0
+	if len(req.Keywords) > 0 {
+		found := 0
+		for _, keyword := range req.Keywords {
+			if strings.Contains(text, strings.ToLower(strings.TrimSpace(keyword))) {
+				found++
+			}
+		}
+		keywordScore = float64(found) / float64(len(req.Keywords))
+	}
+
+	structureScore := 1.0
+	if sections := plannedSections(req.Structure); len(sections) > 0 {
+		found := 0
+		for _, section := range sections {
+			if present[section] {
+				found++
+			}
+		}
+		structureScore = float64(found) / float64(len(sections))
+	}
+
+	return math.Round((keywordScore+structureScore)/2*100) / 100
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/rs/zerolog"
+	zerologlog "github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete service configuration. It is loaded from an optional
+// YAML or TOML file and then overridden by environment variables.
+type Config struct {
+	Server      ServerConfig       `yaml:"server" toml:"server"`
+	OAuth       OAuthConfig        `yaml:"oauth" toml:"oauth"`
+	Providers   ProvidersConfig    `yaml:"providers" toml:"providers"`
+	Generation  GenerationConfig   `yaml:"generation" toml:"generation"`
+	Safety      SafetyConfig       `yaml:"safety" toml:"safety"`
+	Taxonomy    TaxonomyConfig     `yaml:"taxonomy" toml:"taxonomy"`
+	Prompts     PromptsConfig      `yaml:"prompts" toml:"prompts"`
+	Exemplars   ExemplarsConfig    `yaml:"exemplars" toml:"exemplars"`
+	Experiments []ExperimentConfig `yaml:"experiments" toml:"experiments"`
+	Similarity  SimilarityConfig   `yaml:"similarity" toml:"similarity"`
+	Storage     StorageConfig      `yaml:"storage" toml:"storage"`
+	Admin       AdminConfig        `yaml:"admin" toml:"admin"`
+
+	// catalog, prompts, exemplars and corpus are loaded from their files during validation
+	catalog   *Catalog
+	prompts   *PromptLibrary
+	exemplars *ExemplarLibrary
+	corpus    *LyricsCorpus
+}
+
+// ServerConfig configures the HTTP server
+type ServerConfig struct {
+	Port            string   `yaml:"port" toml:"port"`
+	Mode            string   `yaml:"mode" toml:"mode"`
+	LogLevel        string   `yaml:"log_level" toml:"log_level"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+// OAuthConfig configures the client credentials flow against the AI Gateway
+type OAuthConfig struct {
+	TokenEndpoint      string   `yaml:"token_endpoint" toml:"token_endpoint"`
+	ClientID           string   `yaml:"client_id" toml:"client_id"`
+	ClientIDFile       string   `yaml:"client_id_file" toml:"client_id_file"`
+	ClientSecret       string   `yaml:"client_secret" toml:"client_secret"`
+	ClientSecretFile   string   `yaml:"client_secret_file" toml:"client_secret_file"`
+	Scope              string   `yaml:"scope" toml:"scope"`
+	AuthMethod         string   `yaml:"auth_method" toml:"auth_method"`
+	PrivateKeyFile     string   `yaml:"private_key_file" toml:"private_key_file"`
+	PrivateKeyID       string   `yaml:"private_key_id" toml:"private_key_id"`
+	RefreshFraction    float64  `yaml:"refresh_fraction" toml:"refresh_fraction"`
+	SecretPollInterval Duration `yaml:"secret_poll_interval" toml:"secret_poll_interval"`
+}
+
+// ProvidersConfig configures the upstream LLM providers
+type ProvidersConfig struct {
+	Gateway GatewayConfig `yaml:"gateway" toml:"gateway"`
+}
+
+// GatewayConfig configures the OpenAI-compatible AI Gateway
+type GatewayConfig struct {
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	Model    string `yaml:"model" toml:"model"`
+}
+
+// GenerationConfig holds the defaults applied to lyrics generation requests
+type GenerationConfig struct {
+	Temperature float64 `yaml:"temperature" toml:"temperature"`
+	// MaxTokens caps the completion size estimated from the target length and language
+	MaxTokens     int `yaml:"max_tokens" toml:"max_tokens"`
+	DefaultVerses int `yaml:"default_verses" toml:"default_verses"`
+	// Truncation is "continue" to finish cut-off lyrics with follow-up calls, or
+	// "warn" to return them with a warning
+	Truncation       string `yaml:"truncation" toml:"truncation"`
+	MaxContinuations int    `yaml:"max_continuations" toml:"max_continuations"`
+	// LanguageMismatch is "retry" to regenerate once when sections come back in another
+	// language than requested, or "warn" to return them with a warning
+	LanguageMismatch string `yaml:"language_mismatch" toml:"language_mismatch"`
+}
+
+// SafetyConfig is the local content policy applied before calling the gateway
+type SafetyConfig struct {
+	BlockedKeywords []string `yaml:"blocked_keywords" toml:"blocked_keywords"`
+}
+
+// TaxonomyConfig selects the catalog of accepted genres, emotions and languages
+type TaxonomyConfig struct {
+	// CatalogFile is a YAML or TOML catalog; the built-in catalog is used when empty
+	CatalogFile string `yaml:"catalog_file" toml:"catalog_file"`
+}
+
+// PromptsConfig selects the prompt templates
+type PromptsConfig struct {
+	// Dir holds one subdirectory per prompt version; the built-in prompts are used when empty
+	Dir     string `yaml:"dir" toml:"dir"`
+	Version string `yaml:"version" toml:"version"`
+}
+
+// ExemplarsConfig configures the few-shot exemplars added to prompts
+type ExemplarsConfig struct {
+	// File is a YAML or TOML exemplar library, updated by the admin API; the built-in
+	// exemplars are used when empty
+	File string `yaml:"file" toml:"file"`
+	// TokenBudget caps the estimated tokens of the exemplars in one prompt; 0 disables them
+	TokenBudget int `yaml:"token_budget" toml:"token_budget"`
+	MaxExamples int `yaml:"max_examples" toml:"max_examples"`
+}
+
+// ExperimentConfig defines an A/B experiment over prompt versions and temperatures
+type ExperimentConfig struct {
+	Name    string `yaml:"name" toml:"name"`
+	Enabled bool   `yaml:"enabled" toml:"enabled"`
+	// Unit is "api_key" (the default, falling back to the request when no key is
+	// sent) or "request"
+	Unit string      `yaml:"unit" toml:"unit"`
+	Arms []ArmConfig `yaml:"arms" toml:"arms"`
+}
+
+// ArmConfig is one variant of an experiment; unset fields keep the regular settings
+type ArmConfig struct {
+	Name          string   `yaml:"name" toml:"name"`
+	Weight        int      `yaml:"weight" toml:"weight"`
+	PromptVersion string   `yaml:"prompt_version" toml:"prompt_version"`
+	Temperature   *float64 `yaml:"temperature" toml:"temperature"`
+}
+
+// SimilarityConfig configures the check of new lyrics against earlier songs and a
+// corpus of known lyrics
+type SimilarityConfig struct {
+	// Threshold is the similarity from 0 to 1 at which lyrics count as a near-duplicate;
+	// 0 disables the check
+	Threshold float64 `yaml:"threshold" toml:"threshold"`
+	// Action is "regenerate" to ask once for new lyrics, or "warn" to return them with
+	// a warning
+	Action string `yaml:"action" toml:"action"`
+	// CorpusFile is a YAML or TOML list of known lyrics to compare against
+	CorpusFile string `yaml:"corpus_file" toml:"corpus_file"`
+}
+
+// StorageConfig configures where generated songs are kept
+type StorageConfig struct {
+	// MaxSongs is the number of songs kept in memory before the oldest are evicted
+	MaxSongs int `yaml:"max_songs" toml:"max_songs"`
+}
+
+// AdminConfig configures the admin API
+type AdminConfig struct {
+	// Token is the bearer token for /admin; the admin API is disabled when empty
+	Token string `yaml:"token" toml:"token"`
+}
+
+// Duration is a time.Duration that is written as a string ("30s") in config files
+type Duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// DefaultConfig returns the configuration used when nothing is set
+func DefaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:            "8080",
+			Mode:            "debug",
+			LogLevel:        "",
+			ShutdownTimeout: Duration(30 * time.Second),
+		},
+		OAuth: OAuthConfig{
+			AuthMethod:         string(ClientAuthSecretPost),
+			RefreshFraction:    0.8,
+			SecretPollInterval: Duration(30 * time.Second),
+		},
+		Providers: ProvidersConfig{
+			Gateway: GatewayConfig{
+				Model: "gpt-3.5-turbo",
+			},
+		},
+		Generation: GenerationConfig{
+			Temperature:      0.8,
+			MaxTokens:        4000,
+			Truncation:       truncationContinue,
+			MaxContinuations: 1,
+			LanguageMismatch: languageMismatchRetry,
+			DefaultVerses:    2,
+		},
+		Prompts: PromptsConfig{
+			Version: defaultPromptVersion,
+		},
+		Exemplars: ExemplarsConfig{
+			TokenBudget: defaultExemplarTokenBudget,
+			MaxExamples: defaultMaxExemplars,
+		},
+		Similarity: SimilarityConfig{
+			Threshold: 0.6,
+			Action:    similarityWarn,
+		},
+		Storage: StorageConfig{
+			MaxSongs: defaultStoreCapacity,
+		},
+		catalog: DefaultCatalog(),
+		prompts: DefaultPrompts(),
+	}
+}
+
+// LoadConfig reads the config file at path (if any), applies environment overrides
+// and validates the result. All validation problems are returned together.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		if err := decodeFile(path, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	// A malformed environment variable or unreadable secret file leaves its setting
+	// as it was, so the rest of the configuration is still validated and every
+	// problem reported at once
+	if err := errors.Join(cfg.applyEnv(), cfg.loadSecretFiles(), cfg.Validate()); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// decodeFile decodes a YAML (.yaml, .yml) or TOML (.toml) file, rejecting
+// unknown keys so that typos are reported instead of silently ignored
+func decodeFile(path string, out interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(out); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported file extension %q (use .yaml, .yml or .toml)", filepath.Ext(path))
+	}
+	return nil
+}
+
+// applyEnv overrides file settings with the environment variables the service has
+// always used, so existing deployments keep working without a config file
+func (c *Config) applyEnv() error {
+	strs := []struct {
+		name   string
+		target *string
+	}{
+		{"PORT", &c.Server.Port},
+		{"GIN_MODE", &c.Server.Mode},
+		{"LOG_LEVEL", &c.Server.LogLevel},
+		{"PROMPTS_DIR", &c.Prompts.Dir},
+		{"PROMPT_VERSION", &c.Prompts.Version},
+		{"EXEMPLARS_FILE", &c.Exemplars.File},
+		{"SIMILARITY_CORPUS_FILE", &c.Similarity.CorpusFile},
+		{"ADMIN_TOKEN", &c.Admin.Token},
+		{"AI_GATEWAY_CONSUMER_KEY", &c.OAuth.ClientID},
+		{"AI_GATEWAY_CONSUMER_KEY_FILE", &c.OAuth.ClientIDFile},
+		{"AI_GATEWAY_CONSUMER_SECRET", &c.OAuth.ClientSecret},
+		{"AI_GATEWAY_CONSUMER_SECRET_FILE", &c.OAuth.ClientSecretFile},
+		{"AI_GATEWAY_TOKEN_ENDPOINT", &c.OAuth.TokenEndpoint},
+		{"AI_GATEWAY_SCOPE", &c.OAuth.Scope},
+		{"AI_GATEWAY_AUTH_METHOD", &c.OAuth.AuthMethod},
+		{"AI_GATEWAY_PRIVATE_KEY_FILE", &c.OAuth.PrivateKeyFile},
+		{"AI_GATEWAY_PRIVATE_KEY_ID", &c.OAuth.PrivateKeyID},
+		{"AI_GATEWAY_ENDPOINT", &c.Providers.Gateway.Endpoint},
+		{"OPENAI_MODEL", &c.Providers.Gateway.Model},
+	}
+	for _, s := range strs {
+		if v := os.Getenv(s.name); v != "" {
+			*s.target = v
+		}
+	}
+
+	var errs []error
+	if v := os.Getenv("AI_GATEWAY_TOKEN_REFRESH_FRACTION"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err != nil {
+			errs = append(errs, fmt.Errorf("AI_GATEWAY_TOKEN_REFRESH_FRACTION: %w", err))
+		} else {
+			c.OAuth.RefreshFraction = f
+		}
+	}
+	if v := os.Getenv("AI_GATEWAY_SECRET_POLL_INTERVAL"); v != "" {
+		if err := c.OAuth.SecretPollInterval.UnmarshalText([]byte(v)); err != nil {
+			errs = append(errs, fmt.Errorf("AI_GATEWAY_SECRET_POLL_INTERVAL: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// loadSecretFiles reads credentials configured as files; an inline value and a
+// file for the same credential are mutually exclusive
+func (c *Config) loadSecretFiles() error {
+	var errs []error
+	load := func(name, path string, target *string) {
+		if path == "" {
+			return
+		}
+		if *target != "" {
+			errs = append(errs, fmt.Errorf("oauth.%s and oauth.%s_file are both set", name, name))
+			return
+		}
+		value, err := readTrimmedFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("oauth.%s_file: %w", name, err))
+			return
+		}
+		*target = value
+	}
+	load("client_id", c.OAuth.ClientIDFile, &c.OAuth.ClientID)
+	load("client_secret", c.OAuth.ClientSecretFile, &c.OAuth.ClientSecret)
+	return errors.Join(errs...)
+}
+
+// Validate checks the whole configuration and reports every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 1 || port > 65535 {
+		fail("server.port must be a number between 1 and 65535, got %q", c.Server.Port)
+	}
+	if c.Server.Mode != "debug" && c.Server.Mode != "release" && c.Server.Mode != "test" {
+		fail("server.mode must be debug, release or test, got %q", c.Server.Mode)
+	}
+	if c.Server.LogLevel != "" {
+		if _, err := zerolog.ParseLevel(c.Server.LogLevel); err != nil {
+			fail("server.log_level: %v", err)
+		}
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		fail("server.shutdown_timeout must be positive")
+	}
+
+	method, err := ParseClientAuthMethod(c.OAuth.AuthMethod)
+	if err != nil {
+		fail("oauth.auth_method: %v", err)
+	}
+	// A credential set as a file is reported by loadSecretFiles if it cannot be read
+	if c.OAuth.ClientID == "" && c.OAuth.ClientIDFile == "" {
+		fail("oauth.client_id is required (AI_GATEWAY_CONSUMER_KEY)")
+	}
+	if c.OAuth.ClientSecret == "" && c.OAuth.ClientSecretFile == "" && method != ClientAuthPrivateKeyJWT {
+		fail("oauth.client_secret is required (AI_GATEWAY_CONSUMER_SECRET)")
+	}
+	if method == ClientAuthPrivateKeyJWT {
+		if c.OAuth.PrivateKeyFile == "" {
+			fail("oauth.private_key_file is required for private_key_jwt (AI_GATEWAY_PRIVATE_KEY_FILE)")
+		} else if _, err := LoadPrivateKeyPEM(c.OAuth.PrivateKeyFile); err != nil {
+			fail("oauth.private_key_file: %v", err)
+		}
+	}
+	if err := validateURL(c.OAuth.TokenEndpoint); err != nil {
+		fail("oauth.token_endpoint %v (AI_GATEWAY_TOKEN_ENDPOINT)", err)
+	}
+	if c.OAuth.RefreshFraction <= 0 || c.OAuth.RefreshFraction >= 1 {
+		fail("oauth.refresh_fraction must be between 0 and 1, got %v", c.OAuth.RefreshFraction)
+	}
+	if c.OAuth.SecretPollInterval <= 0 {
+		fail("oauth.secret_poll_interval must be positive")
+	}
+
+	if err := validateURL(c.Providers.Gateway.Endpoint); err != nil {
+		fail("providers.gateway.endpoint %v (AI_GATEWAY_ENDPOINT)", err)
+	}
+	if c.Providers.Gateway.Model == "" {
+		fail("providers.gateway.model is required")
+	}
+
+	errs = append(errs, c.validateReloadable()...)
+
+	// The exemplar library is edited at runtime, so its file is only read at startup
+	if c.catalog != nil {
+		exemplars, err := LoadExemplars(c.Exemplars.File, c.catalog)
+		if err != nil {
+			fail("exemplars.file: %v", err)
+		}
+		c.exemplars = exemplars
+	}
+	return errors.Join(errs...)
+}
+
+// validateReloadable checks the settings that can change on SIGHUP
+func (c *Config) validateReloadable() []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Generation.Temperature < 0 || c.Generation.Temperature > 2 {
+		fail("generation.temperature must be between 0 and 2, got %v", c.Generation.Temperature)
+	}
+	if c.Generation.MaxTokens <= 0 {
+		fail("generation.max_tokens must be positive, got %d", c.Generation.MaxTokens)
+	}
+	if c.Generation.DefaultVerses < 1 || c.Generation.DefaultVerses > 4 {
+		fail("generation.default_verses must be between 1 and 4, got %d", c.Generation.DefaultVerses)
+	}
+	if c.Generation.Truncation != truncationContinue && c.Generation.Truncation != truncationWarn {
+		fail("generation.truncation must be %q or %q, got %q", truncationContinue, truncationWarn, c.Generation.Truncation)
+	}
+	if c.Generation.MaxContinuations < 0 || c.Generation.MaxContinuations > 3 {
+		fail("generation.max_continuations must be between 0 and 3, got %d", c.Generation.MaxContinuations)
+	}
+	if c.Generation.LanguageMismatch != languageMismatchRetry && c.Generation.LanguageMismatch != languageMismatchWarn {
+		fail("generation.language_mismatch must be %q or %q, got %q", languageMismatchRetry, languageMismatchWarn, c.Generation.LanguageMismatch)
+	}
+	for i, keyword := range c.Safety.BlockedKeywords {
+		if strings.TrimSpace(keyword) == "" {
+			fail("safety.blocked_keywords[%d] is empty", i)
+		}
+	}
+	catalog, err := LoadCatalog(c.Taxonomy.CatalogFile)
+	if err != nil {
+		fail("taxonomy.catalog_file: %v", err)
+	}
+	c.catalog = catalog
+
+	prompts, err := LoadPrompts(c.Prompts.Dir)
+	if err != nil {
+		fail("prompts.dir: %v", err)
+	} else {
+		if _, ok := prompts.Version(c.Prompts.Version); !ok {
+			fail("prompts.version %q not found, available: %s", c.Prompts.Version, strings.Join(prompts.Versions(), ", "))
+		}
+		if catalog != nil {
+			if err := prompts.checkCatalog(catalog); err != nil {
+				fail("prompts.dir: %v", err)
+			}
+		}
+	}
+	c.prompts = prompts
+
+	if c.Exemplars.TokenBudget < 0 {
+		fail("exemplars.token_budget must not be negative, got %d", c.Exemplars.TokenBudget)
+	}
+	if c.Exemplars.MaxExamples < 0 {
+		fail("exemplars.max_examples must not be negative, got %d", c.Exemplars.MaxExamples)
+	}
+
+	if c.Similarity.Threshold < 0 || c.Similarity.Threshold > 1 {
+		fail("similarity.threshold must be between 0 and 1, got %v", c.Similarity.Threshold)
+	}
+	if c.Similarity.Action != similarityRegenerate && c.Similarity.Action != similarityWarn {
+		fail("similarity.action must be %q or %q, got %q", similarityRegenerate, similarityWarn, c.Similarity.Action)
+	}
+	corpus, err := LoadCorpus(c.Similarity.CorpusFile)
+	if err != nil {
+		fail("similarity.corpus_file: %v", err)
+	}
+	c.corpus = corpus
+
+	errs = append(errs, c.validateExperiments()...)
+	return errs
+}
+
+// validateExperiments checks the experiment and arm definitions
+func (c *Config) validateExperiments() []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	names := map[string]bool{}
+	enabled := 0
+	for i := range c.Experiments {
+		experiment := &c.Experiments[i]
+		field := fmt.Sprintf("experiments[%d]", i)
+		if experiment.Name == "" {
+			fail("%s.name is required", field)
+		} else if names[experiment.Name] {
+			fail("%s.name %q is used twice", field, experiment.Name)
+		}
+		names[experiment.Name] = true
+
+		if experiment.Unit == "" {
+			experiment.Unit = assignByAPIKey
+		}
+		if experiment.Unit != assignByAPIKey && experiment.Unit != assignByRequest {
+			fail("%s.unit must be %q or %q, got %q", field, assignByAPIKey, assignByRequest, experiment.Unit)
+		}
+		if experiment.Enabled {
+			enabled++
+		}
+		if len(experiment.Arms) == 0 {
+			fail("%s.arms must not be empty", field)
+		}
+
+		arms := map[string]bool{}
+		for j, arm := range experiment.Arms {
+			armField := fmt.Sprintf("%s.arms[%d]", field, j)
+			if arm.Name == "" {
+				fail("%s.name is required", armField)
+			} else if arms[arm.Name] {
+				fail("%s.name %q is used twice", armField, arm.Name)
+			}
+			arms[arm.Name] = true
+
+			if arm.Weight <= 0 {
+				fail("%s.weight must be positive, got %d", armField, arm.Weight)
+			}
+			if arm.PromptVersion != "" && c.prompts != nil {
+				if _, ok := c.prompts.Version(arm.PromptVersion); !ok {
+					fail("%s.prompt_version %q not found", armField, arm.PromptVersion)
+				}
+			}
+			if arm.Temperature != nil && (*arm.Temperature < 0 || *arm.Temperature > 2) {
+				fail("%s.temperature must be between 0 and 2, got %v", armField, *arm.Temperature)
+			}
+		}
+	}
+	// Arms of concurrent experiments would override each other's settings
+	if enabled > 1 {
+		fail("experiments: at most one experiment can be enabled, got %d", enabled)
+	}
+	return errs
+}
+
+// RestartRequired lists the settings that differ from other and only take effect
+// after a restart
+func (c *Config) RestartRequired(other *Config) []string {
+	var changed []string
+	if c.Server.Port != other.Server.Port {
+		changed = append(changed, "server.port")
+	}
+	if c.Server.Mode != other.Server.Mode {
+		changed = append(changed, "server.mode")
+	}
+	if c.Server.ShutdownTimeout != other.Server.ShutdownTimeout {
+		changed = append(changed, "server.shutdown_timeout")
+	}
+	if withoutRotatedSecrets(c.OAuth) != withoutRotatedSecrets(other.OAuth) {
+		changed = append(changed, "oauth")
+	}
+	if c.Providers.Gateway.Endpoint != other.Providers.Gateway.Endpoint {
+		changed = append(changed, "providers.gateway.endpoint")
+	}
+	if c.Storage != other.Storage {
+		changed = append(changed, "storage")
+	}
+	if c.Exemplars.File != other.Exemplars.File {
+		changed = append(changed, "exemplars.file")
+	}
+	return changed
+}
+
+// ServiceSettings derives the runtime generation settings from the configuration
+func (c *Config) ServiceSettings() *ServiceSettings {
+	blocked := make([]string, 0, len(c.Safety.BlockedKeywords))
+	for _, keyword := range c.Safety.BlockedKeywords {
+		blocked = append(blocked, strings.ToLower(strings.TrimSpace(keyword)))
+	}
+
+	return &ServiceSettings{
+		Model:           c.Providers.Gateway.Model,
+		Generation:      c.Generation,
+		BlockedKeywords: blocked,
+		Catalog:         c.catalog,
+		Prompts:         c.prompts,
+		PromptVersion:   c.Prompts.Version,
+		Experiments:     c.Experiments,
+		AdminToken:      c.Admin.Token,
+		Similarity:      c.Similarity,
+		Corpus:          c.corpus,
+
+		ExemplarTokenBudget: c.Exemplars.TokenBudget,
+		MaxExemplars:        c.Exemplars.MaxExamples,
+	}
+}
+
+// LogLevel returns the configured log level, defaulting on the server mode
+func (c *Config) LogLevel() zerolog.Level {
+	if level, err := zerolog.ParseLevel(c.Server.LogLevel); err == nil && c.Server.LogLevel != "" {
+		return level
+	}
+	if c.Server.Mode == "release" {
+		return zerolog.InfoLevel
+	}
+	return zerolog.DebugLevel
+}
+
+// withoutRotatedSecrets blanks the credentials that the CredentialWatcher rotates
+// live, so that a rotated file is not reported as a change requiring a restart
+func withoutRotatedSecrets(oauth OAuthConfig) OAuthConfig {
+	if oauth.ClientIDFile != "" {
+		oauth.ClientID = ""
+	}
+	if oauth.ClientSecretFile != "" {
+		oauth.ClientSecret = ""
+	}
+	return oauth
+}
+
+func validateURL(value string) error {
+	if value == "" {
+		return fmt.Errorf("is required")
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("must be an absolute http(s) URL, got %q", value)
+	}
+	return nil
+}
+
+// reloadConfig re-reads the configuration on SIGHUP and applies the settings that
+// can change at runtime. Invalid configurations are rejected as a whole, and
+// structural changes are reported but only take effect after a restart.
+func reloadConfig(path string, current *Config, service *LyricsService) *Config {
+	next, err := LoadConfig(path)
+	if err != nil {
+		zerologlog.Error().Err(err).Msg("Config reload rejected, keeping current configuration")
+		return current
+	}
+
+	if changed := current.RestartRequired(next); len(changed) > 0 {
+		zerologlog.Warn().Strs("settings", changed).Msg("Config changes require a restart and were not applied")
+		// Keep reporting them against the configuration that is actually running
+		logLevel := next.Server.LogLevel
+		next.Server = current.Server
+		next.Server.LogLevel = logLevel
+		next.OAuth = current.OAuth
+		next.Providers.Gateway.Endpoint = current.Providers.Gateway.Endpoint
+		next.Storage = current.Storage
+		next.Exemplars.File = current.Exemplars.File
+	}
+
+	zerolog.SetGlobalLevel(next.LogLevel())
+	service.ApplySettings(next.ServiceSettings())
+
+	zerologlog.Info().
+		Str("model", next.Providers.Gateway.Model).
+		Int("genres", len(next.catalog.Genres.Entries())).
+		Str("prompt_version", next.Prompts.Version).
+		Int("blocked_keywords", len(next.Safety.BlockedKeywords)).
+		Msg("Reloaded configuration")
+	return next
+}
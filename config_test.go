@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clearConfigEnv isolates a test from configuration set in the environment
+func clearConfigEnv(t *testing.T) {
+	for _, name := range []string{
+		"PORT", "GIN_MODE", "LOG_LEVEL", "OPENAI_MODEL", "PROMPTS_DIR", "PROMPT_VERSION", "EXEMPLARS_FILE", "ADMIN_TOKEN",
+		"SIMILARITY_CORPUS_FILE",
+		"AI_GATEWAY_CONSUMER_KEY", "AI_GATEWAY_CONSUMER_KEY_FILE",
+		"AI_GATEWAY_CONSUMER_SECRET", "AI_GATEWAY_CONSUMER_SECRET_FILE",
+		"AI_GATEWAY_TOKEN_ENDPOINT", "AI_GATEWAY_ENDPOINT", "AI_GATEWAY_SCOPE",
+		"AI_GATEWAY_AUTH_METHOD", "AI_GATEWAY_PRIVATE_KEY_FILE", "AI_GATEWAY_PRIVATE_KEY_ID",
+		"AI_GATEWAY_TOKEN_REFRESH_FRACTION", "AI_GATEWAY_SECRET_POLL_INTERVAL",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+const validYAMLConfig = `
+server:
+  port: "9090"
+  mode: release
+oauth:
+  token_endpoint: https://idp.example.com/oauth2/token
+  client_id: file-client
+  client_secret: file-secret
+providers:
+  gateway:
+    endpoint: https://gateway.example.com/openai/v1
+    model: gpt-4o-mini
+generation:
+  temperature: 0.5
+  max_tokens: 1200
+  default_verses: 3
+safety:
+  blocked_keywords: [forbidden]
+`
+
+func TestLoadConfigFromYAMLWithEnvOverrides(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("AI_GATEWAY_CONSUMER_SECRET", "env-secret")
+	t.Setenv("AI_GATEWAY_SECRET_POLL_INTERVAL", "1m")
+
+	cfg, err := LoadConfig(writeConfigFile(t, "config.yaml", validYAMLConfig))
+	require.NoError(t, err)
+
+	assert.Equal(t, "9090", cfg.Server.Port)
+	assert.Equal(t, "file-client", cfg.OAuth.ClientID)
+	assert.Equal(t, "env-secret", cfg.OAuth.ClientSecret)
+	assert.Equal(t, Duration(time.Minute), cfg.OAuth.SecretPollInterval)
+	assert.Equal(t, 0.8, cfg.OAuth.RefreshFraction)
+	assert.Equal(t, "gpt-4o-mini", cfg.Providers.Gateway.Model)
+	assert.Equal(t, 3, cfg.Generation.DefaultVerses)
+	assert.Same(t, DefaultCatalog(), cfg.ServiceSettings().Catalog)
+}
+
+func TestLoadConfigFromTOML(t *testing.T) {
+	clearConfigEnv(t)
+	secretFile := writeConfigFile(t, "secret", "mounted-secret\n")
+
+	cfg, err := LoadConfig(writeConfigFile(t, "config.toml", `
+[oauth]
+token_endpoint = "https://idp.example.com/oauth2/token"
+client_id = "toml-client"
+client_secret_file = "`+secretFile+`"
+secret_poll_interval = "10s"
+
+[providers.gateway]
+endpoint = "https://gateway.example.com"
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, "toml-client", cfg.OAuth.ClientID)
+	assert.Equal(t, "mounted-secret", cfg.OAuth.ClientSecret)
+	assert.Equal(t, Duration(10*time.Second), cfg.OAuth.SecretPollInterval)
+}
+
+func TestLoadConfigFromEnvOnly(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("AI_GATEWAY_CONSUMER_KEY", "key")
+	t.Setenv("AI_GATEWAY_CONSUMER_SECRET", "secret")
+	t.Setenv("AI_GATEWAY_TOKEN_ENDPOINT", "https://idp.example.com/token")
+	t.Setenv("AI_GATEWAY_ENDPOINT", "https://gateway.example.com")
+
+	cfg, err := LoadConfig("")
+	require.NoError(t, err)
+	assert.Equal(t, "8080", cfg.Server.Port)
+	assert.Equal(t, "gpt-3.5-turbo", cfg.Providers.Gateway.Model)
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	clearConfigEnv(t)
+	// A malformed environment variable is reported along with the file's errors
+	t.Setenv("AI_GATEWAY_SECRET_POLL_INTERVAL", "often")
+	_, err := LoadConfig(writeConfigFile(t, "config.yaml", `
+server:
+  port: "http"
+oauth:
+  refresh_fraction: 1.5
+generation:
+  temperature: 3
+taxonomy:
+  catalog_file: /does/not/exist.yaml
+`))
+	require.Error(t, err)
+
+	for _, message := range []string{
+		"server.port",
+		"oauth.client_id is required",
+		"oauth.client_secret is required",
+		"oauth.token_endpoint",
+		"oauth.refresh_fraction",
+		"providers.gateway.endpoint",
+		"generation.temperature",
+		"taxonomy.catalog_file",
+		"AI_GATEWAY_SECRET_POLL_INTERVAL",
+	} {
+		assert.Contains(t, err.Error(), message)
+	}
+}
+
+func TestLoadConfigReportsEnvAndSecretFileErrorsWithValidation(t *testing.T) {
+	clearConfigEnv(t)
+
+	// A malformed variable is reported once and does not reset its setting
+	t.Setenv("AI_GATEWAY_TOKEN_REFRESH_FRACTION", "abc")
+	_, err := LoadConfig(writeConfigFile(t, "config.yaml", validYAMLConfig))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "AI_GATEWAY_TOKEN_REFRESH_FRACTION")
+	assert.NotContains(t, err.Error(), "oauth.refresh_fraction")
+	assert.Len(t, strings.Split(err.Error(), "\n"), 1)
+
+	// An unreadable secret file does not hide the other problems
+	t.Setenv("AI_GATEWAY_TOKEN_REFRESH_FRACTION", "")
+	t.Setenv("AI_GATEWAY_ENDPOINT", "not a url")
+	_, err = LoadConfig(writeConfigFile(t, "config.yaml", `
+oauth:
+  token_endpoint: https://idp.example.com/oauth2/token
+  client_id: file-client
+  client_secret_file: /does/not/exist
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "oauth.client_secret_file")
+	assert.Contains(t, err.Error(), "providers.gateway.endpoint")
+	assert.NotContains(t, err.Error(), "oauth.client_secret is required")
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	clearConfigEnv(t)
+	_, err := LoadConfig(writeConfigFile(t, "config.yaml", "server:\n  prot: \"8080\"\n"))
+	assert.ErrorContains(t, err, "prot")
+
+	_, err = LoadConfig(writeConfigFile(t, "config.json", "{}"))
+	assert.ErrorContains(t, err, "unsupported file extension")
+}
+
+func TestReloadConfigAppliesRuntimeSettingsOnly(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, "config.yaml", validYAMLConfig)
+	current, err := LoadConfig(path)
+	require.NoError(t, err)
+
+	service := &LyricsService{}
+	service.ApplySettings(current.ServiceSettings())
+
+	updated := bytes.Replace([]byte(validYAMLConfig), []byte(`port: "9090"`), []byte(`port: "9191"`), 1)
+	updated = bytes.Replace(updated, []byte("temperature: 0.5"), []byte("temperature: 1.1"), 1)
+	require.NoError(t, os.WriteFile(path, updated, 0o600))
+
+	next := reloadConfig(path, current, service)
+	assert.Equal(t, "9090", next.Server.Port)
+	assert.Equal(t, 1.1, service.Settings().Generation.Temperature)
+
+	// An invalid file leaves everything as it was
+	require.NoError(t, os.WriteFile(path, []byte("generation:\n  max_tokens: -1\n"), 0o600))
+	assert.Same(t, next, reloadConfig(path, next, service))
+	assert.Equal(t, 1.1, service.Settings().Generation.Temperature)
+}
+
+func TestGenerateLyricsUsesServiceSettings(t *testing.T) {
+	clearConfigEnv(t)
+	catalogFile := writeConfigFile(t, "catalog.yaml", `
+genres:
+  - {id: synthwave, display_names: {en: Synthwave}, aliases: [outrun]}
+emotions:
+  - {id: happy, display_names: {en: Happy}}
+languages:
+  - {id: english, display_names: {en: English}}
+`)
+	cfg, err := LoadConfig(writeConfigFile(t, "config.yaml", validYAMLConfig+"taxonomy:\n  catalog_file: "+catalogFile+"\n"))
+	require.NoError(t, err)
+
+	service := &LyricsService{}
+	service.ApplySettings(cfg.ServiceSettings())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{"genre not in catalog", `{"keywords":["love"],"genre":"rock","emotion":"happy","language":"english"}`, http.StatusBadRequest, "invalid_genre"},
+		{"blocked keyword", `{"keywords":["Forbidden fruit"],"genre":"Outrun","emotion":"happy","language":"english"}`, http.StatusBadRequest, "content_blocked"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Contains(t, w.Body.String(), tt.wantError)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxIntensity     = 5
+	defaultIntensity = 3
+)
+
+// Song positions that can be used in an emotion arc instead of a section name
+const (
+	positionStart  = "start"
+	positionMiddle = "middle"
+	positionEnd    = "end"
+)
+
+// SectionEmotion assigns an emotion and its intensity to a section or song position
+type SectionEmotion struct {
+	// Section is a section ("verse 2", "chorus", "bridge"), every verse ("verse")
+	// or a song position ("start", "middle", "end")
+	Section   string `json:"section" binding:"required"`
+	Emotion   string `json:"emotion" binding:"required"`
+	Intensity int    `json:"intensity,omitempty" binding:"omitempty,min=1,max=5"`
+}
+
+var sectionNamePattern = regexp.MustCompile(`^(verse|chorus|bridge)[\s_-]*(\d*)$`)
+
+// plannedSections lists the distinct sections requested, in song order. The chorus
+// repeats, so it is listed once after the first verse.
+func plannedSections(structure SongStructure) []string {
+	var sections []string
+	for i := 1; i <= structure.Verses; i++ {
+		sections = append(sections, fmt.Sprintf("verse %d", i))
+		if i == 1 && structure.Chorus {
+			sections = append(sections, "chorus")
+		}
+	}
+	if structure.Bridge {
+		sections = append(sections, "bridge")
+	}
+	return sections
+}
+
+// songPosition places a non-repeating section at the start, middle or end of the
+// song, splitting the verses and bridge into thirds
+func songPosition(index, count int) string {
+	switch {
+	case index*3 < count:
+		return positionStart
+	case (index+1)*3 > 2*count:
+		return positionEnd
+	default:
+		return positionMiddle
+	}
+}
+
+// resolveEmotionArc expands the requested arc into one entry per planned section, in
+// song order. The most specific assignment wins: a numbered section, then all verses,
+// then a song position; unassigned sections keep the request's overall emotion.
+func resolveEmotionArc(emotions *CatalogSet, req LyricsRequest) ([]SectionEmotion, error) {
+	sections := plannedSections(req.Structure)
+	planned := map[string]bool{}
+	for _, section := range sections {
+		planned[section] = true
+	}
+
+	const (
+		byPosition = iota
+		byKind
+		bySection
+	)
+	assigned := map[string]SectionEmotion{}
+	specificity := map[string]int{}
+	seen := map[string]bool{}
+	assign := func(section string, level int, point SectionEmotion) {
+		if current, ok := specificity[section]; !ok || level > current {
+			point.Section = section
+			assigned[section] = point
+			specificity[section] = level
+		}
+	}
+
+	for _, point := range req.EmotionArc {
+		entry, ok := emotions.Lookup(point.Emotion)
+		if !ok {
+			return nil, fmt.Errorf("unsupported emotion %q in emotion_arc, supported emotions: %s",
+				point.Emotion, strings.Join(emotions.IDs(), ", "))
+		}
+		point.Emotion = entry.ID
+		if point.Intensity == 0 {
+			point.Intensity = defaultIntensity
+		}
+
+		target := normalizeSectionName(point.Section)
+		if seen[target] {
+			return nil, fmt.Errorf("section %q appears more than once in emotion_arc", point.Section)
+		}
+		seen[target] = true
+
+		switch target {
+		case positionStart, positionMiddle, positionEnd:
+			matched := false
+			positional := nonRepeatingSections(sections)
+			for i, section := range positional {
+				if songPosition(i, len(positional)) == target {
+					assign(section, byPosition, point)
+					matched = true
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("the song has no %s section; add verses or a bridge", target)
+			}
+		case "verse":
+			for _, section := range sections {
+				if strings.HasPrefix(section, "verse ") {
+					assign(section, byKind, point)
+				}
+			}
+		default:
+			if !planned[target] {
+				return nil, fmt.Errorf("section %q is not part of the requested structure (%s)",
+					point.Section, strings.Join(sections, ", "))
+			}
+			assign(target, bySection, point)
+		}
+	}
+
+	arc := make([]SectionEmotion, 0, len(sections))
+	for _, section := range sections {
+		point, ok := assigned[section]
+		if !ok {
+			point = SectionEmotion{Section: section, Emotion: req.Emotion, Intensity: defaultIntensity}
+		}
+		arc = append(arc, point)
+	}
+	return arc, nil
+}
+
+// nonRepeatingSections drops the chorus, which recurs throughout the song
+func nonRepeatingSections(sections []string) []string {
+	var result []string
+	for _, section := range sections {
+		if section != "chorus" {
+			result = append(result, section)
+		}
+	}
+	return result
+}
+
+// normalizeSectionName maps "Verse 2", "verse2" and "VERSE-2" to "verse 2"
+func normalizeSectionName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	match := sectionNamePattern.FindStringSubmatch(name)
+	if match == nil || match[2] == "" {
+		return name
+	}
+	return match[1] + " " + match[2]
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveEmotionArc(t *testing.T) {
+	emotions := DefaultCatalog().Emotions
+	structure := SongStructure{Verses: 3, Chorus: true, Bridge: true}
+
+	tests := []struct {
+		name    string
+		arc     []SectionEmotion
+		want    []SectionEmotion
+		wantErr string
+	}{
+		{
+			name: "melancholic verses to hopeful chorus",
+			arc: []SectionEmotion{
+				{Section: "verse", Emotion: "melancholic", Intensity: 4},
+				{Section: "Chorus", Emotion: "hopeful", Intensity: 5},
+			},
+			want: []SectionEmotion{
+				{"verse 1", "melancholic", 4},
+				{"chorus", "hopeful", 5},
+				{"verse 2", "melancholic", 4},
+				{"verse 3", "melancholic", 4},
+				{"bridge", "sad", 3},
+			},
+		},
+		{
+			name: "numbered section beats kind beats position",
+			arc: []SectionEmotion{
+				{Section: "end", Emotion: "peaceful"},
+				{Section: "verse", Emotion: "sad"},
+				{Section: "VERSE-3", Emotion: "joyful", Intensity: 2},
+				{Section: "start", Emotion: "nostalgic"},
+			},
+			want: []SectionEmotion{
+				{"verse 1", "sad", 3},
+				{"chorus", "sad", 3},
+				{"verse 2", "sad", 3},
+				{"verse 3", "happy", 2},
+				{"bridge", "peaceful", 3},
+			},
+		},
+		{
+			name:    "section not in structure",
+			arc:     []SectionEmotion{{Section: "verse 4", Emotion: "sad"}},
+			wantErr: `"verse 4" is not part of the requested structure`,
+		},
+		{
+			name:    "unknown emotion",
+			arc:     []SectionEmotion{{Section: "chorus", Emotion: "angry"}},
+			wantErr: `unsupported emotion "angry"`,
+		},
+		{
+			name:    "duplicate section",
+			arc:     []SectionEmotion{{Section: "verse2", Emotion: "sad"}, {Section: "Verse 2", Emotion: "happy"}},
+			wantErr: "more than once",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc, err := resolveEmotionArc(emotions, LyricsRequest{Emotion: "sad", EmotionArc: tt.arc, Structure: structure})
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, arc)
+		})
+	}
+}
+
+func TestSongPosition(t *testing.T) {
+	positions := func(count int) []string {
+		var result []string
+		for i := 0; i < count; i++ {
+			result = append(result, songPosition(i, count))
+		}
+		return result
+	}
+	assert.Equal(t, []string{"start"}, positions(1))
+	assert.Equal(t, []string{"start", "end"}, positions(2))
+	assert.Equal(t, []string{"start", "middle", "end"}, positions(3))
+	assert.Equal(t, []string{"start", "start", "middle", "end", "end"}, positions(5))
+
+	_, err := resolveEmotionArc(DefaultCatalog().Emotions, LyricsRequest{
+		Emotion:    "sad",
+		EmotionArc: []SectionEmotion{{Section: "middle", Emotion: "hopeful"}},
+		Structure:  SongStructure{Verses: 2, Chorus: true},
+	})
+	assert.ErrorContains(t, err, "no middle section")
+}
+
+func TestEmotionArcInPromptAndMetadata(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newTestGateway(t, "[Title: Turning]\n[Verse 1]\nGrey skies\n[Chorus]\nSun breaks through\n[Verse 2]\nGrey again", &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+
+	body := `{"keywords":["sky"],"genre":"pop","emotion":"sad","language":"english",
+		"emotion_arc":[{"section":"verse","emotion":"melancholic","intensity":4},{"section":"chorus","emotion":"hopeful"}]}`
+	req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response LyricsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []SectionEmotion{
+		{"verse 1", "melancholic", 4},
+		{"chorus", "hopeful", 3},
+		{"verse 2", "melancholic", 4},
+	}, response.Metadata.SectionEmotions)
+
+	require.Len(t, requests, 1)
+	raw, _ := json.Marshal(requests[0]["messages"])
+	assert.Contains(t, string(raw), "Verse 1: melancholic, intensity 4/5")
+	assert.Contains(t, string(raw), "Chorus: hopeful, intensity 3/5")
+}
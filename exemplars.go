@@ -0,0 +1,509 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pelletier/go-toml/v2"
+	zerologlog "github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultExemplarData is the built-in exemplar library used when no file is configured
+//
+//go:embed exemplars.yaml
+var defaultExemplarData []byte
+
+// Defaults for few-shot exemplar selection
+const (
+	defaultExemplarTokenBudget = 300
+	defaultMaxExemplars        = 3
+	maxExemplarLength          = 1000 // characters
+)
+
+var exemplarIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Exemplar is a short original lyric snippet used as a few-shot example. Genre and
+// emotion are optional; an untagged exemplar matches any genre or emotion.
+type Exemplar struct {
+	ID       string `yaml:"id" toml:"id" json:"id"`
+	Genre    string `yaml:"genre,omitempty" toml:"genre,omitempty" json:"genre,omitempty"`
+	Emotion  string `yaml:"emotion,omitempty" toml:"emotion,omitempty" json:"emotion,omitempty"`
+	Language string `yaml:"language" toml:"language" json:"language" binding:"required"`
+	Text     string `yaml:"text" toml:"text" json:"text" binding:"required"`
+}
+
+// exemplarFile is the on-disk layout of an exemplar library
+type exemplarFile struct {
+	Exemplars []Exemplar `yaml:"exemplars" toml:"exemplars"`
+}
+
+// ExemplarLibrary holds the exemplars and writes changes made through the admin API
+// back to its file. The built-in library has no file; changes to it last until restart.
+type ExemplarLibrary struct {
+	mutex     sync.RWMutex
+	path      string
+	exemplars map[string]Exemplar
+}
+
+// DefaultExemplars returns a new copy of the built-in exemplar library
+func DefaultExemplars() *ExemplarLibrary {
+	var file exemplarFile
+	if err := yaml.Unmarshal(defaultExemplarData, &file); err != nil {
+		panic(fmt.Sprintf("invalid built-in exemplars: %v", err))
+	}
+	library, err := newExemplarLibrary("", file, DefaultCatalog())
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in exemplars: %v", err))
+	}
+	return library
+}
+
+// LoadExemplars reads a YAML or TOML exemplar file and checks its tags against the
+// catalog; an empty path returns the built-in library
+func LoadExemplars(path string, catalog *Catalog) (*ExemplarLibrary, error) {
+	if path == "" {
+		return DefaultExemplars(), nil
+	}
+	var file exemplarFile
+	if err := decodeFile(path, &file); err != nil {
+		return nil, err
+	}
+	return newExemplarLibrary(path, file, catalog)
+}
+
+func newExemplarLibrary(path string, file exemplarFile, catalog *Catalog) (*ExemplarLibrary, error) {
+	library := &ExemplarLibrary{path: path, exemplars: map[string]Exemplar{}}
+	var errs []error
+	for i, exemplar := range file.Exemplars {
+		exemplar, err := exemplar.normalize(catalog)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("exemplars[%d]: %w", i, err))
+			continue
+		}
+		if _, exists := library.exemplars[exemplar.ID]; exists {
+			errs = append(errs, fmt.Errorf("exemplars[%d]: id %q is used twice", i, exemplar.ID))
+			continue
+		}
+		library.exemplars[exemplar.ID] = exemplar
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return library, nil
+}
+
+// normalize validates an exemplar and resolves its tags to canonical catalog IDs
+func (e Exemplar) normalize(catalog *Catalog) (Exemplar, error) {
+	e.ID = strings.TrimSpace(e.ID)
+	if !exemplarIDPattern.MatchString(e.ID) {
+		return e, fmt.Errorf("id %q must be lowercase letters, digits and dashes", e.ID)
+	}
+	e.Text = strings.TrimSpace(e.Text)
+	if e.Text == "" {
+		return e, fmt.Errorf("text is required")
+	}
+	if length := utf8.RuneCountInString(e.Text); length > maxExemplarLength {
+		return e, fmt.Errorf("text is %d characters, at most %d are allowed", length, maxExemplarLength)
+	}
+	if e.Language == "" {
+		return e, fmt.Errorf("language is required")
+	}
+
+	for _, tag := range []struct {
+		kind  string
+		set   *CatalogSet
+		value *string
+	}{
+		{"genre", catalog.Genres, &e.Genre},
+		{"emotion", catalog.Emotions, &e.Emotion},
+		{"language", catalog.Languages, &e.Language},
+	} {
+		if *tag.value == "" {
+			continue
+		}
+		entry, ok := tag.set.Lookup(*tag.value)
+		if !ok {
+			return e, fmt.Errorf("unknown %s %q", tag.kind, *tag.value)
+		}
+		*tag.value = entry.ID
+	}
+	return e, nil
+}
+
+// List returns the exemplars sorted by ID
+func (l *ExemplarLibrary) List() []Exemplar {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	exemplars := make([]Exemplar, 0, len(l.exemplars))
+	for _, exemplar := range l.exemplars {
+		exemplars = append(exemplars, exemplar)
+	}
+	sort.Slice(exemplars, func(i, j int) bool { return exemplars[i].ID < exemplars[j].ID })
+	return exemplars
+}
+
+// Get returns the exemplar with the given ID
+func (l *ExemplarLibrary) Get(id string) (Exemplar, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	exemplar, ok := l.exemplars[id]
+	return exemplar, ok
+}
+
+// Add inserts an exemplar unless one with its ID exists, and saves the library; it
+// reports whether the exemplar was added
+func (l *ExemplarLibrary) Add(exemplar Exemplar) (bool, error) {
+	return l.put(exemplar, false)
+}
+
+// Replace replaces an existing exemplar and saves the library; it reports whether
+// the exemplar existed
+func (l *ExemplarLibrary) Replace(exemplar Exemplar) (bool, error) {
+	return l.put(exemplar, true)
+}
+
+// put stores an exemplar if its ID is already taken (replace) or free (!replace),
+// checking and writing under one lock so that concurrent calls cannot both succeed.
+// The change is rolled back if the file cannot be written.
+func (l *ExemplarLibrary) put(exemplar Exemplar, replace bool) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	previous, existed := l.exemplars[exemplar.ID]
+	if existed != replace {
+		return false, nil
+	}
+	l.exemplars[exemplar.ID] = exemplar
+	if err := l.save(); err != nil {
+		if existed {
+			l.exemplars[exemplar.ID] = previous
+		} else {
+			delete(l.exemplars, exemplar.ID)
+		}
+		return true, err
+	}
+	return true, nil
+}
+
+// Delete removes an exemplar and saves the library; it reports whether it existed
+func (l *ExemplarLibrary) Delete(id string) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	previous, existed := l.exemplars[id]
+	if !existed {
+		return false, nil
+	}
+	delete(l.exemplars, id)
+	if err := l.save(); err != nil {
+		l.exemplars[id] = previous
+		return true, err
+	}
+	return true, nil
+}
+
+// save writes the library to its file through a temporary file, so readers never
+// see a partial write; callers must hold the write lock
+func (l *ExemplarLibrary) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	file := exemplarFile{Exemplars: make([]Exemplar, 0, len(l.exemplars))}
+	for _, exemplar := range l.exemplars {
+		file.Exemplars = append(file.Exemplars, exemplar)
+	}
+	sort.Slice(file.Exemplars, func(i, j int) bool { return file.Exemplars[i].ID < file.Exemplars[j].ID })
+
+	var data []byte
+	var err error
+	if strings.ToLower(filepath.Ext(l.path)) == ".toml" {
+		data, err = toml.Marshal(file)
+	} else {
+		data, err = yaml.Marshal(file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode exemplars: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".exemplars-*")
+	if err != nil {
+		return fmt.Errorf("failed to save exemplars: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save exemplars: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save exemplars: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("failed to save exemplars: %w", err)
+	}
+	return nil
+}
+
+// Exemplar match scores. A candidate needs at least minExemplarScore, i.e. a related
+// genre or the same emotion, to be worth its tokens.
+const (
+	scoreGenreExact   = 6
+	scoreGenreBlend   = 4
+	scoreGenreFamily  = 3
+	scoreUntagged     = 1
+	scoreEmotionExact = 3
+	minExemplarScore  = 3
+)
+
+// Select returns the exemplars that best match the request's genres, emotion and
+// language, best first, keeping their estimated size within the token budget
+func (l *ExemplarLibrary) Select(catalog *Catalog, req LyricsRequest, tokenBudget, limit int) []Exemplar {
+	if l == nil || tokenBudget <= 0 || limit <= 0 {
+		return nil
+	}
+
+	type candidate struct {
+		exemplar Exemplar
+		score    int
+	}
+	var candidates []candidate
+	for _, exemplar := range l.List() {
+		if exemplar.Language != req.Language {
+			continue
+		}
+		score := exemplarGenreScore(catalog, exemplar.Genre, req.genreBlend())
+		switch exemplar.Emotion {
+		case req.Emotion:
+			score += scoreEmotionExact
+		case "":
+			score += scoreUntagged
+		}
+		if score >= minExemplarScore {
+			candidates = append(candidates, candidate{exemplar, score})
+		}
+	}
+	// List is sorted by ID, so equal scores keep a stable order
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+
+	var selected []Exemplar
+	remaining := tokenBudget
+	for _, candidate := range candidates {
+		cost := estimateTokens(candidate.exemplar.Text)
+		if cost > remaining {
+			continue
+		}
+		selected = append(selected, candidate.exemplar)
+		remaining -= cost
+		if len(selected) == limit {
+			break
+		}
+	}
+	return selected
+}
+
+// exemplarGenreScore rates how closely an exemplar's genre matches the requested blend:
+// the dominant genre, the other blended genre, or a genre of the same family
+func exemplarGenreScore(catalog *Catalog, genre string, blend []GenreWeight) int {
+	if genre == "" {
+		return scoreUntagged
+	}
+	for i, requested := range blend {
+		if genre == requested.Genre {
+			if i == 0 {
+				return scoreGenreExact
+			}
+			return scoreGenreBlend
+		}
+	}
+	root := func(id string) string {
+		if entry, ok := catalog.Genres.Lookup(id); ok && entry.Parent != "" {
+			return entry.Parent
+		}
+		return id
+	}
+	for _, requested := range blend {
+		if root(genre) == root(requested.Genre) {
+			return scoreGenreFamily
+		}
+	}
+	return 0
+}
+
+// estimateTokens approximates the token count of a text: about four characters per
+// token for alphabetic scripts, and one token per character for CJK scripts
+func estimateTokens(text string) int {
+	chars, wide := 0, 0
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			wide++
+		} else {
+			chars++
+		}
+	}
+	return wide + (chars+3)/4
+}
+
+// fewShotMessage presents the selected exemplars as style references
+func fewShotMessage(exemplars []Exemplar) string {
+	var b strings.Builder
+	b.WriteString("Here are short excerpts of original lyrics that show the style to aim for. Use them only as a guide to tone, imagery and phrasing; do not copy their lines.")
+	for i, exemplar := range exemplars {
+		tags := []string{}
+		for _, tag := range []string{exemplar.Genre, exemplar.Emotion, exemplar.Language} {
+			if tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		fmt.Fprintf(&b, "\n\nExample %d (%s):\n%s", i+1, strings.Join(tags, ", "), exemplar.Text)
+	}
+	return b.String()
+}
+
+// exemplarIDs returns the IDs of the exemplars, for response metadata
+func exemplarIDs(exemplars []Exemplar) []string {
+	if len(exemplars) == 0 {
+		return nil
+	}
+	ids := make([]string, len(exemplars))
+	for i, exemplar := range exemplars {
+		ids[i] = exemplar.ID
+	}
+	return ids
+}
+
+// listExemplars returns the exemplars, optionally filtered by genre, emotion and language
+func listExemplars(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filters := map[string]string{}
+		for _, name := range []string{"genre", "emotion", "language"} {
+			filters[name] = normalizeCatalogKey(c.Query(name))
+		}
+
+		exemplars := []Exemplar{}
+		for _, exemplar := range service.exemplars.List() {
+			if (filters["genre"] == "" || filters["genre"] == exemplar.Genre) &&
+				(filters["emotion"] == "" || filters["emotion"] == exemplar.Emotion) &&
+				(filters["language"] == "" || filters["language"] == exemplar.Language) {
+				exemplars = append(exemplars, exemplar)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"exemplars": exemplars})
+	}
+}
+
+// getExemplar returns one exemplar
+func getExemplar(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		exemplar, ok := service.exemplars.Get(c.Param("id"))
+		if !ok {
+			respondError(c, http.StatusNotFound, "not_found", "No exemplar found with this ID.")
+			return
+		}
+		c.JSON(http.StatusOK, exemplar)
+	}
+}
+
+// createExemplar adds an exemplar; the ID must not be in use
+func createExemplar(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		exemplar, ok := bindExemplar(c, service, "")
+		if !ok {
+			return
+		}
+		added, err := service.exemplars.Add(exemplar)
+		if !savedExemplar(c, err) {
+			return
+		}
+		if !added {
+			respondError(c, http.StatusConflict, "exemplar_exists", fmt.Sprintf("An exemplar with ID %q already exists.", exemplar.ID))
+			return
+		}
+		c.JSON(http.StatusCreated, exemplar)
+	}
+}
+
+// updateExemplar replaces an existing exemplar
+func updateExemplar(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if _, exists := service.exemplars.Get(id); !exists {
+			respondError(c, http.StatusNotFound, "not_found", "No exemplar found with this ID.")
+			return
+		}
+		exemplar, ok := bindExemplar(c, service, id)
+		if !ok {
+			return
+		}
+		// The exemplar may have been deleted while the request was validated
+		existed, err := service.exemplars.Replace(exemplar)
+		if !savedExemplar(c, err) {
+			return
+		}
+		if !existed {
+			respondError(c, http.StatusNotFound, "not_found", "No exemplar found with this ID.")
+			return
+		}
+		c.JSON(http.StatusOK, exemplar)
+	}
+}
+
+// deleteExemplar removes an exemplar
+func deleteExemplar(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existed, err := service.exemplars.Delete(c.Param("id"))
+		if err != nil {
+			zerologlog.Error().Err(err).Msg("Failed to save exemplar library")
+			respondError(c, http.StatusInternalServerError, "exemplar_save_failed", "Failed to save the exemplar library.")
+			return
+		}
+		if !existed {
+			respondError(c, http.StatusNotFound, "not_found", "No exemplar found with this ID.")
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// bindExemplar parses and validates an exemplar from the request body. A non-empty
+// id (from the URL) takes precedence over the ID in the body.
+func bindExemplar(c *gin.Context, service *LyricsService, id string) (Exemplar, bool) {
+	var exemplar Exemplar
+	if err := c.ShouldBindJSON(&exemplar); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return Exemplar{}, false
+	}
+	if id != "" {
+		exemplar.ID = id
+	}
+	exemplar, err := exemplar.normalize(service.Settings().Catalog)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid_exemplar", errorMessage(err))
+		return Exemplar{}, false
+	}
+	return exemplar, true
+}
+
+// savedExemplar reports a failed library save to the client; it returns false when it
+// wrote an error response
+func savedExemplar(c *gin.Context, err error) bool {
+	if err != nil {
+		zerologlog.Error().Err(err).Msg("Failed to save exemplar library")
+		respondError(c, http.StatusInternalServerError, "exemplar_save_failed", "Failed to save the exemplar library.")
+		return false
+	}
+	return true
+}
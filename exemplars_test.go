@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectExemplars(t *testing.T) {
+	catalog := DefaultCatalog()
+	library := DefaultExemplars()
+	ids := func(req LyricsRequest, budget, limit int) []string {
+		return exemplarIDs(library.Select(catalog, req, budget, limit))
+	}
+
+	// Exact genre and emotion first, then the same genre, then the same emotion
+	assert.Equal(t, []string{"pop-happy-en", "pop-romantic-en", "country-happy-en"},
+		ids(LyricsRequest{Genre: "pop", Emotion: "happy", Language: "english"}, 1000, 3))
+
+	// Sub-genres match exemplars of their root genre and siblings
+	assert.Equal(t, []string{"pop-happy-en"},
+		ids(LyricsRequest{Genre: "k-pop", Emotion: "happy", Language: "english"}, 1000, 1))
+
+	// The second genre of a blend ranks after the dominant one
+	blend := LyricsRequest{Genres: []GenreWeight{{"folk", 0.6}, {"synthwave", 0.4}}, Genre: "folk", Emotion: "nostalgic", Language: "english"}
+	assert.Equal(t, []string{"synthwave-nostalgic-en", "folk-contemplative-en", "country-nostalgic-en"}, ids(blend, 1000, 3))
+
+	// Only exemplars in the requested language are used
+	assert.Equal(t, []string{"j-pop-hopeful-ja"},
+		ids(LyricsRequest{Genre: "pop", Emotion: "hopeful", Language: "japanese"}, 1000, 3))
+	assert.Empty(t, ids(LyricsRequest{Genre: "metal", Emotion: "sad", Language: "korean"}, 1000, 3))
+
+	// A small budget skips exemplars that do not fit and a zero budget disables them
+	assert.Equal(t, []string{"pop-happy-en"}, ids(LyricsRequest{Genre: "pop", Emotion: "happy", Language: "english"}, 36, 3))
+	assert.Equal(t, []string{"electronic-energetic-en"}, ids(LyricsRequest{Genre: "electronic", Emotion: "energetic", Language: "english"}, 30, 3))
+	assert.Empty(t, ids(LyricsRequest{Genre: "pop", Emotion: "happy", Language: "english"}, 0, 3))
+}
+
+func TestEstimateTokens(t *testing.T) {
+	assert.Equal(t, 4, estimateTokens("Lights up, hands"))
+	assert.Equal(t, 5, estimateTokens("桜の道を走"))
+	assert.Equal(t, 0, estimateTokens(""))
+}
+
+func TestLoadExemplarsValidates(t *testing.T) {
+	_, err := LoadExemplars(writeConfigFile(t, "exemplars.yaml", `
+exemplars:
+  - id: one
+    genre: polka
+    language: english
+    text: la la
+  - id: Two
+    language: english
+    text: la la
+  - id: three
+    language: english
+  - id: four
+    genre: hip hop
+    emotion: HAPPY
+    language: english
+    text: yeah
+  - id: four
+    language: english
+    text: again
+`), DefaultCatalog())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `exemplars[0]: unknown genre "polka"`)
+	assert.Contains(t, err.Error(), `exemplars[1]: id "Two" must be lowercase letters, digits and dashes`)
+	assert.Contains(t, err.Error(), "exemplars[2]: text is required")
+	assert.Contains(t, err.Error(), `exemplars[4]: id "four" is used twice`)
+	assert.NotContains(t, err.Error(), "exemplars[3]")
+}
+
+func TestExemplarAdminCRUD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exemplars.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("exemplars:\n  - id: rock-sad-en\n    genre: rock\n    emotion: sad\n    language: english\n    text: Broken strings\n"), 0o600))
+	library, err := LoadExemplars(path, DefaultCatalog())
+	require.NoError(t, err)
+
+	service := NewLyricsService("http://unused", "gpt-3.5-turbo", nil, WithExemplarLibrary(library))
+	settings := *service.Settings()
+	settings.AdminToken = "admin-secret"
+	service.ApplySettings(&settings)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	admin := router.Group("/admin", adminAuth(service))
+	admin.GET("/exemplars", listExemplars(service))
+	admin.POST("/exemplars", createExemplar(service))
+	admin.GET("/exemplars/:id", getExemplar(service))
+	admin.PUT("/exemplars/:id", updateExemplar(service))
+	admin.DELETE("/exemplars/:id", deleteExemplar(service))
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("POST", "/admin/exemplars", `{"id":"folk-happy-en","genre":"Folk","emotion":"happy","language":"english","text":"Sun on the fields"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"id":"folk-happy-en","genre":"folk","emotion":"happy","language":"english","text":"Sun on the fields"}`, w.Body.String())
+
+	assert.Equal(t, http.StatusConflict, serve("POST", "/admin/exemplars", `{"id":"folk-happy-en","language":"english","text":"x"}`).Code)
+	w = serve("POST", "/admin/exemplars", `{"id":"x","genre":"polka","language":"english","text":"x"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `Unknown genre \"polka\".`)
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/admin/exemplars", `{"id":"x","language":"english"}`).Code)
+
+	w = serve("PUT", "/admin/exemplars/rock-sad-en", `{"genre":"rock","emotion":"melancholic","language":"english","text":"Rusty strings"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusNotFound, serve("PUT", "/admin/exemplars/missing", `{"language":"english","text":"x"}`).Code)
+
+	w = serve("GET", "/admin/exemplars?genre=rock", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"exemplars":[{"id":"rock-sad-en","genre":"rock","emotion":"melancholic","language":"english","text":"Rusty strings"}]}`, w.Body.String())
+	assert.Equal(t, http.StatusOK, serve("GET", "/admin/exemplars/folk-happy-en", "").Code)
+
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/admin/exemplars/rock-sad-en", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/exemplars/rock-sad-en", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/admin/exemplars/rock-sad-en", "").Code)
+
+	// Changes are written back to the file
+	reloaded, err := LoadExemplars(path, DefaultCatalog())
+	require.NoError(t, err)
+	assert.Equal(t, []Exemplar{{ID: "folk-happy-en", Genre: "folk", Emotion: "happy", Language: "english", Text: "Sun on the fields"}}, reloaded.List())
+}
+
+func TestExemplarLibraryAddIsAtomic(t *testing.T) {
+	library := DefaultExemplars()
+
+	// Concurrent creates with the same ID: exactly one wins, the rest see a conflict
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := library.Add(Exemplar{ID: "same", Language: "english", Text: fmt.Sprintf("Take %d", i)})
+			assert.NoError(t, err)
+			if ok {
+				added.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), added.Load())
+
+	replaced, err := library.Replace(Exemplar{ID: "missing", Language: "english", Text: "x"})
+	require.NoError(t, err)
+	assert.False(t, replaced)
+	_, exists := library.Get("missing")
+	assert.False(t, exists)
+}
+
+func TestExemplarsAddedToPrompt(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newTestGateway(t, "[Title: Song]\n[Verse 1]\nLine", &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+
+	generate := func() LyricsResponse {
+		req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(
+			`{"keywords":["road"],"genre":"country","emotion":"happy","language":"english"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response LyricsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := generate()
+	assert.Equal(t, "country-happy-en", response.Metadata.Exemplars[0])
+	require.Len(t, requests, 1)
+	messages := requests[0]["messages"].([]interface{})
+	require.Len(t, messages, 3)
+	fewShot := messages[1].(map[string]interface{})
+	assert.Equal(t, "system", fewShot["role"])
+	assert.Contains(t, fewShot["content"], "Windows down on County Road Nine")
+
+	settings := *service.Settings()
+	settings.ExemplarTokenBudget = 0
+	service.ApplySettings(&settings)
+	response = generate()
+	assert.Empty(t, response.Metadata.Exemplars)
+	assert.Len(t, requests[1]["messages"], 2)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyHeader identifies the calling application for experiment assignment
+const apiKeyHeader = "X-API-Key"
+
+// Experiment assignment units
+const (
+	assignByAPIKey  = "api_key"
+	assignByRequest = "request"
+)
+
+type apiKeyContextKey struct{}
+
+// withAPIKey records the caller's API key on the request context
+func withAPIKey(ctx context.Context, apiKey string) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, apiKey)
+}
+
+func apiKeyFromContext(ctx context.Context) string {
+	apiKey, _ := ctx.Value(apiKeyContextKey{}).(string)
+	return apiKey
+}
+
+// ExperimentAssignment is the arm a request was assigned to and the settings it uses
+type ExperimentAssignment struct {
+	Experiment    string
+	Arm           string
+	PromptVersion string
+	Temperature   float64
+}
+
+// assignExperiment assigns the request to an arm of the enabled experiment, if any.
+// Assignment is deterministic: the same API key (or, without one or when the
+// experiment is per request, the same request) always lands in the same arm.
+func (settings *ServiceSettings) assignExperiment(apiKey string, req LyricsRequest) *ExperimentAssignment {
+	for _, experiment := range settings.Experiments {
+		if !experiment.Enabled || len(experiment.Arms) == 0 {
+			continue
+		}
+
+		unit := apiKey
+		if experiment.Unit == assignByRequest || unit == "" {
+			unit = requestHash(req)
+		}
+		arm := pickArm(experiment, unit)
+
+		assignment := &ExperimentAssignment{
+			Experiment:    experiment.Name,
+			Arm:           arm.Name,
+			PromptVersion: settings.PromptVersion,
+			Temperature:   settings.Generation.Temperature,
+		}
+		if arm.PromptVersion != "" {
+			assignment.PromptVersion = arm.PromptVersion
+		}
+		if arm.Temperature != nil {
+			assignment.Temperature = *arm.Temperature
+		}
+		return assignment
+	}
+	return nil
+}
+
+// pickArm maps the unit onto the arms in proportion to their weights
+func pickArm(experiment ExperimentConfig, unit string) ArmConfig {
+	total := 0
+	for _, arm := range experiment.Arms {
+		total += arm.Weight
+	}
+
+	sum := sha256.Sum256([]byte(experiment.Name + "\x00" + unit))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for _, arm := range experiment.Arms {
+		if bucket < arm.Weight {
+			return arm
+		}
+		bucket -= arm.Weight
+	}
+	return experiment.Arms[len(experiment.Arms)-1]
+}
+
+// requestHash identifies a request by its content
+func requestHash(req LyricsRequest) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return string(sum[:])
+}
+
+// ArmStats are the outcomes recorded for one experiment arm
+type ArmStats struct {
+	Generations    int64   `json:"generations"`
+	MeanCompliance float64 `json:"mean_compliance"`
+	Ratings        int64   `json:"ratings"`
+	MeanRating     float64 `json:"mean_rating"`
+}
+
+type armKey struct {
+	experiment string
+	arm        string
+}
+
+type armTotals struct {
+	generations   int64
+	complianceSum float64
+	ratings       int64
+	ratingSum     int64
+}
+
+// ExperimentTracker aggregates generation outcomes and user ratings per arm. The
+// totals are kept in memory and survive config reloads but not restarts.
+type ExperimentTracker struct {
+	mutex  sync.Mutex
+	totals map[armKey]*armTotals
+}
+
+// NewExperimentTracker creates an empty tracker
+func NewExperimentTracker() *ExperimentTracker {
+	return &ExperimentTracker{totals: map[armKey]*armTotals{}}
+}
+
+func (t *ExperimentTracker) arm(experiment, arm string) *armTotals {
+	key := armKey{experiment, arm}
+	totals, ok := t.totals[key]
+	if !ok {
+		totals = &armTotals{}
+		t.totals[key] = totals
+	}
+	return totals
+}
+
+// RecordGeneration records a successful generation and its compliance score
+func (t *ExperimentTracker) RecordGeneration(experiment, arm string, compliance float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	totals := t.arm(experiment, arm)
+	totals.generations++
+	totals.complianceSum += compliance
+}
+
+// RecordRating records a user rating, replacing the previous rating of the same
+// song when there was one
+func (t *ExperimentTracker) RecordRating(experiment, arm string, rating, previous int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	totals := t.arm(experiment, arm)
+	if previous == 0 {
+		totals.ratings++
+	}
+	totals.ratingSum += int64(rating - previous)
+}
+
+// Stats returns the aggregated outcomes of an arm
+func (t *ExperimentTracker) Stats(experiment, arm string) ArmStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	totals, ok := t.totals[armKey{experiment, arm}]
+	if !ok {
+		return ArmStats{}
+	}
+	stats := ArmStats{Generations: totals.generations, Ratings: totals.ratings}
+	if totals.generations > 0 {
+		stats.MeanCompliance = math.Round(totals.complianceSum/float64(totals.generations)*1000) / 1000
+	}
+	if totals.ratings > 0 {
+		stats.MeanRating = math.Round(float64(totals.ratingSum)/float64(totals.ratings)*100) / 100
+	}
+	return stats
+}
+
+// ArmReport describes an arm and its outcomes for the admin API
+type ArmReport struct {
+	Name          string   `json:"name"`
+	Weight        int      `json:"weight"`
+	PromptVersion string   `json:"prompt_version,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	ArmStats
+}
+
+// ExperimentReport describes an experiment and its arms for the admin API
+type ExperimentReport struct {
+	Name    string      `json:"name"`
+	Enabled bool        `json:"enabled"`
+	Unit    string      `json:"unit"`
+	Arms    []ArmReport `json:"arms"`
+}
+
+// listExperiments reports the configured experiments with the outcomes per arm
+func listExperiments(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		experiments := service.Settings().Experiments
+		reports := make([]ExperimentReport, 0, len(experiments))
+		for _, experiment := range experiments {
+			report := ExperimentReport{Name: experiment.Name, Enabled: experiment.Enabled, Unit: experiment.Unit}
+			for _, arm := range experiment.Arms {
+				report.Arms = append(report.Arms, ArmReport{
+					Name:          arm.Name,
+					Weight:        arm.Weight,
+					PromptVersion: arm.PromptVersion,
+					Temperature:   arm.Temperature,
+					ArmStats:      service.experiments.Stats(experiment.Name, arm.Name),
+				})
+			}
+			reports = append(reports, report)
+		}
+		c.JSON(http.StatusOK, gin.H{"experiments": reports})
+	}
+}
+
+// RatingRequest is a user's rating of a generated song
+type RatingRequest struct {
+	Rating int `json:"rating" binding:"required,min=1,max=5"`
+}
+
+// RatingResponse confirms a recorded rating
+type RatingResponse struct {
+	ID     string `json:"id"`
+	Rating int    `json:"rating"`
+}
+
+// rateLyrics records a 1-5 rating for a generated song; rating again replaces it
+func rateLyrics(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RatingRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		id := c.Param("id")
+		song, previous, ok := service.store.Rate(id, req.Rating)
+		if !ok {
+			respondError(c, http.StatusNotFound, "not_found", "No lyrics found with this ID.")
+			return
+		}
+
+		if metadata := song.Response.Metadata; metadata.Experiment != "" {
+			service.experiments.RecordRating(metadata.Experiment, metadata.ExperimentArm, req.Rating, previous)
+		}
+		c.JSON(http.StatusOK, RatingResponse{ID: id, Rating: req.Rating})
+	}
+}
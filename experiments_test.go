@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testExperiment() ExperimentConfig {
+	hot := 1.2
+	return ExperimentConfig{
+		Name:    "warmer-prompts",
+		Enabled: true,
+		Unit:    assignByAPIKey,
+		Arms: []ArmConfig{
+			{Name: "control", Weight: 1},
+			{Name: "hot", Weight: 1, Temperature: &hot},
+		},
+	}
+}
+
+func TestAssignExperimentIsDeterministic(t *testing.T) {
+	settings := &ServiceSettings{PromptVersion: "v1", Generation: GenerationConfig{Temperature: 0.7}, Experiments: []ExperimentConfig{testExperiment()}}
+	req := LyricsRequest{Keywords: []string{"rain"}, Genre: "pop", Emotion: "sad", Language: "english"}
+
+	first := settings.assignExperiment("key-1", req)
+	require.NotNil(t, first)
+	assert.Equal(t, "warmer-prompts", first.Experiment)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, settings.assignExperiment("key-1", LyricsRequest{Genre: fmt.Sprint(i)}))
+	}
+
+	// Without an API key the request content decides the arm
+	assert.Equal(t, settings.assignExperiment("", req), settings.assignExperiment("", req))
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		assignment := settings.assignExperiment(fmt.Sprintf("key-%d", i), req)
+		counts[assignment.Arm]++
+		if assignment.Arm == "hot" {
+			assert.Equal(t, 1.2, assignment.Temperature)
+		} else {
+			assert.Equal(t, 0.7, assignment.Temperature)
+		}
+		assert.Equal(t, "v1", assignment.PromptVersion)
+	}
+	assert.InDelta(t, 500, counts["control"], 60)
+	assert.InDelta(t, 500, counts["hot"], 60)
+
+	settings.Experiments[0].Enabled = false
+	assert.Nil(t, settings.assignExperiment("key-1", req))
+}
+
+func TestExperimentArmReachesGatewayAndRatings(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newTestGateway(t, "[Title: Rain]\n[Verse 1]\nRain falls\n[Chorus]\nRain again", &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	settings := *service.Settings()
+	experiment := testExperiment()
+	experiment.Arms = experiment.Arms[1:]
+	settings.Experiments = []ExperimentConfig{experiment}
+	settings.AdminToken = "admin-secret"
+	service.ApplySettings(&settings)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+	router.POST("/lyrics/:id/rating", rateLyrics(service))
+	router.Group("/admin", adminAuth(service)).GET("/experiments", listExperiments(service))
+
+	serve := func(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("POST", "/generate", `{"keywords":["rain"],"genre":"pop","emotion":"sad","language":"english","structure":{"verses":1,"chorus":true}}`,
+		http.Header{apiKeyHeader: {"key-1"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response LyricsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "warmer-prompts", response.Metadata.Experiment)
+	assert.Equal(t, "hot", response.Metadata.ExperimentArm)
+	assert.Equal(t, 1.0, response.Metadata.ComplianceScore)
+	require.Len(t, requests, 1)
+	assert.Equal(t, 1.2, requests[0]["temperature"])
+
+	rate := func(id string, rating int) *httptest.ResponseRecorder {
+		return serve("POST", "/lyrics/"+id+"/rating", fmt.Sprintf(`{"rating":%d}`, rating), nil)
+	}
+	assert.Equal(t, http.StatusNotFound, rate("missing", 4).Code)
+	assert.Equal(t, http.StatusBadRequest, rate(response.ID, 6).Code)
+	assert.Equal(t, http.StatusOK, rate(response.ID, 2).Code)
+	// Rating again replaces the earlier rating
+	assert.Equal(t, http.StatusOK, rate(response.ID, 4).Code)
+
+	assert.Equal(t, ArmStats{Generations: 1, MeanCompliance: 1, Ratings: 1, MeanRating: 4},
+		service.experiments.Stats("warmer-prompts", "hot"))
+
+	w = serve("GET", "/admin/experiments", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = serve("GET", "/admin/experiments", "", http.Header{"Authorization": {"Bearer wrong"}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = serve("GET", "/admin/experiments", "", http.Header{"Authorization": {"Bearer admin-secret"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	var report struct {
+		Experiments []ExperimentReport `json:"experiments"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	require.Len(t, report.Experiments, 1)
+	assert.Equal(t, int64(1), report.Experiments[0].Arms[0].Generations)
+	assert.Equal(t, 4.0, report.Experiments[0].Arms[0].MeanRating)
+
+	settings.AdminToken = ""
+	service.ApplySettings(&settings)
+	w = serve("GET", "/admin/experiments", "", http.Header{"Authorization": {"Bearer admin-secret"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestConfigValidatesExperiments(t *testing.T) {
+	clearConfigEnv(t)
+
+	_, err := LoadConfig(writeConfigFile(t, "config.yaml", validYAMLConfig+`
+experiments:
+  - name: tone
+    enabled: true
+    unit: session
+    arms:
+      - name: a
+        weight: 0
+        prompt_version: v9
+      - name: a
+        weight: 1
+        temperature: 3
+  - name: tone
+    enabled: true
+`))
+	require.Error(t, err)
+	for _, want := range []string{
+		`experiments[0].unit must be "api_key" or "request", got "session"`,
+		"experiments[0].arms[0].weight must be positive, got 0",
+		`experiments[0].arms[0].prompt_version "v9" not found`,
+		`experiments[0].arms[1].name "a" is used twice`,
+		"experiments[0].arms[1].temperature must be between 0 and 2, got 3",
+		`experiments[1].name "tone" is used twice`,
+		"experiments[1].arms must not be empty",
+		"at most one experiment can be enabled, got 2",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+
+	cfg, err := LoadConfig(writeConfigFile(t, "config.yaml", validYAMLConfig+`
+experiments:
+  - name: tone
+    enabled: true
+    arms:
+      - name: control
+        weight: 3
+      - name: v1-cool
+        weight: 1
+        prompt_version: v1
+        temperature: 0.3
+`))
+	require.NoError(t, err)
+	settings := cfg.ServiceSettings()
+	require.Len(t, settings.Experiments, 1)
+	assert.Equal(t, assignByAPIKey, settings.Experiments[0].Unit)
+	assert.Equal(t, 0.3, *settings.Experiments[0].Arms[1].Temperature)
+}
+
+func TestLyricsStoreEvictsOldest(t *testing.T) {
+	store := NewLyricsStore(2)
+	for _, id := range []string{"a", "b", "c"} {
+		store.Save(&LyricsResponse{ID: id}, LyricsRequest{})
+	}
+	assert.Equal(t, 2, store.Len())
+	_, ok := store.Get("a")
+	assert.False(t, ok)
+
+	song, previous, ok := store.Rate("c", 5)
+	require.True(t, ok)
+	assert.Equal(t, 0, previous)
+	assert.Equal(t, 5, song.Rating)
+}
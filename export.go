@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportFormat renders a stored song as a downloadable file
+type exportFormat struct {
+	extension   string
+	contentType string
+	render      func(song StoredLyrics, options exportOptions) []byte
+}
+
+// exportOptions are the layout settings of an export, from its query parameters
+type exportOptions struct {
+	Columns int
+}
+
+var exportFormats = map[string]exportFormat{
+	"chordpro": {"cho", "text/x-chordpro; charset=utf-8", textExport(renderChordPro)},
+	"markdown": {"md", "text/markdown; charset=utf-8", textExport(renderMarkdown)},
+	"text":     {"txt", "text/plain; charset=utf-8", textExport(renderPlainText)},
+	"lrc":      {"lrc", "text/x-lrc; charset=utf-8", textExport(renderLRC)},
+	"pdf":      {"pdf", "application/pdf", renderPDF},
+}
+
+// textExport adapts a text renderer that has no layout options
+func textExport(render func(song StoredLyrics) string) func(StoredLyrics, exportOptions) []byte {
+	return func(song StoredLyrics, _ exportOptions) []byte {
+		return []byte(render(song))
+	}
+}
+
+// exportFormatAliases maps alternative format names to the canonical ones
+var exportFormatAliases = map[string]string{
+	"cho":   "chordpro",
+	"md":    "markdown",
+	"plain": "text",
+	"txt":   "text",
+}
+
+// exportLyrics renders a stored song in the format given by the format query parameter
+func exportLyrics(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := strings.ToLower(strings.TrimSpace(c.Query("format")))
+		if alias, ok := exportFormatAliases[name]; ok {
+			name = alias
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			respondError(c, http.StatusBadRequest, "invalid_format",
+				"Unsupported export format. Supported formats: "+strings.Join(exportFormatNames(), ", "))
+			return
+		}
+
+		options := exportOptions{Columns: 1}
+		if columns := c.Query("columns"); columns != "" {
+			n, err := strconv.Atoi(columns)
+			if err != nil || n < 1 || n > 2 {
+				respondError(c, http.StatusBadRequest, "invalid_columns", "Columns must be 1 or 2.")
+				return
+			}
+			options.Columns = n
+		}
+
+		song, ok := service.store.Get(c.Param("id"))
+		if !ok {
+			respondError(c, http.StatusNotFound, "not_found", "No lyrics found with this ID.")
+			return
+		}
+
+		c.Header("Content-Disposition", attachmentDisposition(song.Response.Lyrics.Title, format.extension))
+		c.Data(http.StatusOK, format.contentType, format.render(song, options))
+	}
+}
+
+// exportFormatNames returns the supported format names in sorted order
+func exportFormatNames() []string {
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var filenameUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// attachmentDisposition names the download after the song title, with an ASCII
+// fallback for clients that do not support RFC 6266 encoded file names
+func attachmentDisposition(title, extension string) string {
+	slug := strings.Trim(filenameUnsafe.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if slug == "" {
+		slug = "lyrics"
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": slug + "." + extension})
+
+	isASCII := strings.IndexFunc(title, func(r rune) bool { return r > unicode.MaxASCII }) < 0
+	if !isASCII {
+		encoded := mime.FormatMediaType("attachment", map[string]string{"filename": title + "." + extension})
+		disposition += "; " + strings.TrimPrefix(encoded, "attachment; ")
+	}
+	return disposition
+}
+
+// exportHeaders lists the song's metadata as labelled values, in display order
+func exportHeaders(song StoredLyrics) [][2]string {
+	metadata := song.Response.Metadata
+	genre := metadata.Genre
+	if len(metadata.Genres) > 0 {
+		parts := make([]string, len(metadata.Genres))
+		for i, blended := range metadata.Genres {
+			parts[i] = fmt.Sprintf("%s %.0f%%", blended.Genre, blended.Weight*100)
+		}
+		genre = strings.Join(parts, " + ")
+	}
+
+	language := metadata.Language
+	if len(metadata.Languages) > 0 {
+		language = strings.Join(LyricsRequest{Languages: metadata.Languages}.languageIDs(), " + ")
+	}
+
+	headers := [][2]string{
+		{"Genre", genre},
+		{"Emotion", metadata.Emotion},
+		{"Language", language},
+	}
+	if len(metadata.KeywordsUsed) > 0 {
+		headers = append(headers, [2]string{"Keywords", strings.Join(metadata.KeywordsUsed, ", ")})
+	}
+	if !metadata.CreatedAt.IsZero() {
+		headers = append(headers, [2]string{"Created", metadata.CreatedAt.UTC().Format("2006-01-02")})
+	}
+	return headers
+}
+
+// sectionKind returns the kind of a section, e.g. "verse" for "verse 2"
+func sectionKind(name string) string {
+	kind, _, _ := strings.Cut(name, " ")
+	return kind
+}
+
+// sectionLabel returns the display label of a section, e.g. "Verse 2"
+func sectionLabel(name string) string {
+	return capitalize(name)
+}
+
+// nonEmptyLines splits text into trimmed, non-empty lines
+func nonEmptyLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// renderChordPro writes the song in ChordPro, using environment directives for verses,
+// choruses and bridges and recalling a repeated chorus with {chorus}
+func renderChordPro(song StoredLyrics) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "{title: %s}\n", escapeChordPro(song.Response.Lyrics.Title))
+	for _, header := range exportHeaders(song) {
+		fmt.Fprintf(&b, "{meta: %s %s}\n", strings.ToLower(header[0]), escapeChordPro(header[1]))
+	}
+	chords := song.Response.Chords
+	if chords != nil {
+		fmt.Fprintf(&b, "{key: %s}\n{tempo: %d}\n", chords.KeyName(), (chords.Tempo.Min+chords.Tempo.Max)/2)
+	}
+
+	var chorus []string
+	for _, section := range song.Response.Lyrics.Sections {
+		b.WriteString("\n")
+		kind := sectionKind(section.Name)
+		switch kind {
+		case "chorus":
+			if chorus != nil && slices.Equal(chorus, section.Lines) {
+				b.WriteString("{chorus}\n")
+				continue
+			}
+			chorus = section.Lines
+			fallthrough
+		case "verse", "bridge":
+			fmt.Fprintf(&b, "{start_of_%s: %s}\n", kind, escapeChordPro(sectionLabel(section.Name)))
+			writeChordProLines(&b, song, section)
+			fmt.Fprintf(&b, "{end_of_%s}\n", kind)
+		default:
+			fmt.Fprintf(&b, "{comment: %s}\n", escapeChordPro(sectionLabel(section.Name)))
+			writeChordProLines(&b, song, section)
+		}
+	}
+	return b.String()
+}
+
+// writeChordProLines writes the lines of a section with the song's chords, if any, inline
+func writeChordProLines(b *strings.Builder, song StoredLyrics, section LyricsSection) {
+	chords := song.Response.Chords
+	if chords == nil {
+		writeLines(b, section, "", "", escapeChordPro)
+		return
+	}
+	for i, line := range placeChords(section.Lines, chords.ForSection(section.Name), song.Response.sectionLanguage(section)) {
+		// Escaping keeps the length in runes, so the chord positions still apply
+		line.Lyric = escapeChordPro(line.Lyric)
+		b.WriteString(inlineChordPro(line) + "\n")
+		if romanized := section.romanizedLine(i); romanized != "" {
+			b.WriteString(escapeChordPro(romanized) + "\n")
+		}
+	}
+}
+
+// renderMarkdown writes the song as Markdown with a heading per section
+func renderMarkdown(song StoredLyrics) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", escapeMarkdown(song.Response.Lyrics.Title))
+	for _, header := range exportHeaders(song) {
+		fmt.Fprintf(&b, "- **%s:** %s\n", header[0], escapeMarkdown(header[1]))
+	}
+	for _, section := range song.Response.Lyrics.Sections {
+		fmt.Fprintf(&b, "\n## %s\n\n", escapeMarkdown(sectionLabel(section.Name)))
+		// Two trailing spaces keep each lyric line on its own line; romanized lines
+		// are set in italics
+		writeLines(&b, section, "  ", "*", escapeMarkdown)
+	}
+	return b.String()
+}
+
+// renderPlainText writes the song as plain text with bracketed section labels
+func renderPlainText(song StoredLyrics) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", song.Response.Lyrics.Title)
+	for _, header := range exportHeaders(song) {
+		fmt.Fprintf(&b, "%s: %s\n", header[0], header[1])
+	}
+	for _, section := range song.Response.Lyrics.Sections {
+		fmt.Fprintf(&b, "\n[%s]\n", sectionLabel(section.Name))
+		writeLines(&b, section, "", "", nil)
+	}
+	return b.String()
+}
+
+// renderLRC writes an LRC skeleton: every lyric line with a zero timestamp to be
+// synced in an LRC editor, and an empty timed line between sections
+func renderLRC(song StoredLyrics) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[ti:%s]\n", lrcEscaper.Replace(song.Response.Lyrics.Title))
+	fmt.Fprintf(&b, "[re:songlyrics-api]\n[ve:%s]\n", buildVersion())
+	for i, section := range song.Response.Lyrics.Sections {
+		if i > 0 {
+			b.WriteString("[00:00.00]\n")
+		}
+		for j, line := range section.Lines {
+			fmt.Fprintf(&b, "[00:00.00]%s\n", lrcEscaper.Replace(line))
+			if romanized := section.romanizedLine(j); romanized != "" {
+				fmt.Fprintf(&b, "[00:00.00]%s\n", lrcEscaper.Replace(romanized))
+			}
+		}
+	}
+	return b.String()
+}
+
+// writeLines writes the lines of a section, each followed by its romanization, if
+// any, wrapped in emphasis. Lines are passed through escape unless it is nil.
+func writeLines(b *strings.Builder, section LyricsSection, suffix, emphasis string, escape func(string) string) {
+	if escape == nil {
+		escape = func(s string) string { return s }
+	}
+	for i, line := range section.Lines {
+		b.WriteString(escape(line) + suffix + "\n")
+		if romanized := section.romanizedLine(i); romanized != "" {
+			b.WriteString(emphasis + escape(romanized) + emphasis + suffix + "\n")
+		}
+	}
+}
+
+// chordProEscaper replaces the brackets and braces that ChordPro reads as chords and
+// directives with parentheses, as ChordPro has no escape character
+var chordProEscaper = strings.NewReplacer(`[`, `(`, `]`, `)`, `{`, `(`, `}`, `)`)
+
+// escapeChordPro makes text render literally in ChordPro
+func escapeChordPro(text string) string {
+	return chordProEscaper.Replace(text)
+}
+
+// lrcEscaper replaces the square brackets that LRC reads as tags with parentheses
+var lrcEscaper = strings.NewReplacer(`[`, `(`, `]`, `)`)
+
+// markdownEscaper backslash-escapes the characters that Markdown reads as inline
+// syntax: emphasis, code, links, HTML, headings, tables and strikethrough
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`,
+	`<`, `\<`, `>`, `\>`, `#`, `\#`, `|`, `\|`, `~`, `\~`,
+)
+
+// markdownOrderedList matches text that would start an ordered list item, e.g. "1. "
+var markdownOrderedList = regexp.MustCompile(`^(\d+)([.)])(\s|$)`)
+
+// escapeMarkdown makes text render literally in Markdown: inline syntax is escaped,
+// as is a leading "-", "+" or "=" (a list item or a setext heading underline) and
+// the number of a leading "1." or "1)"
+func escapeMarkdown(text string) string {
+	text = markdownEscaper.Replace(strings.TrimSpace(text))
+	if strings.HasPrefix(text, "-") || strings.HasPrefix(text, "+") || strings.HasPrefix(text, "=") {
+		return `\` + text
+	}
+	return markdownOrderedList.ReplaceAllString(text, `$1\$2$3`)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStoredSong saves a parsed song with a repeated chorus and returns the service
+func testStoredSong(t *testing.T, title string) (*LyricsService, string) {
+	service := &LyricsService{store: NewLyricsStore(10)}
+	lyrics := service.parseLyrics("[Title: "+title+"]\n[Verse 1]\nCity lights\nHum along\n[Chorus]\nWe are home\n[Verse 2]\nMorning comes\n[Chorus]\nWe are home\n[Outro]\nFade away", LyricsRequest{})
+	response := &LyricsResponse{
+		ID:     "song-1",
+		Lyrics: lyrics,
+		Metadata: LyricsMetadata{
+			Genre:        "folk",
+			Genres:       []GenreWeight{{"folk", 0.6}, {"electronic", 0.4}},
+			Emotion:      "hopeful",
+			Language:     "english",
+			KeywordsUsed: []string{"city", "home"},
+			CreatedAt:    time.Date(2025, 8, 26, 10, 30, 0, 0, time.UTC),
+		},
+	}
+	service.store.Save(response, LyricsRequest{})
+	return service, response.ID
+}
+
+func TestParseLyricsKeepsSectionOrder(t *testing.T) {
+	service, id := testStoredSong(t, "Home")
+	song, _ := service.store.Get(id)
+
+	var names []string
+	for _, section := range song.Response.Lyrics.Sections {
+		names = append(names, section.Name)
+	}
+	assert.Equal(t, []string{"verse 1", "chorus", "verse 2", "chorus", "outro"}, names)
+	assert.Equal(t, []string{"City lights", "Hum along"}, song.Response.Lyrics.Sections[0].Lines)
+}
+
+func TestExportLyrics(t *testing.T) {
+	defer func(previous string) { version = previous }(version)
+	version = "1.2.3"
+
+	service, id := testStoredSong(t, "Home Again")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/lyrics/:id/export", exportLyrics(service))
+	export := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := export("/lyrics/" + id + "/export?format=chordpro")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/x-chordpro; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=home-again.cho`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, `{title: Home Again}
+{meta: genre folk 60% + electronic 40%}
+{meta: emotion hopeful}
+{meta: language english}
+{meta: keywords city, home}
+{meta: created 2025-08-26}
+
+{start_of_verse: Verse 1}
+City lights
+Hum along
+{end_of_verse}
+
+{start_of_chorus: Chorus}
+We are home
+{end_of_chorus}
+
+{start_of_verse: Verse 2}
+Morning comes
+{end_of_verse}
+
+{chorus}
+
+{comment: Outro}
+Fade away
+`, w.Body.String())
+
+	w = export("/lyrics/" + id + "/export?format=md")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/markdown; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "# Home Again\n\n- **Genre:** folk 60% + electronic 40%\n")
+	assert.Contains(t, w.Body.String(), "\n## Verse 1\n\nCity lights  \nHum along  \n")
+
+	w = export("/lyrics/" + id + "/export?format=plain")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "Home Again\n\nGenre: folk 60% + electronic 40%\nEmotion: hopeful\n")
+	assert.Contains(t, w.Body.String(), "\n[Chorus]\nWe are home\n\n[Verse 2]\n")
+
+	w = export("/lyrics/" + id + "/export?format=lrc")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `attachment; filename=home-again.lrc`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, `[ti:Home Again]
+[re:songlyrics-api]
+[ve:1.2.3]
+[00:00.00]City lights
+[00:00.00]Hum along
+[00:00.00]
+[00:00.00]We are home
+[00:00.00]
+[00:00.00]Morning comes
+[00:00.00]
+[00:00.00]We are home
+[00:00.00]
+[00:00.00]Fade away
+`, w.Body.String())
+
+	w = export("/lyrics/" + id + "/export?format=pdfx")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Supported formats: chordpro, lrc, markdown, pdf, text")
+	assert.Equal(t, http.StatusNotFound, export("/lyrics/missing/export?format=text").Code)
+}
+
+func TestRenderMarkdownEscapesSyntax(t *testing.T) {
+	song := StoredLyrics{Response: LyricsResponse{
+		Lyrics: GeneratedLyrics{Title: "#1 *Hit*", Sections: []LyricsSection{{Name: "verse 1", Lines: []string{
+			"# not a heading", "- not a list", "1. not a list either", "---", "my_snake_case and <b>tags</b>", "2024 was a year",
+		}}}},
+		Metadata: LyricsMetadata{Genre: "pop", Emotion: "happy", Language: "english", KeywordsUsed: []string{"[link](x)"}},
+	}}
+
+	assert.Equal(t, "# \\#1 \\*Hit\\*\n\n"+
+		"- **Genre:** pop\n- **Emotion:** happy\n- **Language:** english\n- **Keywords:** \\[link\\](x)\n"+
+		"\n## Verse 1\n\n"+
+		"\\# not a heading  \n\\- not a list  \n1\\. not a list either  \n\\---  \n"+
+		"my\\_snake\\_case and \\<b\\>tags\\</b\\>  \n2024 was a year  \n", renderMarkdown(song))
+}
+
+func TestRenderChordProAndLRCEscapeTags(t *testing.T) {
+	song := StoredLyrics{Response: LyricsResponse{
+		Lyrics: GeneratedLyrics{Title: "Songs [Live] {Demo}", Sections: []LyricsSection{{Name: "verse 1", Lines: []string{
+			"[Am] is not a chord", "{end_of_verse}", "[00:12.00] not a timestamp",
+		}}}},
+		Metadata: LyricsMetadata{Genre: "pop", Emotion: "happy", Language: "english", KeywordsUsed: []string{"{x}"}},
+	}}
+
+	chordPro := renderChordPro(song)
+	assert.Contains(t, chordPro, "{title: Songs (Live) (Demo)}\n")
+	assert.Contains(t, chordPro, "{meta: keywords (x)}\n")
+	assert.Contains(t, chordPro, "{start_of_verse: Verse 1}\n(Am) is not a chord\n(end_of_verse)\n(00:12.00) not a timestamp\n{end_of_verse}\n")
+
+	lrc := renderLRC(song)
+	assert.True(t, strings.HasPrefix(lrc, "[ti:Songs (Live) {Demo}]\n"), lrc)
+	assert.Contains(t, lrc, "[00:00.00](Am) is not a chord\n[00:00.00]{end_of_verse}\n[00:00.00](00:12.00) not a timestamp\n")
+}
+
+func TestAttachmentDispositionEncodesNonASCIITitles(t *testing.T) {
+	assert.Equal(t, `attachment; filename=lyrics.txt; filename*=utf-8''%E5%A4%9C%E6%98%8E%E3%81%91.txt`,
+		attachmentDisposition("夜明け", "txt"))
+	assert.Equal(t, `attachment; filename=caf-au-lait.md; filename*=utf-8''Caf%C3%A9%20au%20lait.md`,
+		attachmentDisposition("Café au lait", "md"))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// maxBlendGenres is the number of genres that can be blended in one song
+const maxBlendGenres = 2
+
+// GenreWeight is one genre of a blend and its share of the song
+type GenreWeight struct {
+	Genre  string  `json:"genre" binding:"required"`
+	Weight float64 `json:"weight,omitempty" binding:"omitempty,gt=0"`
+}
+
+// genreBlend returns the requested genres, treating a single genre as a blend of one
+func (req LyricsRequest) genreBlend() []GenreWeight {
+	if len(req.Genres) > 0 {
+		return req.Genres
+	}
+	return []GenreWeight{{Genre: req.Genre, Weight: 1}}
+}
+
+// resolveGenres validates the requested genre or blend against the catalog. It returns
+// the blend with canonical IDs and weights normalized to sum to 1, dominant genre first.
+func resolveGenres(genres *CatalogSet, req LyricsRequest) ([]GenreWeight, error) {
+	if req.Genre != "" && len(req.Genres) > 0 {
+		return nil, errors.New("use either genre or genres, not both")
+	}
+	if len(req.Genres) > maxBlendGenres {
+		return nil, fmt.Errorf("at most %d genres can be blended", maxBlendGenres)
+	}
+
+	blend := req.genreBlend()
+	weighted := 0
+	for _, genre := range blend {
+		if genre.Weight > 0 {
+			weighted++
+		}
+	}
+	if weighted != 0 && weighted != len(blend) {
+		return nil, errors.New("give a weight for every blended genre or for none")
+	}
+
+	resolved := make([]GenreWeight, 0, len(blend))
+	total := 0.0
+	for _, genre := range blend {
+		entry, ok := genres.Lookup(genre.Genre)
+		if !ok {
+			return nil, fmt.Errorf("unsupported genre %q, supported genres: %s",
+				genre.Genre, strings.Join(genres.IDs(), ", "))
+		}
+		for _, previous := range resolved {
+			if previous.Genre == entry.ID {
+				return nil, fmt.Errorf("genre %q is listed twice", entry.ID)
+			}
+		}
+
+		weight := genre.Weight
+		if weighted == 0 {
+			weight = 1
+		}
+		total += weight
+		resolved = append(resolved, GenreWeight{Genre: entry.ID, Weight: weight})
+	}
+
+	for i := range resolved {
+		resolved[i].Weight = math.Round(resolved[i].Weight/total*100) / 100
+	}
+	if len(resolved) == 2 && resolved[1].Weight > resolved[0].Weight {
+		resolved[0], resolved[1] = resolved[1], resolved[0]
+	}
+	return resolved, nil
+}
+
+// genreLabel describes the genre or blend for the prompt, e.g. "folk 60% + electronic 40%".
+// A sub-genre names its parent, e.g. "k-pop (a style of pop)".
+func (c *Catalog) genreLabel(blend []GenreWeight) string {
+	parts := make([]string, 0, len(blend))
+	for _, genre := range blend {
+		label := genre.Genre
+		if entry, ok := c.Genres.Lookup(genre.Genre); ok && entry.Parent != "" {
+			label = fmt.Sprintf("%s (a style of %s)", entry.ID, entry.Parent)
+		}
+		if len(blend) > 1 {
+			label = fmt.Sprintf("%s %.0f%%", label, genre.Weight*100)
+		}
+		parts = append(parts, label)
+	}
+	return strings.Join(parts, " + ")
+}
+
+// genreGuidance returns the style guide lines for each genre of the blend. Sub-genres
+// carry their own guidance on top of that of their root genre.
+func (c *Catalog) genreGuidance(blend []GenreWeight) []string {
+	var lines []string
+	for _, genre := range blend {
+		entry, ok := c.Genres.Lookup(genre.Genre)
+		if !ok {
+			continue
+		}
+		if entry.Parent != "" {
+			if parent, ok := c.Genres.Lookup(entry.Parent); ok && parent.StyleGuide != "" {
+				lines = append(lines, fmt.Sprintf("Genre (%s, root of %s): %s", parent.ID, entry.ID, parent.StyleGuide))
+			}
+		}
+		if entry.StyleGuide != "" {
+			lines = append(lines, fmt.Sprintf("Genre (%s): %s", entry.ID, entry.StyleGuide))
+		}
+	}
+	if len(blend) > 1 {
+		lines = append(lines, fmt.Sprintf(
+			"Blend: combine the genres in proportion to their weights; %s is dominant and sets the overall song form, the others colour the imagery, rhythm and vocabulary.",
+			blend[0].Genre))
+	}
+	return lines
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveGenres(t *testing.T) {
+	genres := DefaultCatalog().Genres
+
+	tests := []struct {
+		name    string
+		req     LyricsRequest
+		want    []GenreWeight
+		wantErr string
+	}{
+		{"single root", LyricsRequest{Genre: "Rock"}, []GenreWeight{{"rock", 1}}, ""},
+		{"sub-genre alias", LyricsRequest{Genre: "kpop"}, []GenreWeight{{"k-pop", 1}}, ""},
+		{"equal blend", LyricsRequest{Genres: []GenreWeight{{Genre: "folk"}, {Genre: "electronic"}}},
+			[]GenreWeight{{"folk", 0.5}, {"electronic", 0.5}}, ""},
+		{"weighted blend puts dominant first", LyricsRequest{Genres: []GenreWeight{{"bluegrass", 30}, {"synthwave", 70}}},
+			[]GenreWeight{{"synthwave", 0.7}, {"bluegrass", 0.3}}, ""},
+		{"both fields", LyricsRequest{Genre: "pop", Genres: []GenreWeight{{Genre: "rock"}}}, nil, "either genre or genres"},
+		{"too many", LyricsRequest{Genres: []GenreWeight{{Genre: "pop"}, {Genre: "rock"}, {Genre: "jazz"}}}, nil, "at most 2"},
+		{"partial weights", LyricsRequest{Genres: []GenreWeight{{"pop", 0.6}, {Genre: "rock"}}}, nil, "every blended genre"},
+		{"duplicate via alias", LyricsRequest{Genres: []GenreWeight{{Genre: "hip-hop"}, {Genre: "rap"}}}, nil, "listed twice"},
+		{"unknown", LyricsRequest{Genres: []GenreWeight{{Genre: "pop"}, {Genre: "vaporwave"}}}, nil, `"vaporwave"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blend, err := resolveGenres(genres, tt.req)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, blend)
+		})
+	}
+}
+
+func TestCatalogValidatesGenreHierarchy(t *testing.T) {
+	_, err := LoadCatalog(writeConfigFile(t, "catalog.yaml", `
+genres:
+  - {id: electronic, display_names: {en: Electronic}}
+  - {id: synthwave, parent: electronic, display_names: {en: Synthwave}}
+  - {id: darksynth, parent: synthwave, display_names: {en: Darksynth}}
+  - {id: bluegrass, parent: country, display_names: {en: Bluegrass}}
+emotions:
+  - {id: happy, display_names: {en: Happy}}
+languages:
+  - {id: english, display_names: {en: English}}
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"darksynth" has parent "synthwave" which is not a root entry`)
+	assert.Contains(t, err.Error(), `"bluegrass" has unknown parent "country"`)
+
+	synthwave, ok := DefaultCatalog().Genres.Lookup("synthwave")
+	require.True(t, ok)
+	assert.Equal(t, "electronic", synthwave.Parent)
+}
+
+func TestBuildPromptCombinesGenreGuidance(t *testing.T) {
+	catalog := DefaultCatalog()
+	service := &LyricsService{}
+	rendered, err := service.Settings().buildPrompt(LyricsRequest{
+		Keywords:  []string{"highway"},
+		Genres:    []GenreWeight{{"synthwave", 0.6}, {"folk", 0.4}},
+		Emotion:   "nostalgic",
+		Language:  "english",
+		Structure: SongStructure{Verses: 2, Chorus: true},
+	}, defaultPromptVersion)
+	require.NoError(t, err)
+	prompt := rendered.User
+
+	synthwave, _ := catalog.Genres.Lookup("synthwave")
+	electronic, _ := catalog.Genres.Lookup("electronic")
+	folk, _ := catalog.Genres.Lookup("folk")
+
+	assert.Contains(t, prompt, "Genre: synthwave (a style of electronic) 60% + folk 40%")
+	assert.Contains(t, prompt, synthwave.StyleGuide)
+	assert.Contains(t, prompt, electronic.StyleGuide)
+	assert.Contains(t, prompt, folk.StyleGuide)
+	assert.Contains(t, prompt, "synthwave is dominant")
+}
+
+func TestGenerateLyricsRejectsInvalidBlend(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(&LyricsService{}))
+
+	for _, body := range []string{
+		`{"keywords":["love"],"genres":[{"genre":"pop"},{"genre":"rock"},{"genre":"jazz"}],"emotion":"happy","language":"english"}`,
+		`{"keywords":["love"],"genres":[{"genre":"pop","weight":-1}],"emotion":"happy","language":"english"}`,
+		`{"keywords":["love"],"emotion":"happy","language":"english"}`,
+	} {
+		req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// version is injected at build time:
+//
+//	go build -ldflags "-X main.version=1.2.3"
+var version = ""
+
+// buildVersion returns the injected version, falling back to the module version or
+// VCS revision recorded by the Go toolchain
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+			return "dev-" + setting.Value[:12]
+		}
+	}
+	return "dev"
+}
+
+// ReadinessCheck verifies a single dependency
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// DependencyStatus reports the outcome of one readiness check
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ReadinessResponse represents the readiness check response
+type ReadinessResponse struct {
+	Status       string                      `json:"status"`
+	Timestamp    time.Time                   `json:"timestamp"`
+	Version      string                      `json:"version"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// livenessCheck reports that the process is up; it does not touch dependencies
+func livenessCheck(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthResponse{
+		Status:    "alive",
+		Timestamp: time.Now(),
+		Version:   buildVersion(),
+	})
+}
+
+// readinessCheck runs all checks concurrently and returns 503 if any of them fails
+func readinessCheck(timeout time.Duration, checks ...ReadinessCheck) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		dependencies := make(map[string]DependencyStatus, len(checks))
+		ready := true
+
+		for _, check := range checks {
+			wg.Add(1)
+			go func(check ReadinessCheck) {
+				defer wg.Done()
+
+				start := time.Now()
+				err := check.Check(ctx)
+				status := DependencyStatus{
+					Status:    "ok",
+					LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+				}
+				if err != nil {
+					status.Status = "fail"
+					status.Error = err.Error()
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				dependencies[check.Name] = status
+				if err != nil {
+					ready = false
+				}
+			}(check)
+		}
+		wg.Wait()
+
+		response := ReadinessResponse{
+			Status:       "ready",
+			Timestamp:    time.Now(),
+			Version:      buildVersion(),
+			Dependencies: dependencies,
+		}
+		code := http.StatusOK
+		if !ready {
+			response.Status = "not_ready"
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, response)
+	}
+}
+
+// oauthReadinessCheck verifies that an access token can be obtained. A cached valid
+// token counts as success, so this only reaches the token endpoint when needed.
+func oauthReadinessCheck(client *OAuthClient) ReadinessCheck {
+	return ReadinessCheck{
+		Name: "oauth",
+		Check: func(ctx context.Context) error {
+			_, err := client.GetAccessToken(ctx)
+			return err
+		},
+	}
+}
+
+// gatewayReadinessCheck probes the AI Gateway base URL. Any HTTP response below 500
+// (including 401/404) shows the gateway is reachable; results are cached for ttl so
+// frequent probes from the orchestrator do not load the gateway.
+func gatewayReadinessCheck(gatewayURL string, ttl time.Duration) ReadinessCheck {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return ReadinessCheck{
+		Name: "gateway",
+		Check: cachedCheck(ttl, func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, gatewayURL, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("gateway unreachable: %w", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= http.StatusInternalServerError {
+				return fmt.Errorf("gateway returned status %d", resp.StatusCode)
+			}
+			return nil
+		}),
+	}
+}
+
+// cachedCheck memoizes the result of check for ttl. A failure caused by the caller's
+// context being cancelled or timing out says nothing about the dependency, so it is
+// returned but not cached.
+func cachedCheck(ttl time.Duration, check func(ctx context.Context) error) func(ctx context.Context) error {
+	var mu sync.Mutex
+	var checkedAt time.Time
+	var lastErr error
+
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !checkedAt.IsZero() && time.Since(checkedAt) < ttl {
+			return lastErr
+		}
+		err := check(ctx)
+		if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			return err
+		}
+		lastErr, checkedAt = err, time.Now()
+		return lastErr
+	}
+}
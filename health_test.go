@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildVersionUsesInjectedVersion(t *testing.T) {
+	previous := version
+	t.Cleanup(func() { version = previous })
+
+	version = "2.3.4"
+	assert.Equal(t, "2.3.4", buildVersion())
+
+	version = ""
+	assert.NotEmpty(t, buildVersion())
+}
+
+func TestLivenessCheck(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/livez", livenessCheck)
+
+	req, _ := http.NewRequest("GET", "/livez", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestReadinessCheck(t *testing.T) {
+	tokenServer, _ := newTestTokenServer(t, 3600, 0, nil)
+	oauthClient := NewOAuthClient(tokenServer.URL, "id", "secret", "")
+
+	var gatewayStatus atomic.Int32
+	gatewayStatus.Store(http.StatusUnauthorized)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(gatewayStatus.Load()))
+	}))
+	defer gateway.Close()
+
+	gin.SetMode(gin.TestMode)
+	newRouter := func(checks ...ReadinessCheck) *gin.Engine {
+		router := gin.New()
+		router.GET("/readyz", readinessCheck(time.Second, checks...))
+		return router
+	}
+	probe := func(router *gin.Engine) (int, ReadinessResponse) {
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response ReadinessResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	// A 401 from the gateway still proves it is reachable
+	router := newRouter(oauthReadinessCheck(oauthClient), gatewayReadinessCheck(gateway.URL, 0))
+	code, response := probe(router)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", response.Status)
+	assert.Equal(t, "ok", response.Dependencies["oauth"].Status)
+	assert.Equal(t, "ok", response.Dependencies["gateway"].Status)
+
+	gatewayStatus.Store(http.StatusBadGateway)
+	code, response = probe(router)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not_ready", response.Status)
+	assert.Equal(t, "fail", response.Dependencies["gateway"].Status)
+	assert.Contains(t, response.Dependencies["gateway"].Error, "502")
+	assert.Equal(t, "ok", response.Dependencies["oauth"].Status)
+}
+
+func TestCachedCheck(t *testing.T) {
+	var calls atomic.Int32
+	check := cachedCheck(time.Hour, func(ctx context.Context) error {
+		calls.Add(1)
+		return errors.New("down")
+	})
+
+	assert.Error(t, check(context.Background()))
+	assert.Error(t, check(context.Background()))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// A probe cut short by its own context is not cached as a failure
+	var healthy atomic.Bool
+	calls.Store(0)
+	check = cachedCheck(time.Hour, func(ctx context.Context) error {
+		calls.Add(1)
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("gateway unreachable: %w", err)
+		}
+		if !healthy.Load() {
+			return errors.New("down")
+		}
+		return nil
+	})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, check(cancelled), context.Canceled)
+	healthy.Store(true)
+	assert.NoError(t, check(context.Background()))
+	assert.NoError(t, check(context.Background()))
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// languageSamples holds a few paragraphs of text per catalog language, named
+// <language>.txt, from which the n-gram profiles are built
+//
+//go:embed langid
+var languageSamples embed.FS
+
+// Language identification tuning
+const (
+	// maxGram is the longest character n-gram in a profile
+	maxGram = 3
+	// minIdentifyLetters is the least text, in letters, worth identifying; a CJK
+	// character counts as three letters since it carries about a syllable
+	minIdentifyLetters = 12
+	// minIdentifyWords is the least number of different words in alphabetic text worth
+	// identifying, so that vocables such as "la la la" or "na na na" are not mistaken
+	// for a language that happens to use those letters
+	minIdentifyWords = 4
+	// identifySharpness scales the mean log-likelihood per n-gram before the softmax
+	// that turns the candidates' scores into confidences
+	identifySharpness = 8
+)
+
+// languageProfile is the character n-gram frequency table of one language
+type languageProfile struct {
+	counts map[string]int
+	// totals and distinct are the number of n-grams and of different n-grams per length
+	totals   [maxGram + 1]int
+	distinct [maxGram + 1]int
+}
+
+// LanguageGuess is a candidate language for a text with its confidence between 0 and 1
+type LanguageGuess struct {
+	Language   string  `json:"language"`
+	Confidence float64 `json:"confidence"`
+}
+
+var (
+	languageProfiles     map[string]*languageProfile
+	languageProfilesOnce sync.Once
+)
+
+// loadLanguageProfiles builds the n-gram profile of every embedded sample
+func loadLanguageProfiles() map[string]*languageProfile {
+	languageProfilesOnce.Do(func() {
+		entries, err := languageSamples.ReadDir("langid")
+		if err != nil {
+			panic(fmt.Sprintf("invalid built-in language samples: %v", err))
+		}
+		languageProfiles = make(map[string]*languageProfile, len(entries))
+		for _, entry := range entries {
+			data, err := languageSamples.ReadFile("langid/" + entry.Name())
+			if err != nil {
+				panic(fmt.Sprintf("invalid built-in language samples: %v", err))
+			}
+			profile := &languageProfile{counts: map[string]int{}}
+			ngrams(string(data), func(gram string, n int) {
+				if profile.counts[gram] == 0 {
+					profile.distinct[n]++
+				}
+				profile.counts[gram]++
+				profile.totals[n]++
+			})
+			languageProfiles[strings.TrimSuffix(entry.Name(), ".txt")] = profile
+		}
+	})
+	return languageProfiles
+}
+
+// ngrams calls fn with every character n-gram of 1 to maxGram letters in text. Words
+// are lowercased and padded with a space so that word starts and endings count.
+func ngrams(text string, fn func(gram string, n int)) {
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		runes := []rune(" " + word + " ")
+		for n := 1; n <= maxGram; n++ {
+			for i := 0; i+n <= len(runes); i++ {
+				if n == 1 && runes[i] == ' ' {
+					continue
+				}
+				fn(string(runes[i:i+n]), n)
+			}
+		}
+	}
+}
+
+// logLikelihood is the mean log-probability per n-gram of text under the profile,
+// with add-one smoothing for n-grams the sample never had
+func (p *languageProfile) logLikelihood(text string) float64 {
+	total, grams := 0.0, 0
+	ngrams(text, func(gram string, n int) {
+		total += math.Log(float64(p.counts[gram]+1) / float64(p.totals[n]+p.distinct[n]+1))
+		grams++
+	})
+	if grams == 0 {
+		return 0
+	}
+	return total / float64(grams)
+}
+
+// scriptCandidates narrows the candidates to those written in the text's dominant
+// script: Hangul for Korean, kana and kanji for Japanese, and Latin letters for the
+// rest. It also returns the amount of text in letters, as counted for
+// minIdentifyLetters.
+func scriptCandidates(text string, candidates []string) ([]string, int) {
+	var hangul, japanese, latin int
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana, unicode.Han):
+			japanese++
+		case unicode.IsLetter(r):
+			latin++
+		}
+	}
+
+	// English words are common in Japanese and Korean lyrics, so CJK wins with a
+	// third as many characters as Latin letters
+	script := ""
+	if cjk := hangul + japanese; cjk > 0 && cjk*3 >= latin {
+		script = "japanese"
+		if hangul >= japanese {
+			script = "korean"
+		}
+	}
+	var matched []string
+	for _, candidate := range candidates {
+		if candidate == script || (script == "" && candidate != "korean" && candidate != "japanese") {
+			matched = append(matched, candidate)
+		}
+	}
+	return matched, (hangul+japanese)*3 + latin
+}
+
+// distinctWords counts the different words of a text, ignoring case
+func distinctWords(text string) int {
+	words := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		words[word] = true
+	}
+	return len(words)
+}
+
+// identifyLanguage ranks the candidate languages for a text, most likely first, using
+// the character n-gram profiles of the embedded samples. It returns nothing when the
+// text is too short or too repetitive to tell, or no candidate is written in its script.
+func identifyLanguage(text string, candidates []string) []LanguageGuess {
+	candidates, letters := scriptCandidates(text, candidates)
+	if letters < minIdentifyLetters {
+		return nil
+	}
+	// Japanese does not separate words with spaces, so the word count only applies to
+	// text in Latin letters
+	if !slices.Contains(candidates, "japanese") && !slices.Contains(candidates, "korean") &&
+		distinctWords(text) < minIdentifyWords {
+		return nil
+	}
+
+	profiles := loadLanguageProfiles()
+	var guesses []LanguageGuess
+	best := math.Inf(-1)
+	for _, candidate := range candidates {
+		profile, ok := profiles[candidate]
+		if !ok {
+			continue
+		}
+		score := profile.logLikelihood(text)
+		best = max(best, score)
+		guesses = append(guesses, LanguageGuess{Language: candidate, Confidence: score})
+	}
+
+	// Softmax relative to the best score, which keeps the exponents small
+	total := 0.0
+	for i := range guesses {
+		guesses[i].Confidence = math.Exp(identifySharpness * (guesses[i].Confidence - best))
+		total += guesses[i].Confidence
+	}
+	for i := range guesses {
+		guesses[i].Confidence = math.Round(guesses[i].Confidence/total*100) / 100
+	}
+	sort.SliceStable(guesses, func(i, j int) bool { return guesses[i].Confidence > guesses[j].Confidence })
+	return guesses
+}
+
+// Handling of sections identified in another language than requested
+const (
+	languageMismatchRetry = "retry"
+	languageMismatchWarn  = "warn"
+	// minLanguageConfidence is the confidence an identification needs before a section
+	// counts as being in another language
+	minLanguageConfidence = 0.6
+)
+
+// SectionLanguage is the language identified in a section of the lyrics
+type SectionLanguage struct {
+	Section    string  `json:"section"`
+	Language   string  `json:"language"`
+	Confidence float64 `json:"confidence"`
+	// Expected lists the requested languages for the section when it is in none of them
+	Expected []string `json:"expected,omitempty"`
+}
+
+// checkSectionLanguages identifies the language of each distinct section among the
+// candidates and returns the identifications along with the sections confidently in a
+// language not requested for them. Sections too short to identify are left out, as
+// are those whose requested language has no profile to compare with.
+func checkSectionLanguages(sections []LyricsSection, req LyricsRequest, candidates []string) (identified, mismatched []SectionLanguage) {
+	profiles := loadLanguageProfiles()
+	seen := map[string]bool{}
+	for _, section := range sections {
+		if seen[section.Name] {
+			continue
+		}
+		seen[section.Name] = true
+
+		expected := req.sectionLanguages(section.Name)
+		profiled := false
+		for _, language := range expected {
+			_, ok := profiles[language]
+			profiled = profiled || ok
+		}
+		guesses := identifyLanguage(strings.Join(section.Lines, "\n"), candidates)
+		if !profiled || len(guesses) == 0 {
+			continue
+		}
+
+		result := SectionLanguage{Section: section.Name, Language: guesses[0].Language, Confidence: guesses[0].Confidence}
+		if result.Confidence >= minLanguageConfidence && !slices.Contains(expected, result.Language) {
+			result.Expected = expected
+			mismatched = append(mismatched, result)
+		}
+		identified = append(identified, result)
+	}
+	return identified, mismatched
+}
+
+// sectionLanguages returns the languages requested for a section: the language it was
+// assigned in a mix by sections, or else every requested language
+func (req LyricsRequest) sectionLanguages(section string) []string {
+	name := normalizeSectionName(section)
+	for _, language := range req.Languages {
+		if slices.Contains(language.Sections, name) {
+			return []string{language.Language}
+		}
+	}
+	return req.languageIDs()
+}
+
+// describeMismatches lists sections in the wrong language, e.g. "verse 2 is in
+// spanish instead of portuguese"
+func describeMismatches(mismatched []SectionLanguage) string {
+	descriptions := make([]string, len(mismatched))
+	for i, section := range mismatched {
+		descriptions[i] = fmt.Sprintf("%s is in %s instead of %s", section.Section, section.Language,
+			strings.Join(section.Expected, " or "))
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+// languageRetryPrompt asks the model to rewrite lyrics whose sections came back in the
+// wrong language
+func languageRetryPrompt(mismatched []SectionLanguage) string {
+	return fmt.Sprintf("Some sections are not in the requested language: %s. Rewrite the complete lyrics "+
+		"with every section in its requested language, in the same format and without any introduction.",
+		describeMismatches(mismatched))
+}
+
+// languageMismatchWarning flags the sections still in the wrong language
+func languageMismatchWarning(mismatched []SectionLanguage) Warning {
+	return Warning{
+		Code:    "language_mismatch",
+		Message: fmt.Sprintf("Some sections appear to be in another language than requested: %s.", describeMismatches(mismatched)),
+	}
+}
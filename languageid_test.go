@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentifyLanguage(t *testing.T) {
+	all := DefaultCatalog().Languages.IDs()
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Quiero estar contigo\nEn la orilla del mar hasta el amanecer", "spanish"},
+		{"Eu quero ficar com você\nNa beira do mar até o amanhecer", "portuguese"},
+		{"Je veux rester avec toi\nAu bord de la mer", "french"},
+		{"Voglio restare con te\nIn riva al mare fino all'alba", "italian"},
+		{"Ich will bei dir bleiben\nAm Meer bis zum Morgen", "german"},
+		{"Dancing in the moonlight\nYou and I", "english"},
+		{"夜明けの道を歩いて", "japanese"},
+		{"너와 나 together\n사랑해 forever", "korean"},
+	}
+	for _, tt := range tests {
+		guesses := identifyLanguage(tt.text, all)
+		require.NotEmpty(t, guesses, tt.text)
+		assert.Equal(t, tt.want, guesses[0].Language, tt.text)
+		assert.GreaterOrEqual(t, guesses[0].Confidence, minLanguageConfidence, tt.text)
+	}
+
+	assert.Empty(t, identifyLanguage("Oh oh oh", all))
+	// Vocables are not a language, however long
+	assert.Empty(t, identifyLanguage("La la la la la la la la", all))
+	assert.Empty(t, identifyLanguage("Na na na na, hey hey hey\nNa na na na, oh oh", all))
+	assert.Empty(t, identifyLanguage("夜明けの道", []string{"spanish", "english", "korean"}))
+	// Candidates without a profile are skipped
+	assert.Equal(t, []LanguageGuess{{Language: "english", Confidence: 1}}, identifyLanguage("Dancing in the moonlight", []string{"english", "klingon"}))
+}
+
+func TestCheckSectionLanguages(t *testing.T) {
+	all := DefaultCatalog().Languages.IDs()
+	sections := []LyricsSection{
+		{Name: "verse 1", Lines: []string{"Eu quero ficar com você", "Na beira do mar até o amanhecer"}},
+		{Name: "chorus", Lines: []string{"Quiero estar contigo", "En la orilla del mar hasta el amanecer"}},
+		{Name: "verse 2", Lines: []string{"Oh oh oh"}},
+		{Name: "chorus", Lines: []string{"Quiero estar contigo", "En la orilla del mar hasta el amanecer"}},
+	}
+
+	identified, mismatched := checkSectionLanguages(sections, LyricsRequest{Language: "portuguese"}, all)
+	require.Len(t, identified, 2)
+	assert.Equal(t, "portuguese", identified[0].Language)
+	require.Len(t, mismatched, 1)
+	assert.Equal(t, "chorus", mismatched[0].Section)
+	assert.Equal(t, "spanish", mismatched[0].Language)
+	assert.Equal(t, []string{"portuguese"}, mismatched[0].Expected)
+	assert.Contains(t, languageRetryPrompt(mismatched), "chorus is in spanish instead of portuguese")
+
+	// A section assigned to spanish in a mix is expected in spanish; a weighted mix accepts either
+	_, mismatched = checkSectionLanguages(sections, LyricsRequest{Language: "portuguese", Languages: []LanguageMix{
+		{Language: "portuguese", Sections: []string{"verse 1", "verse 2"}}, {Language: "spanish", Sections: []string{"chorus"}}}}, all)
+	assert.Empty(t, mismatched)
+	_, mismatched = checkSectionLanguages(sections, LyricsRequest{Language: "spanish", Languages: []LanguageMix{
+		{Language: "spanish", Weight: 0.5}, {Language: "portuguese", Weight: 0.5}}}, all)
+	assert.Empty(t, mismatched)
+
+	// A vocable chorus in an English song is not taken for another language
+	identified, mismatched = checkSectionLanguages([]LyricsSection{
+		{Name: "verse 1", Lines: []string{"Dancing in the moonlight", "You and I until the morning"}},
+		{Name: "chorus", Lines: []string{"La la la la la la la la", "La la la la la la la la"}},
+	}, LyricsRequest{Language: "english"}, all)
+	assert.Len(t, identified, 1)
+	assert.Empty(t, mismatched)
+}
+
+func TestGenerateLyricsRetriesLanguageMismatch(t *testing.T) {
+	spanish := "[Title: Mar]\n[Verse 1]\nEu quero ficar com você\nNa beira do mar até o amanhecer\n[Chorus]\nQuiero estar contigo\nEn la orilla del mar hasta el amanecer"
+	portuguese := "[Title: Mar]\n[Verse 1]\nEu quero ficar com você\nNa beira do mar até o amanhecer\n[Chorus]\nSaudade que não passa\nMeu coração chora sem você"
+	var requests []map[string]interface{}
+	gateway := newSequenceGateway(t, []gatewayReply{{spanish, "stop"}, {portuguese, "stop"}}, &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+	generate := func() LyricsResponse {
+		req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(
+			`{"keywords":["mar"],"genre":"pop","emotion":"romantic","language":"portuguese","structure":{"verses":1,"chorus":true}}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response LyricsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := generate()
+	require.Len(t, requests, 2)
+	messages := requests[1]["messages"].([]interface{})
+	assert.Equal(t, spanish, messages[len(messages)-2].(map[string]interface{})["content"])
+	assert.Contains(t, messages[len(messages)-1].(map[string]interface{})["content"], "chorus is in spanish instead of portuguese")
+	assert.Equal(t, []string{"Saudade que não passa", "Meu coração chora sem você"}, response.Lyrics.Sections[1].Lines)
+	assert.Equal(t, 1, response.Metadata.LanguageRetries)
+	require.Len(t, response.Metadata.SectionLanguages, 2)
+	assert.Equal(t, "portuguese", response.Metadata.SectionLanguages[1].Language)
+	assert.Empty(t, response.Warnings)
+
+	// In warn mode the lyrics are returned as generated, flagged
+	settings := *service.Settings()
+	settings.Generation.LanguageMismatch = languageMismatchWarn
+	service.ApplySettings(&settings)
+	requests = nil
+	response = generate()
+	assert.Len(t, requests, 1)
+	assert.Zero(t, response.Metadata.LanguageRetries)
+	assert.Equal(t, "spanish", response.Metadata.SectionLanguages[1].Language)
+	require.Len(t, response.Warnings, 1)
+	assert.Equal(t, "language_mismatch", response.Warnings[0].Code)
+}
+
+func TestConfigValidatesLanguageMismatch(t *testing.T) {
+	clearConfigEnv(t)
+
+	_, err := LoadConfig(writeConfigFile(t, "config.yaml", strings.Replace(validYAMLConfig,
+		"  default_verses: 3\n", "  default_verses: 3\n  language_mismatch: ignore\n", 1)))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `generation.language_mismatch must be "retry" or "warn", got "ignore"`)
+}
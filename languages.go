@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// maxMixLanguages is the number of languages that can be mixed in one song
+const maxMixLanguages = 3
+
+// LanguageMix is one language of a bilingual song, with either the sections sung in it
+// or its share of the lyrics
+type LanguageMix struct {
+	Language string `json:"language" binding:"required"`
+	// Sections are section names ("verse 2", "chorus"), or "verse" for every verse
+	Sections []string `json:"sections,omitempty"`
+	Weight   float64  `json:"weight,omitempty" binding:"omitempty,gt=0"`
+}
+
+// resolveLanguages validates the requested language or mix against the catalog. It
+// returns the primary language and, for a mix, the languages with canonical IDs and
+// either their sections expanded to the planned sections in song order or their
+// weights normalized to sum to 1, dominant language first.
+func resolveLanguages(languages *CatalogSet, req LyricsRequest) (string, []LanguageMix, error) {
+	if len(req.Languages) == 0 {
+		entry, ok := languages.Lookup(req.Language)
+		if !ok {
+			return "", nil, fmt.Errorf("unsupported language, supported languages: %s", strings.Join(languages.IDs(), ", "))
+		}
+		return entry.ID, nil, nil
+	}
+	if req.Language != "" {
+		return "", nil, errors.New("use either language or languages, not both")
+	}
+	if len(req.Languages) < 2 {
+		return "", nil, errors.New("list at least two languages to mix, or use language for one")
+	}
+	if len(req.Languages) > maxMixLanguages {
+		return "", nil, fmt.Errorf("at most %d languages can be mixed", maxMixLanguages)
+	}
+
+	bySection, weighted := 0, 0
+	mix := make([]LanguageMix, 0, len(req.Languages))
+	for _, language := range req.Languages {
+		entry, ok := languages.Lookup(language.Language)
+		if !ok {
+			return "", nil, fmt.Errorf("unsupported language %q, supported languages: %s",
+				language.Language, strings.Join(languages.IDs(), ", "))
+		}
+		for _, previous := range mix {
+			if previous.Language == entry.ID {
+				return "", nil, fmt.Errorf("language %q is listed twice", entry.ID)
+			}
+		}
+		if len(language.Sections) > 0 {
+			bySection++
+		}
+		if language.Weight > 0 {
+			weighted++
+		}
+		language.Language = entry.ID
+		mix = append(mix, language)
+	}
+
+	switch {
+	case bySection > 0 && weighted > 0:
+		return "", nil, errors.New("assign sections or give weights, not both")
+	case bySection > 0:
+		assigned, err := assignLanguageSections(mix, plannedSections(req.Structure))
+		if err != nil {
+			return "", nil, err
+		}
+		return assigned[0].Language, assigned, nil
+	case weighted != 0 && weighted != len(mix):
+		return "", nil, errors.New("give a weight for every language or for none")
+	}
+
+	total := 0.0
+	for i := range mix {
+		if weighted == 0 {
+			mix[i].Weight = 1
+		}
+		total += mix[i].Weight
+	}
+	for i := range mix {
+		mix[i].Weight = math.Round(mix[i].Weight/total*100) / 100
+	}
+	sort.SliceStable(mix, func(i, j int) bool { return mix[i].Weight > mix[j].Weight })
+	return mix[0].Language, mix, nil
+}
+
+// assignLanguageSections expands each language's sections to planned sections. The
+// first language also takes the sections no language was given.
+func assignLanguageSections(mix []LanguageMix, sections []string) ([]LanguageMix, error) {
+	planned := map[string]bool{}
+	for _, section := range sections {
+		planned[section] = true
+	}
+
+	owner := map[string]int{}
+	for i, language := range mix {
+		for _, name := range language.Sections {
+			target := normalizeSectionName(name)
+			var matched []string
+			switch {
+			case target == "verse":
+				for _, section := range sections {
+					if strings.HasPrefix(section, "verse ") {
+						matched = append(matched, section)
+					}
+				}
+			case planned[target]:
+				matched = []string{target}
+			default:
+				return nil, fmt.Errorf("section %q is not part of the requested structure (%s)",
+					name, strings.Join(sections, ", "))
+			}
+			for _, section := range matched {
+				if previous, ok := owner[section]; ok && previous != i {
+					return nil, fmt.Errorf("section %q is assigned to more than one language", section)
+				}
+				owner[section] = i
+			}
+		}
+	}
+
+	assigned := make([]LanguageMix, len(mix))
+	for i, language := range mix {
+		assigned[i] = LanguageMix{Language: language.Language}
+	}
+	for _, section := range sections {
+		i, ok := owner[section]
+		if !ok {
+			i = 0
+		}
+		assigned[i].Sections = append(assigned[i].Sections, section)
+	}
+	for _, language := range assigned {
+		if len(language.Sections) == 0 {
+			return nil, fmt.Errorf("language %q has no sections; assign it some or give weights instead", language.Language)
+		}
+	}
+	return assigned, nil
+}
+
+// languageIDs returns the requested languages, treating a single language as a mix of one
+func (req LyricsRequest) languageIDs() []string {
+	if len(req.Languages) == 0 {
+		return []string{req.Language}
+	}
+	ids := make([]string, len(req.Languages))
+	for i, language := range req.Languages {
+		ids[i] = language.Language
+	}
+	return ids
+}
+
+// languageNames lists the languages of a mix for the prompt, e.g. "spanish and english"
+func languageNames(mix []LanguageMix) string {
+	names := LyricsRequest{Languages: mix}.languageIDs()
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// detectLanguage picks the candidate language a text is most likely in, or "" when
+// the text is too short or no candidate is confidently identified
+func detectLanguage(text string, candidates []string) string {
+	guesses := identifyLanguage(text, candidates)
+	if len(guesses) == 0 || guesses[0].Confidence < minLanguageConfidence {
+		return ""
+	}
+	return guesses[0].Language
+}
+
+// tagSectionLanguages sets the detected language of each section of a mixed song
+func tagSectionLanguages(sections []LyricsSection, mix []LanguageMix) {
+	candidates := LyricsRequest{Languages: mix}.languageIDs()
+	for i := range sections {
+		sections[i].Language = detectLanguage(strings.Join(sections[i].Lines, "\n"), candidates)
+	}
+}
+
+// sectionLanguage returns the language a section is sung in: its detected language in
+// a mixed song, or the song's language
+func (r LyricsResponse) sectionLanguage(section LyricsSection) string {
+	if section.Language != "" {
+		return section.Language
+	}
+	return r.Metadata.Language
+}
+
+// inLanguage reports whether the whole song is in the given language: its language,
+// or for a mixed song the language of every section
+func (r LyricsResponse) inLanguage(language string) bool {
+	if len(r.Metadata.Languages) == 0 {
+		return r.Metadata.Language == language
+	}
+	for _, section := range r.Lyrics.Sections {
+		if r.sectionLanguage(section) != language {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveLanguages(t *testing.T) {
+	languages := DefaultCatalog().Languages
+	structure := SongStructure{Verses: 2, Chorus: true, Bridge: true}
+
+	tests := []struct {
+		name        string
+		req         LyricsRequest
+		wantPrimary string
+		want        []LanguageMix
+		wantErr     string
+	}{
+		{"single language", LyricsRequest{Language: "Español"}, "spanish", nil, ""},
+		{"unknown single language", LyricsRequest{Language: "klingon"}, "", nil, "unsupported language, supported languages: english"},
+		{"by section, first takes the rest", LyricsRequest{Structure: structure, Languages: []LanguageMix{
+			{Language: "spanish", Sections: []string{"verse"}}, {Language: "english", Sections: []string{"Chorus"}}}},
+			"spanish", []LanguageMix{
+				{Language: "spanish", Sections: []string{"verse 1", "verse 2", "bridge"}},
+				{Language: "english", Sections: []string{"chorus"}}}, ""},
+		{"equal mix", LyricsRequest{Languages: []LanguageMix{{Language: "korean"}, {Language: "english"}}},
+			"korean", []LanguageMix{{Language: "korean", Weight: 0.5}, {Language: "english", Weight: 0.5}}, ""},
+		{"weighted mix puts dominant first", LyricsRequest{Languages: []LanguageMix{{"english", nil, 30}, {"korean", nil, 70}}},
+			"korean", []LanguageMix{{Language: "korean", Weight: 0.7}, {Language: "english", Weight: 0.3}}, ""},
+		{"both fields", LyricsRequest{Language: "english", Languages: []LanguageMix{{Language: "spanish"}, {Language: "french"}}}, "", nil, "either language or languages"},
+		{"one language", LyricsRequest{Languages: []LanguageMix{{Language: "spanish"}}}, "", nil, "at least two"},
+		{"too many", LyricsRequest{Languages: []LanguageMix{{Language: "spanish"}, {Language: "english"}, {Language: "french"}, {Language: "german"}}}, "", nil, "at most 3"},
+		{"duplicate via alias", LyricsRequest{Languages: []LanguageMix{{Language: "spanish"}, {Language: "español"}}}, "", nil, "listed twice"},
+		{"unknown", LyricsRequest{Languages: []LanguageMix{{Language: "spanish"}, {Language: "klingon"}}}, "", nil, `"klingon"`},
+		{"sections and weights", LyricsRequest{Structure: structure, Languages: []LanguageMix{
+			{Language: "spanish", Sections: []string{"verse"}}, {Language: "english", Weight: 0.5}}}, "", nil, "not both"},
+		{"partial weights", LyricsRequest{Languages: []LanguageMix{{"spanish", nil, 0.6}, {Language: "english"}}}, "", nil, "every language"},
+		{"section outside the structure", LyricsRequest{Structure: SongStructure{Verses: 2, Chorus: true}, Languages: []LanguageMix{
+			{Language: "spanish", Sections: []string{"verse"}}, {Language: "english", Sections: []string{"bridge"}}}}, "", nil, `section "bridge" is not part`},
+		{"section assigned twice", LyricsRequest{Structure: structure, Languages: []LanguageMix{
+			{Language: "spanish", Sections: []string{"verse"}}, {Language: "english", Sections: []string{"verse 2"}}}}, "", nil, "more than one language"},
+		{"language left without sections", LyricsRequest{Structure: structure, Languages: []LanguageMix{
+			{Language: "spanish", Sections: []string{"verse"}}, {Language: "english", Sections: []string{"chorus"}}, {Language: "french"}}}, "", nil, `"french" has no sections`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, mix, err := resolveLanguages(languages, tt.req)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPrimary, primary)
+			assert.Equal(t, tt.want, mix)
+		})
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	candidates := []string{"spanish", "english", "korean"}
+	assert.Equal(t, "spanish", detectLanguage("Bailando en la noche\nTu corazón es mío", candidates))
+	assert.Equal(t, "english", detectLanguage("Dancing in the moonlight\nYou and I", candidates))
+	assert.Equal(t, "korean", detectLanguage("너와 나 together\n사랑해 forever", candidates))
+	assert.Equal(t, "", detectLanguage("Oh oh oh", candidates))
+	assert.Equal(t, "", detectLanguage("夜明けの道", candidates))
+}
+
+func TestBuildPromptDescribesLanguageMix(t *testing.T) {
+	catalog := DefaultCatalog()
+	service := &LyricsService{}
+	service.settings.Store(&ServiceSettings{Catalog: catalog, Prompts: DefaultPrompts()})
+
+	rendered, err := service.Settings().buildPrompt(LyricsRequest{
+		Keywords: []string{"noche"},
+		Genre:    "pop",
+		Emotion:  "romantic",
+		Language: "spanish",
+		Languages: []LanguageMix{
+			{Language: "spanish", Sections: []string{"verse 1", "verse 2"}},
+			{Language: "english", Sections: []string{"chorus"}},
+		},
+		Structure: SongStructure{Verses: 2, Chorus: true},
+	}, defaultPromptVersion)
+	require.NoError(t, err)
+	assert.Contains(t, rendered.User, "Write song lyrics in spanish and english with the following specifications:")
+	assert.Contains(t, rendered.User, "- Spanish: verse 1, verse 2\n- English: chorus\n")
+
+	rendered, err = service.Settings().buildPrompt(LyricsRequest{
+		Keywords:  []string{"seoul"},
+		Genre:     "k-pop",
+		Emotion:   "energetic",
+		Language:  "korean",
+		Languages: []LanguageMix{{Language: "korean", Weight: 0.7}, {Language: "english", Weight: 0.3}},
+		Structure: SongStructure{Verses: 2, Chorus: true},
+	}, defaultPromptVersion)
+	require.NoError(t, err)
+	assert.Contains(t, rendered.User, "- Korean: about 70% of the lines\n- English: about 30% of the lines\n")
+	for _, id := range []string{"korean", "english"} {
+		if language, _ := catalog.Languages.Lookup(id); language.StyleGuide != "" {
+			assert.Contains(t, rendered.User, language.StyleGuide)
+		}
+	}
+}
+
+func TestGenerateLyricsTagsSectionLanguages(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newTestGateway(t, "[Title: Noche]\n[Verse 1]\nBailando en la noche\nTu corazón es mío\n[Chorus]\nYou and I tonight\n[Verse 2]\nLa luna y el mar", &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+	generate := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := generate(`{"keywords":["noche"],"genre":"pop","emotion":"romantic","languages":[{"language":"es","sections":["verse"]},{"language":"english","sections":["chorus"]}]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response LyricsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	assert.Equal(t, "spanish", response.Metadata.Language)
+	assert.Equal(t, []LanguageMix{
+		{Language: "spanish", Sections: []string{"verse 1", "verse 2"}},
+		{Language: "english", Sections: []string{"chorus"}},
+	}, response.Metadata.Languages)
+	var tags []string
+	for _, section := range response.Lyrics.Sections {
+		tags = append(tags, section.Language)
+	}
+	assert.Equal(t, []string{"spanish", "english", "spanish"}, tags)
+	require.Len(t, requests, 1)
+
+	w = generate(`{"keywords":["noche"],"genre":"pop","emotion":"romantic","languages":[{"language":"spanish"},{"language":"english","sections":["bridge"]}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_language")
+	// Validation errors are turned into sentences for clients
+	assert.Contains(t, w.Body.String(), `"message":"Section \"bridge\" is not part of the requested structure (verse 1, chorus, verse 2)."`)
+	w = generate(`{"keywords":["noche"],"genre":"pop","emotion":"romantic"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
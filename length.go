@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// Target song lengths, as words per section
+const (
+	lengthShort  = "short"
+	lengthMedium = "medium"
+	lengthLong   = "long"
+)
+
+var lengthPresets = map[string]WordRange{
+	lengthShort:  {Min: 20, Max: 35},
+	lengthMedium: {Min: 35, Max: 55},
+	lengthLong:   {Min: 55, Max: 80},
+}
+
+// Completion sizing: tokens are estimated from the upper word target, with headroom
+// for the title, section labels and the model overshooting the target
+const (
+	defaultTokensPerWord = 1.5
+	tokenHeadroom        = 1.3
+	titleTokens          = 20
+	sectionLabelTokens   = 8
+)
+
+// Truncation handling when a completion stops at the token limit
+const (
+	truncationContinue = "continue"
+	truncationWarn     = "warn"
+)
+
+// continuationPrompt asks the model to finish a completion that hit the token limit
+const continuationPrompt = "Your previous reply was cut off. Continue the lyrics exactly where they stopped, without repeating anything already written and without any introduction."
+
+// WordRange is a target song length in words
+type WordRange struct {
+	Min int `json:"min" binding:"required,min=10"`
+	Max int `json:"max" binding:"required,gtefield=Min,max=2000"`
+}
+
+// Warning describes a problem with a generated song that did not fail the request
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// resolveWordRange returns the target length of the song in words: the requested word
+// range, or the length preset (medium by default) scaled to the planned sections
+func resolveWordRange(req LyricsRequest) (WordRange, error) {
+	if req.WordRange != nil {
+		if req.Length != "" {
+			return WordRange{}, errors.New("use either length or word_range, not both")
+		}
+		return *req.WordRange, nil
+	}
+
+	length := req.Length
+	if length == "" {
+		length = lengthMedium
+	}
+	perSection := lengthPresets[length]
+	sections := len(plannedSections(req.Structure))
+	return WordRange{Min: perSection.Min * sections, Max: perSection.Max * sections}, nil
+}
+
+// estimateMaxTokens sizes the completion for the target length in the request's
+// language, or the costliest language of a mix, capped at the configured limit
+func (settings *ServiceSettings) estimateMaxTokens(req LyricsRequest) int {
+	limit := settings.Generation.MaxTokens
+	if req.WordRange == nil {
+		return limit
+	}
+
+	tokensPerWord := 0.0
+	for _, id := range req.languageIDs() {
+		if language, ok := settings.Catalog.Languages.Lookup(id); ok && language.TokensPerWord > 0 {
+			tokensPerWord = max(tokensPerWord, language.TokensPerWord)
+		}
+	}
+	if tokensPerWord == 0 {
+		tokensPerWord = defaultTokensPerWord
+	}
+	sections := len(plannedSections(req.Structure))
+	estimate := int(math.Ceil(float64(req.WordRange.Max)*tokensPerWord*tokenHeadroom)) +
+		titleTokens + sections*sectionLabelTokens
+	return min(estimate, limit)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatewayReply is one canned chat completion
+type gatewayReply struct {
+	content      string
+	finishReason string
+}
+
+// newSequenceGateway serves the replies in order, repeating the last one
+func newSequenceGateway(t *testing.T, replies []gatewayReply, requests *[]map[string]interface{}) *httptest.Server {
+	var mu sync.Mutex
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		mu.Lock()
+		reply := replies[min(len(*requests), len(replies)-1)]
+		*requests = append(*requests, body)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      "chatcmpl-test",
+			"object":  "chat.completion",
+			"created": 0,
+			"model":   "gpt-3.5-turbo",
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"message":       map[string]string{"role": "assistant", "content": reply.content},
+				"finish_reason": reply.finishReason,
+			}},
+			"usage": map[string]int{"prompt_tokens": 10, "completion_tokens": 20, "total_tokens": 30},
+		})
+	}))
+	t.Cleanup(gateway.Close)
+	return gateway
+}
+
+func TestResolveWordRange(t *testing.T) {
+	structure := SongStructure{Verses: 2, Chorus: true}
+
+	wordRange, err := resolveWordRange(LyricsRequest{Structure: structure})
+	require.NoError(t, err)
+	assert.Equal(t, WordRange{Min: 105, Max: 165}, wordRange)
+
+	wordRange, err = resolveWordRange(LyricsRequest{Structure: structure, Length: lengthShort})
+	require.NoError(t, err)
+	assert.Equal(t, WordRange{Min: 60, Max: 105}, wordRange)
+
+	wordRange, err = resolveWordRange(LyricsRequest{Structure: structure, WordRange: &WordRange{Min: 90, Max: 120}})
+	require.NoError(t, err)
+	assert.Equal(t, WordRange{Min: 90, Max: 120}, wordRange)
+
+	_, err = resolveWordRange(LyricsRequest{Length: lengthLong, WordRange: &WordRange{Min: 90, Max: 120}})
+	assert.EqualError(t, err, "use either length or word_range, not both")
+	assert.Equal(t, "Use either length or word_range, not both.", errorMessage(err))
+}
+
+func TestEstimateMaxTokens(t *testing.T) {
+	settings := &ServiceSettings{Catalog: DefaultCatalog(), Generation: GenerationConfig{MaxTokens: 4000}}
+	structure := SongStructure{Verses: 4, Chorus: true, Bridge: true}
+	long := &WordRange{Min: 330, Max: 480}
+
+	english := settings.estimateMaxTokens(LyricsRequest{Language: "english", Structure: structure, WordRange: long})
+	japanese := settings.estimateMaxTokens(LyricsRequest{Language: "japanese", Structure: structure, WordRange: long})
+	assert.Equal(t, 942, english)
+	assert.Equal(t, 1940, japanese)
+
+	// The estimate never exceeds the configured limit
+	settings.Generation.MaxTokens = 1500
+	assert.Equal(t, 1500, settings.estimateMaxTokens(LyricsRequest{Language: "japanese", Structure: structure, WordRange: long}))
+	assert.Equal(t, 1500, settings.estimateMaxTokens(LyricsRequest{Language: "english", Structure: structure}))
+}
+
+func TestGenerateLyricsSizesAndContinuesCompletion(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newSequenceGateway(t, []gatewayReply{
+		{"[Title: 夜明け]\n[Verse 1]\n夜明けの", "length"},
+		{"道を歩く\n[Chorus]\n光へ", "stop"},
+	}, &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+	generate := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := generate(`{"keywords":["dawn"],"genre":"j-pop","emotion":"hopeful","language":"japanese",
+		"structure":{"verses":4,"chorus":true,"bridge":true},"length":"long"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response LyricsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "夜明けの道を歩く", response.Lyrics.Structure["verse 1"])
+	assert.Equal(t, &WordRange{Min: 330, Max: 480}, response.Metadata.TargetWords)
+	assert.Equal(t, 1940, response.Metadata.MaxTokens)
+	assert.Equal(t, "stop", response.Metadata.FinishReason)
+	assert.Equal(t, 1, response.Metadata.Continuations)
+	assert.Empty(t, response.Warnings)
+
+	require.Len(t, requests, 2)
+	assert.Equal(t, 1940.0, requests[0]["max_tokens"])
+	raw, _ := json.Marshal(requests[0]["messages"])
+	assert.Contains(t, string(raw), "Target length: 330-480 words in total")
+	messages := requests[1]["messages"].([]interface{})
+	assistant := messages[len(messages)-2].(map[string]interface{})
+	assert.Equal(t, "assistant", assistant["role"])
+	assert.Equal(t, "[Title: 夜明け]\n[Verse 1]\n夜明けの", assistant["content"])
+	assert.Equal(t, continuationPrompt, messages[len(messages)-1].(map[string]interface{})["content"])
+
+	// In warn mode the partial lyrics are returned with a warning
+	settings := *service.Settings()
+	settings.Generation.Truncation = truncationWarn
+	service.ApplySettings(&settings)
+	requests = nil
+	w = generate(`{"keywords":["dawn"],"genre":"j-pop","emotion":"hopeful","language":"japanese","word_range":{"min":80,"max":100}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	response = LyricsResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, requests, 1)
+	assert.Equal(t, "length", response.Metadata.FinishReason)
+	require.Len(t, response.Warnings, 1)
+	assert.Equal(t, "lyrics_truncated", response.Warnings[0].Code)
+
+	w = generate(`{"keywords":["dawn"],"genre":"pop","emotion":"happy","language":"english","length":"short","word_range":{"min":80,"max":100}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_length")
+	w = generate(`{"keywords":["dawn"],"genre":"pop","emotion":"happy","language":"english","word_range":{"min":100,"max":80}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = generate(`{"keywords":["dawn"],"genre":"pop","emotion":"happy","language":"english","length":"epic"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGenerateLyricsResetsTruncationForKeptRetry(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newSequenceGateway(t, []gatewayReply{
+		{"[Title: Mar]\n[Verse 1]\nQuiero estar contigo\nEn la orilla del mar", "length"},
+		{" hasta el amanecer\n[Chorus]\nLuces del puerto, llévame a casa esta noche", "stop"},
+		{"[Title: Harbor]\n[Verse 1]\nThe harbor sleeps beneath the rain\nI walk the pier and call again\n[Chorus]\nHarbor lights, carry me home", "stop"},
+	}, &requests)
+	service := newTestLyricsService(t, gateway.URL)
+	continued := truncatedCompletionsTotal.WithLabelValues(service.Settings().Model, "continued")
+	before := testutil.ToFloat64(continued)
+
+	// The continued Spanish lyrics are replaced by the language retry, so the response
+	// and metrics describe the retry rather than the discarded continuation
+	response, err := service.GenerateLyrics(context.Background(), LyricsRequest{Keywords: []string{"harbor"}, Genre: "folk", Emotion: "peaceful", Language: "english"})
+	require.NoError(t, err)
+	require.Len(t, requests, 3)
+	assert.Equal(t, "Harbor", response.Lyrics.Title)
+	assert.Equal(t, 1, response.Metadata.LanguageRetries)
+	assert.Equal(t, "stop", response.Metadata.FinishReason)
+	assert.Zero(t, response.Metadata.Continuations)
+	assert.Empty(t, response.Warnings)
+	assert.Equal(t, before, testutil.ToFloat64(continued))
+}
+
+func TestConfigValidatesTruncation(t *testing.T) {
+	clearConfigEnv(t)
+
+	_, err := LoadConfig(writeConfigFile(t, "config.yaml", strings.Replace(validYAMLConfig,
+		"  default_verses: 3\n", "  default_verses: 3\n  truncation: drop\n  max_continuations: 5\n", 1)))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `generation.truncation must be "continue" or "warn", got "drop"`)
+	assert.Contains(t, err.Error(), "generation.max_continuations must be between 0 and 3, got 5")
+}
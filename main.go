@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,6 +26,11 @@ import (
 	"github.com/openai/openai-go/v2/option"
 	"github.com/rs/zerolog"
 	zerologlog "github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 // OAuth 2.0 Client Credentials structures
@@ -71,14 +81,70 @@ type AzureContentCategory struct {
 type OAuthClient struct {
 	httpClient    *http.Client
 	tokenEndpoint string
-	clientID      string
-	clientSecret  string
 	scope         string
 
+	// Client authentication at the token endpoint; credentials are guarded by
+	// mutex because they can be rotated while the client is in use
+	authMethod  ClientAuthMethod
+	credentials ClientCredentials
+
+	// Refresh policy: tokens are renewed in the background once refreshFraction
+	// of their lifetime has elapsed; failed renewals are retried after retryInterval,
+	// doubling with each consecutive failure up to maxRefreshBackoff
+	refreshFraction float64
+	retryInterval   time.Duration
+
 	// Token management
 	mutex       sync.RWMutex
 	accessToken string
+	issuedAt    time.Time
 	expiresAt   time.Time
+
+	// Refresh deduplication and observability
+	group         singleflight.Group
+	refreshes     int64
+	failures      int64
+	invalidations int64
+	rotations     int64
+	lastRefresh   time.Time
+	lastErr       error
+	failStreak    int
+	rescheduled   chan struct{}
+}
+
+// maxRefreshBackoff caps the delay between failed token renewals
+const maxRefreshBackoff = 5 * time.Minute
+
+// OAuthClientOption configures optional OAuthClient behaviour
+type OAuthClientOption func(*OAuthClient)
+
+// WithRefreshFraction sets the fraction of expires_in after which a token is renewed
+func WithRefreshFraction(fraction float64) OAuthClientOption {
+	return func(o *OAuthClient) {
+		if fraction > 0 && fraction < 1 {
+			o.refreshFraction = fraction
+		}
+	}
+}
+
+// WithRefreshRetryInterval sets the delay between failed background renewals
+func WithRefreshRetryInterval(interval time.Duration) OAuthClientOption {
+	return func(o *OAuthClient) {
+		if interval > 0 {
+			o.retryInterval = interval
+		}
+	}
+}
+
+// OAuthStats is a snapshot of the token refresh state
+type OAuthStats struct {
+	Refreshes     int64     `json:"refreshes"`
+	Failures      int64     `json:"failures"`
+	Invalidations int64     `json:"invalidations"`
+	Rotations     int64     `json:"rotations"`
+	LastRefresh   time.Time `json:"last_refresh"`
+	LastError     string    `json:"last_error,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
 }
 
 // OAuthTransport is a custom HTTP transport that automatically injects OAuth tokens
@@ -87,21 +153,62 @@ type OAuthTransport struct {
 	baseTransport http.RoundTripper
 }
 
-// RoundTrip implements the http.RoundTripper interface with OAuth token injection
+// RoundTrip implements the http.RoundTripper interface with OAuth token injection.
+// If the gateway rejects the token (e.g. it was revoked before its local expiry),
+// the cached token is invalidated and the request is replayed once with a new one.
 func (t *OAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Make sure the body can be replayed if the first attempt is rejected
+	getBody, err := rewindableBody(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to buffer request body: %w", err)
+	}
+
+	token, resp, err := t.send(req, getBody)
+	if err != nil || !isInvalidTokenResponse(resp) {
+		return resp, err
+	}
+
+	zerologlog.Warn().
+		Int("status_code", resp.StatusCode).
+		Str("url", req.URL.String()).
+		Msg("Gateway rejected OAuth token, refreshing and retrying once")
+
+	// Discard the rejected response before replaying
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.oauthClient.Invalidate(token)
+	_, resp, err = t.send(req, getBody)
+	return resp, err
+}
+
+// send performs a single attempt with the current access token on a clone of req,
+// whose body is taken from getBody when there is one
+func (t *OAuthTransport) send(req *http.Request, getBody func() (io.ReadCloser, error)) (string, *http.Response, error) {
 	// Clone the request to avoid modifying the original
 	newReq := req.Clone(req.Context())
+	if getBody != nil {
+		body, err := getBody()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to rewind request body: %w", err)
+		}
+		newReq.Body = body
+		newReq.GetBody = getBody
+	}
 
 	// Get OAuth access token
 	token, err := t.oauthClient.GetAccessToken(req.Context())
 	if err != nil {
 		zerologlog.Error().Err(err).Msg("Failed to get OAuth token in transport")
-		return nil, fmt.Errorf("OAuth authentication failed in transport: %w", err)
+		return "", nil, fmt.Errorf("OAuth authentication failed in transport: %w", err)
 	}
 
 	// Set Authorization header with Bearer token
 	newReq.Header.Set("Authorization", "Bearer "+token)
 
+	// Propagate the W3C trace context to the gateway
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(newReq.Header))
+
 	// Log the request (with sanitized token)
 	zerologlog.Debug().
 		Str("method", newReq.Method).
@@ -110,7 +217,39 @@ func (t *OAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		Msg("OAuth transport injecting token")
 
 	// Use the base transport to make the actual request
-	return t.baseTransport.RoundTrip(newReq)
+	resp, err := t.baseTransport.RoundTrip(newReq)
+	return token, resp, err
+}
+
+// rewindableBody returns a function that yields a fresh copy of the request body.
+// A body without GetBody is read into memory; either way the original body is closed,
+// as RoundTrip must do, but the request itself is left untouched. It returns nil when there is
+// no body.
+func rewindableBody(req *http.Request) (func() (io.ReadCloser, error), error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		req.Body.Close()
+		return req.GetBody, nil
+	}
+
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, nil
+}
+
+// isInvalidTokenResponse reports whether the gateway rejected the bearer token
+func isInvalidTokenResponse(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusUnauthorized {
+		return true
+	}
+	return strings.Contains(resp.Header.Get("WWW-Authenticate"), "invalid_token")
 }
 
 // NewOAuthTransport creates a new OAuth transport with the given OAuth client
@@ -124,7 +263,72 @@ func NewOAuthTransport(oauthClient *OAuthClient) *OAuthTransport {
 // LyricsService handles the lyrics generation logic using OpenAI SDK with OAuth
 type LyricsService struct {
 	openaiClient *openai.Client
-	model        string
+	settings     atomic.Pointer[ServiceSettings]
+	store        *LyricsStore
+	experiments  *ExperimentTracker
+	exemplars    *ExemplarLibrary
+}
+
+// LyricsServiceOption configures optional LyricsService behaviour
+type LyricsServiceOption func(*LyricsService)
+
+// WithLyricsStore sets the store generated songs are saved to
+func WithLyricsStore(store *LyricsStore) LyricsServiceOption {
+	return func(s *LyricsService) {
+		s.store = store
+	}
+}
+
+// WithExemplarLibrary sets the few-shot exemplars added to prompts
+func WithExemplarLibrary(exemplars *ExemplarLibrary) LyricsServiceOption {
+	return func(s *LyricsService) {
+		s.exemplars = exemplars
+	}
+}
+
+// ServiceSettings are the generation settings that can be reloaded at runtime
+type ServiceSettings struct {
+	Model           string
+	Generation      GenerationConfig
+	BlockedKeywords []string
+	Catalog         *Catalog
+	Prompts         *PromptLibrary
+	PromptVersion   string
+	Experiments     []ExperimentConfig
+	AdminToken      string
+	// Similarity configures the near-duplicate check against stored songs and Corpus
+	Similarity SimilarityConfig
+	Corpus     *LyricsCorpus
+	// Few-shot exemplars: the token budget per request and the most to include
+	ExemplarTokenBudget int
+	MaxExemplars        int
+}
+
+// Settings returns the active settings, falling back to the defaults
+func (s *LyricsService) Settings() *ServiceSettings {
+	if settings := s.settings.Load(); settings != nil {
+		return settings
+	}
+	cfg := DefaultConfig()
+	return cfg.ServiceSettings()
+}
+
+// ApplySettings atomically replaces the settings used by subsequent requests
+func (s *LyricsService) ApplySettings(settings *ServiceSettings) {
+	s.settings.Store(settings)
+}
+
+// blockedKeyword returns the first keyword that matches the local safety policy
+func (settings *ServiceSettings) blockedKeyword(keywords []string) (string, bool) {
+	for _, keyword := range keywords {
+		lower := strings.ToLower(keyword)
+		for _, blocked := range settings.BlockedKeywords {
+			if strings.Contains(lower, blocked) {
+				return keyword, true
+			}
+		}
+	}
+	return "", false
 }
 
 // sanitizeForLogging removes sensitive information from strings for logging
@@ -149,63 +353,249 @@ func sanitizeForLogging(input string) string {
 }
 
 // NewOAuthClient creates a new OAuth client for Client Credentials flow
-func NewOAuthClient(tokenEndpoint, clientID, clientSecret, scope string) *OAuthClient {
-	return &OAuthClient{
-		httpClient:    &http.Client{Timeout: 30 * time.Second},
-		tokenEndpoint: tokenEndpoint,
-		clientID:      clientID,
-		clientSecret:  clientSecret,
-		scope:         scope,
+func NewOAuthClient(tokenEndpoint, clientID, clientSecret, scope string, opts ...OAuthClientOption) *OAuthClient {
+	o := &OAuthClient{
+		httpClient:      &http.Client{Timeout: 30 * time.Second},
+		tokenEndpoint:   tokenEndpoint,
+		credentials:     ClientCredentials{ClientID: clientID, ClientSecret: clientSecret},
+		scope:           scope,
+		authMethod:      ClientAuthSecretPost,
+		refreshFraction: 0.8,
+		retryInterval:   5 * time.Second,
+		rescheduled:     make(chan struct{}, 1),
 	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
 }
 
-// GetAccessToken retrieves a valid access token, refreshing if necessary
+// GetAccessToken returns the cached access token while it is still valid. Renewal
+// normally happens in the background (see Start); callers only block when there is
+// no usable token, and concurrent callers share a single token request.
 func (o *OAuthClient) GetAccessToken(ctx context.Context) (string, error) {
+	ctx, span := tracer().Start(ctx, "OAuthClient.GetAccessToken")
+	defer span.End()
+
 	o.mutex.RLock()
-	// Check if we have a valid token (with 30 second buffer)
-	if o.accessToken != "" && time.Now().Add(30*time.Second).Before(o.expiresAt) {
-		token := o.accessToken
-		o.mutex.RUnlock()
+	token, expiresAt := o.accessToken, o.expiresAt
+	o.mutex.RUnlock()
+
+	if token != "" && time.Now().Before(expiresAt) {
+		span.SetAttributes(attrTokenCacheHit.Bool(true))
 		return token, nil
 	}
-	o.mutex.RUnlock()
 
-	// Need to get a new token
+	span.SetAttributes(attrTokenCacheHit.Bool(false))
+	token, err := o.refresh(ctx)
+	if err != nil {
+		recordSpanError(span, err)
+	}
+	return token, err
+}
+
+// refresh fetches a new token, deduplicating concurrent calls. The token request
+// is detached from the caller's context so that one cancelled caller does not fail
+// the others waiting on the same refresh.
+func (o *OAuthClient) refresh(ctx context.Context) (string, error) {
+	ch := o.group.DoChan("token", func() (interface{}, error) {
+		return o.fetchAndStore(context.WithoutCancel(ctx))
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// fetchAndStore requests a new token and records the outcome
+func (o *OAuthClient) fetchAndStore(ctx context.Context) (string, error) {
+	creds := o.Credentials()
+	tokenResp, err := o.requestNewToken(ctx, creds)
+
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
 
-	// Double-check after acquiring write lock
-	if o.accessToken != "" && time.Now().Add(30*time.Second).Before(o.expiresAt) {
+	if err != nil {
+		o.failures++
+		o.failStreak++
+		o.lastErr = err
+		return "", err
+	}
+
+	// Credentials were rotated while this request was in flight; the rotation
+	// already installed a token issued for the new credentials
+	if o.credentials != creds {
 		return o.accessToken, nil
 	}
 
-	return o.requestNewToken(ctx)
+	return o.storeToken(tokenResp), nil
+}
+
+// storeToken records a newly issued token; callers must hold the write lock
+func (o *OAuthClient) storeToken(tokenResp *OAuthTokenResponse) string {
+	// Default to 1 hour if the token endpoint does not provide an expiry
+	expiresIn := tokenResp.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = 3600
+	}
+
+	now := time.Now()
+	o.accessToken = tokenResp.AccessToken
+	o.issuedAt = now
+	o.expiresAt = now.Add(time.Duration(expiresIn) * time.Second)
+	o.refreshes++
+	o.lastRefresh = now
+	o.lastErr = nil
+	o.failStreak = 0
+
+	// Wake the renewal loop so it schedules against the new expiry
+	select {
+	case o.rescheduled <- struct{}{}:
+	default:
+	}
+
+	zerologlog.Debug().
+		Str("token_type", tokenResp.TokenType).
+		Int("expires_in", tokenResp.ExpiresIn).
+		Time("expires_at", o.expiresAt).
+		Msg("Successfully obtained OAuth access token")
+
+	return o.accessToken
+}
+
+// Start runs the background renewal loop until ctx is cancelled. The current token
+// keeps being served while renewals fail, until it actually expires.
+func (o *OAuthClient) Start(ctx context.Context) {
+	go func() {
+		for {
+			timer := time.NewTimer(o.nextRefreshDelay())
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-o.rescheduled:
+				timer.Stop()
+				continue
+			case <-timer.C:
+			}
+
+			if _, err := o.refresh(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				zerologlog.Warn().Err(err).
+					Time("expires_at", o.Stats().ExpiresAt).
+					Msg("Background OAuth token renewal failed, serving current token")
+			}
+		}
+	}()
+}
+
+// nextRefreshDelay returns how long the renewal loop should wait before refreshing
+func (o *OAuthClient) nextRefreshDelay() time.Duration {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	if o.lastErr != nil {
+		// Retry sooner after a failure while the current token is still valid, but
+		// once it has expired (or there is none) wait out the full backoff
+		delay := o.retryBackoff()
+		if remaining := time.Until(o.expiresAt); o.accessToken != "" && remaining > 0 && remaining < delay {
+			delay = remaining
+		}
+		return delay
+	}
+	if o.accessToken == "" {
+		return 0
+	}
+
+	lifetime := o.expiresAt.Sub(o.issuedAt)
+	refreshAt := o.issuedAt.Add(time.Duration(float64(lifetime) * o.refreshFraction))
+	return max(time.Until(refreshAt), 0)
+}
+
+// retryBackoff returns retryInterval doubled for each consecutive failure after the
+// first, capped at maxRefreshBackoff; callers must hold the lock
+func (o *OAuthClient) retryBackoff() time.Duration {
+	delay := o.retryInterval
+	for i := 1; i < o.failStreak && delay < maxRefreshBackoff; i++ {
+		delay *= 2
+	}
+	return max(min(delay, maxRefreshBackoff), o.retryInterval)
+}
+
+// Invalidate discards the cached token if it is still the given one, forcing the
+// next GetAccessToken call to fetch a new token. Comparing against the rejected
+// token avoids throwing away a newer token that another request already fetched.
+func (o *OAuthClient) Invalidate(token string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.accessToken != token {
+		return
+	}
+	o.accessToken = ""
+	o.expiresAt = time.Time{}
+	o.invalidations++
+}
+
+// Stats returns a snapshot of refresh counters and the last refresh error
+func (o *OAuthClient) Stats() OAuthStats {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	stats := OAuthStats{
+		Refreshes:     o.refreshes,
+		Failures:      o.failures,
+		Invalidations: o.invalidations,
+		Rotations:     o.rotations,
+		LastRefresh:   o.lastRefresh,
+		ExpiresAt:     o.expiresAt,
+	}
+	if o.lastErr != nil {
+		stats.LastError = o.lastErr.Error()
+	}
+	return stats
 }
 
 // requestNewToken requests a new access token using Client Credentials flow
-func (o *OAuthClient) requestNewToken(ctx context.Context) (string, error) {
+func (o *OAuthClient) requestNewToken(ctx context.Context, creds ClientCredentials) (*OAuthTokenResponse, error) {
 	// Prepare form-encoded token request (OAuth 2.0 standard)
 	data := url.Values{}
 	data.Set("grant_type", "client_credentials")
-	data.Set("client_id", o.clientID)
-	data.Set("client_secret", o.clientSecret)
 	if o.scope != "" {
 		data.Set("scope", o.scope)
 	}
 
+	// Add client credentials according to the configured auth method
+	authHeader, err := o.clientAuthentication(data, creds)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create HTTP request with form data
 	httpReq, err := http.NewRequestWithContext(ctx, "POST", o.tokenEndpoint, strings.NewReader(data.Encode()))
 	if err != nil {
-		return "", fmt.Errorf("failed to create token request: %w", err)
+		return nil, fmt.Errorf("failed to create token request: %w", err)
 	}
 
 	// Set headers for OAuth token request (form-encoded)
 	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	httpReq.Header.Set("Accept", "application/json")
+	if authHeader != "" {
+		httpReq.Header.Set("Authorization", authHeader)
+	}
 
 	zerologlog.Debug().
 		Str("token_endpoint", o.tokenEndpoint).
-		Str("client_id", sanitizeForLogging(o.clientID)).
+		Str("client_id", sanitizeForLogging(creds.ClientID)).
+		Str("auth_method", string(o.authMethod)).
 		Str("scope", o.scope).
 		Msg("Requesting OAuth access token")
 
@@ -215,14 +605,14 @@ func (o *OAuthClient) requestNewToken(ctx context.Context) (string, error) {
 		zerologlog.Error().Err(err).
 			Str("token_endpoint", o.tokenEndpoint).
 			Msg("OAuth token request failed")
-		return "", fmt.Errorf("OAuth token request failed: %w", err)
+		return nil, fmt.Errorf("OAuth token request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read token response: %w", err)
+		return nil, fmt.Errorf("failed to read token response: %w", err)
 	}
 
 	// Parse token response
@@ -231,7 +621,7 @@ func (o *OAuthClient) requestNewToken(ctx context.Context) (string, error) {
 		zerologlog.Error().Err(err).
 			Str("body", string(body)).
 			Msg("Failed to parse OAuth token response")
-		return "", fmt.Errorf("failed to parse token response: %w", err)
+		return nil, fmt.Errorf("failed to parse token response: %w", err)
 	}
 
 	// Check for OAuth errors
@@ -241,7 +631,7 @@ func (o *OAuthClient) requestNewToken(ctx context.Context) (string, error) {
 			Str("error_description", tokenResp.ErrorDesc).
 			Int("status_code", resp.StatusCode).
 			Msg("OAuth token request error")
-		return "", fmt.Errorf("OAuth error: %s - %s", tokenResp.Error, tokenResp.ErrorDesc)
+		return nil, fmt.Errorf("OAuth error: %s - %s", tokenResp.Error, tokenResp.ErrorDesc)
 	}
 
 	// Check HTTP status
@@ -250,49 +640,45 @@ func (o *OAuthClient) requestNewToken(ctx context.Context) (string, error) {
 			Int("status_code", resp.StatusCode).
 			Str("body", string(body)).
 			Msg("OAuth token endpoint returned non-200 status")
-		return "", fmt.Errorf("OAuth token endpoint returned status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("OAuth token endpoint returned status %d: %s", resp.StatusCode, string(body))
 	}
 
 	// Validate token response
 	if tokenResp.AccessToken == "" {
-		return "", fmt.Errorf("received empty access token")
-	}
-
-	// Update stored token with expiration (default to 1 hour if not provided)
-	expiresIn := tokenResp.ExpiresIn
-	if expiresIn <= 0 {
-		expiresIn = 3600 // Default to 1 hour
+		return nil, fmt.Errorf("received empty access token")
 	}
 
-	o.accessToken = tokenResp.AccessToken
-	o.expiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
-
-	zerologlog.Debug().
-		Str("token_type", tokenResp.TokenType).
-		Int("expires_in", tokenResp.ExpiresIn).
-		Time("expires_at", o.expiresAt).
-		Msg("Successfully obtained OAuth access token")
-
-	return o.accessToken, nil
-}
-
-// promptSystem returns the system prompt for the OpenAI model
-func promptSystem() string {
-	return "You are a professional songwriter who creates song lyrics based on the provided specifications. Follow the user's requirements for genre, emotion, and keywords while maintaining good lyrical structure and flow."
+	return &tokenResp, nil
 }
 
 // LyricsRequest represents the input for lyrics generation
 type LyricsRequest struct {
-	Keywords  []string      `json:"keywords" binding:"required,min=1,max=10"`
-	Genre     string        `json:"genre" binding:"required"`
-	Emotion   string        `json:"emotion" binding:"required"`
-	Language  string        `json:"language" binding:"required"`
-	Structure SongStructure `json:"structure"`
+	Keywords []string      `json:"keywords" binding:"required,min=1,max=10"`
+	Genre    string        `json:"genre" binding:"required_without=Genres"`
+	Genres   []GenreWeight `json:"genres,omitempty" binding:"omitempty,dive"`
+	Emotion  string        `json:"emotion" binding:"required"`
+	// EmotionArc optionally varies the emotion across sections; Emotion applies to
+	// sections it does not cover
+	EmotionArc []SectionEmotion `json:"emotion_arc,omitempty" binding:"omitempty,max=8,dive"`
+	Language   string           `json:"language" binding:"required_without=Languages"`
+	Structure  SongStructure    `json:"structure"`
+	// Length is the target length ("short", "medium" or "long"); WordRange sets it in
+	// words instead. Medium is used when neither is given.
+	Length    string     `json:"length,omitempty" binding:"omitempty,oneof=short medium long"`
+	WordRange *WordRange `json:"word_range,omitempty"`
+	// IncludeChords adds a suggested key, tempo and chord progressions to the response
+	IncludeChords bool `json:"include_chords,omitempty"`
+	// Romanize adds a romanized line (Hepburn romaji or Revised Romanization of
+	// Korean) alongside each Japanese or Korean lyric line
+	Romanize bool `json:"romanize,omitempty"`
+	// Languages mixes languages in one song, by section or by share of the lyrics,
+	// instead of Language
+	Languages []LanguageMix `json:"languages,omitempty" binding:"omitempty,dive"`
 }
 
 // SongStructure defines the structure of the song
 type SongStructure struct {
-	Verses int  `json:"verses" binding:"min=1,max=4"`
+	Verses int  `json:"verses" binding:"omitempty,min=1,max=4"`
 	Chorus bool `json:"chorus"`
 	Bridge bool `json:"bridge"`
 }
@@ -302,12 +688,33 @@ type LyricsResponse struct {
 	ID       string          `json:"id"`
 	Lyrics   GeneratedLyrics `json:"lyrics"`
 	Metadata LyricsMetadata  `json:"metadata"`
+	// Quality rates the craft of the lyrics with a composite score and its sub-scores
+	Quality *QualityScore `json:"quality,omitempty"`
+	// Chords are the suggested key, tempo and progressions, when include_chords is set
+	Chords *ChordSuggestions `json:"chords,omitempty"`
+	// Translation compares a translated song line by line with its source
+	Translation *TranslationReport `json:"translation,omitempty"`
+	// Warnings report problems that did not fail the request, e.g. truncated lyrics
+	Warnings []Warning `json:"warnings,omitempty"`
 }
 
 // GeneratedLyrics contains the actual song content
 type GeneratedLyrics struct {
 	Title     string            `json:"title"`
 	Structure map[string]string `json:"structure"`
+	// Sections lists every section in song order, including repeated choruses
+	Sections []LyricsSection `json:"sections"`
+}
+
+// LyricsSection is one section of a song as it appears in the lyrics
+type LyricsSection struct {
+	Name  string   `json:"name"`
+	Lines []string `json:"lines"`
+	// Language is the language detected in the section of a mixed-language song
+	Language string `json:"language,omitempty"`
+	// Romanized holds the romanization of each line when romanize was requested,
+	// empty for lines that need none
+	Romanized []string `json:"romanized,omitempty"`
 }
 
 // LyricsMetadata contains information about the generated lyrics
@@ -318,6 +725,41 @@ type LyricsMetadata struct {
 	KeywordsUsed []string  `json:"keywords_used"`
 	CreatedAt    time.Time `json:"created_at"`
 	WordCount    int       `json:"word_count"`
+
+	// Genres lists the blended genres, dominant first, when a blend was requested
+	Genres []GenreWeight `json:"genres,omitempty"`
+	// Languages lists the mixed languages when a mix was requested
+	Languages []LanguageMix `json:"languages,omitempty"`
+	// SectionLanguages is the language identified in each section with its confidence;
+	// LanguageRetries counts regenerations after sections came back in the wrong language
+	SectionLanguages []SectionLanguage `json:"section_languages,omitempty"`
+	LanguageRetries  int               `json:"language_retries,omitempty"`
+	// NearestMatch is the earlier song or corpus entry most similar to the lyrics;
+	// DuplicateRetries counts regenerations after the lyrics were a near-duplicate
+	NearestMatch     *SimilarMatch `json:"nearest_match,omitempty"`
+	DuplicateRetries int           `json:"duplicate_retries,omitempty"`
+	// SectionEmotions shows the emotion given to each section when an arc was requested
+	SectionEmotions []SectionEmotion `json:"section_emotions,omitempty"`
+	// PromptVersion and PromptOverride identify the templates that produced the lyrics
+	PromptVersion  string `json:"prompt_version"`
+	PromptOverride string `json:"prompt_override,omitempty"`
+	// Exemplars lists the IDs of the few-shot exemplars included in the prompt
+	Exemplars []string `json:"exemplars,omitempty"`
+	// TargetWords is the length the lyrics were asked for and MaxTokens the completion
+	// limit sized for it; Continuations counts follow-up calls after truncation
+	TargetWords   *WordRange `json:"target_words,omitempty"`
+	MaxTokens     int        `json:"max_tokens"`
+	FinishReason  string     `json:"finish_reason"`
+	Continuations int        `json:"continuations,omitempty"`
+	// Experiment and ExperimentArm are set when the request took part in an A/B experiment
+	Experiment    string `json:"experiment,omitempty"`
+	ExperimentArm string `json:"experiment_arm,omitempty"`
+	// ComplianceScore is the share of keywords and requested sections present, from 0 to 1
+	ComplianceScore float64 `json:"compliance_score"`
+	// TranslatedFrom is the ID of the song a translation was made from, and
+	// Translations lists the translations made of this song
+	TranslatedFrom string            `json:"translated_from,omitempty"`
+	Translations   []TranslationLink `json:"translations,omitempty"`
 }
 
 // HealthResponse represents the health check response
@@ -334,7 +776,7 @@ type ErrorResponse struct {
 }
 
 // NewLyricsService creates a new lyrics service with OpenAI SDK and OAuth transport
-func NewLyricsService(gatewayURL, model string, oauthClient *OAuthClient) *LyricsService {
+func NewLyricsService(gatewayURL, model string, oauthClient *OAuthClient, opts ...LyricsServiceOption) *LyricsService {
 	// Create OAuth transport
 	oauthTransport := NewOAuthTransport(oauthClient)
 
@@ -351,119 +793,104 @@ func NewLyricsService(gatewayURL, model string, oauthClient *OAuthClient) *Lyric
 		option.WithAPIKey(""), // Disable default API key since we use OAuth
 	)
 
-	return &LyricsService{
+	service := &LyricsService{
 		openaiClient: &openaiClient,
-		model:        model,
-	}
-}
-
-// ValidGenres contains the list of supported genres
-var ValidGenres = map[string]bool{
-	"pop":        true,
-	"rock":       true,
-	"metal":      true,
-	"country":    true,
-	"hip-hop":    true,
-	"r&b":        true,
-	"jazz":       true,
-	"folk":       true,
-	"electronic": true,
-	"classical":  true,
-	"reggae":     true,
-	"blues":      true,
-	"indie":      true,
-}
-
-// ValidEmotions contains the list of supported emotions
-var ValidEmotions = map[string]bool{
-	"happy":         true,
-	"sad":           true,
-	"romantic":      true,
-	"energetic":     true,
-	"melancholic":   true,
-	"hopeful":       true,
-	"nostalgic":     true,
-	"peaceful":      true,
-	"excited":       true,
-	"contemplative": true,
-}
-
-// ValidLanguages contains the list of supported languages
-var ValidLanguages = map[string]bool{
-	"english":    true,
-	"spanish":    true,
-	"french":     true,
-	"german":     true,
-	"italian":    true,
-	"portuguese": true,
-	"japanese":   true,
-	"korean":     true,
+		store:        NewLyricsStore(defaultStoreCapacity),
+		experiments:  NewExperimentTracker(),
+		exemplars:    DefaultExemplars(),
+	}
+	for _, opt := range opts {
+		opt(service)
+	}
+	settings := service.Settings()
+	settings.Model = model
+	service.ApplySettings(settings)
+	return service
 }
 
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit")
+	flag.Parse()
+
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
 		zerologlog.Info().Msg("No .env file found")
 	}
 
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	if os.Getenv("GIN_MODE") == "release" {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	} else {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	}
-
-	// Get AI Gateway OAuth configuration
-	consumerKey := os.Getenv("AI_GATEWAY_CONSUMER_KEY")
-	if consumerKey == "" {
-		zerologlog.Fatal().Msg("AI_GATEWAY_CONSUMER_KEY environment variable is required")
-	}
-
-	consumerSecret := os.Getenv("AI_GATEWAY_CONSUMER_SECRET")
-	if consumerSecret == "" {
-		zerologlog.Fatal().Msg("AI_GATEWAY_CONSUMER_SECRET environment variable is required")
-	}
-
-	tokenEndpoint := os.Getenv("AI_GATEWAY_TOKEN_ENDPOINT")
-	if tokenEndpoint == "" {
-		zerologlog.Fatal().Msg("AI_GATEWAY_TOKEN_ENDPOINT environment variable is required")
-	}
-
-	gatewayURL := os.Getenv("AI_GATEWAY_ENDPOINT")
-	if gatewayURL == "" {
-		zerologlog.Fatal().Msg("AI_GATEWAY_ENDPOINT environment variable is required")
+	// Load configuration from the config file and environment overrides
+	cfg, err := LoadConfig(*configPath)
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration is invalid:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration is valid")
+		return
 	}
-
-	// Get optional OAuth scope (default to empty)
-	oauthScope := os.Getenv("AI_GATEWAY_SCOPE")
-
-	// Get model version (default: gpt-3.5-turbo)
-	openaiModel := os.Getenv("OPENAI_MODEL")
-	if openaiModel == "" {
-		openaiModel = "gpt-3.5-turbo"
+	if err != nil {
+		zerologlog.Fatal().Err(err).Msg("Invalid configuration")
 	}
 
-	// Get port from environment or default to 8080
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	zerolog.SetGlobalLevel(cfg.LogLevel())
+	gin.SetMode(cfg.Server.Mode)
+
+	// Client authentication at the token endpoint (validated by LoadConfig)
+	authMethod, _ := ParseClientAuthMethod(cfg.OAuth.AuthMethod)
+	oauthOptions := []OAuthClientOption{WithRefreshFraction(cfg.OAuth.RefreshFraction)}
+	switch authMethod {
+	case ClientAuthSecretBasic:
+		oauthOptions = append(oauthOptions, WithClientSecretBasic())
+	case ClientAuthPrivateKeyJWT:
+		signingKey, err := LoadPrivateKeyPEM(cfg.OAuth.PrivateKeyFile)
+		if err != nil {
+			zerologlog.Fatal().Err(err).Str("file", cfg.OAuth.PrivateKeyFile).Msg("Failed to load OAuth signing key")
+		}
+		oauthOptions = append(oauthOptions, WithPrivateKeyJWT(signingKey, cfg.OAuth.PrivateKeyID))
 	}
 
 	// Initialize OAuth client
-	oauthClient := NewOAuthClient(tokenEndpoint, consumerKey, consumerSecret, oauthScope)
+	oauthClient := NewOAuthClient(cfg.OAuth.TokenEndpoint, cfg.OAuth.ClientID, cfg.OAuth.ClientSecret, cfg.OAuth.Scope, oauthOptions...)
+
+	// Renew tokens in the background for the lifetime of the process
+	renewCtx, stopRenewal := context.WithCancel(context.Background())
+	defer stopRenewal()
+	oauthClient.Start(renewCtx)
+
+	// Watch mounted credential files and rotate them into the live client
+	credentialWatcher := NewCredentialWatcher(oauthClient, cfg.OAuth.ClientIDFile, cfg.OAuth.ClientSecretFile,
+		cfg.OAuth.PrivateKeyFile, time.Duration(cfg.OAuth.SecretPollInterval))
+	if credentialWatcher.Enabled() {
+		go credentialWatcher.Run(renewCtx)
+	}
 
+	gatewayURL := cfg.Providers.Gateway.Endpoint
 	zerologlog.Info().
-		Str("token_endpoint", tokenEndpoint).
+		Str("token_endpoint", cfg.OAuth.TokenEndpoint).
 		Str("gateway_url", gatewayURL).
-		Str("consumer_key", sanitizeForLogging(consumerKey)).
-		Str("model", openaiModel).
+		Str("consumer_key", sanitizeForLogging(cfg.OAuth.ClientID)).
+		Str("auth_method", string(authMethod)).
+		Str("model", cfg.Providers.Gateway.Model).
 		Msg("Initializing OpenAI SDK with AI Gateway and OAuth Client Credentials")
 
 	// Initialize services with OpenAI SDK and AI Gateway
-	lyricsService := NewLyricsService(gatewayURL, openaiModel, oauthClient)
+	lyricsService := NewLyricsService(gatewayURL, cfg.Providers.Gateway.Model, oauthClient,
+		WithLyricsStore(NewLyricsStore(cfg.Storage.MaxSongs)), WithExemplarLibrary(cfg.exemplars))
+	lyricsService.ApplySettings(cfg.ServiceSettings())
+
+	// Configure tracing (OTEL_TRACES_EXPORTER=otlp|stdout|none)
+	shutdownTracing, err := InitTracing(context.Background(), buildVersion())
+	if err != nil {
+		zerologlog.Fatal().Err(err).Msg("Failed to initialize tracing")
+	}
+
+	// Expose OAuth refresh statistics alongside the request metrics
+	RegisterOAuthMetrics(oauthClient)
 
 	// Setup Gin router
 	router := gin.Default()
+	router.Use(metricsMiddleware(), tracingMiddleware())
 
 	// Middleware for CORS
 	router.Use(func(c *gin.Context) {
@@ -479,36 +906,69 @@ func main() {
 		c.Next()
 	})
 
-	// Health check endpoint
+	// Health check endpoints: /livez for liveness, /readyz checks dependencies
 	router.GET("/health", healthCheck)
+	router.GET("/livez", livenessCheck)
+	router.GET("/readyz", readinessCheck(10*time.Second,
+		oauthReadinessCheck(oauthClient),
+		gatewayReadinessCheck(gatewayURL, 30*time.Second),
+	))
+
+	// Prometheus metrics endpoint
+	router.GET("/metrics", metricsHandler())
 
 	// API routes
 	router.POST("/generate", generateLyrics(lyricsService))
 
+	// Catalog discovery
+	router.GET("/genres", catalogHandler(lyricsService, func(c *Catalog) *CatalogSet { return c.Genres }))
+	router.GET("/emotions", catalogHandler(lyricsService, func(c *Catalog) *CatalogSet { return c.Emotions }))
+	router.GET("/languages", catalogHandler(lyricsService, func(c *Catalog) *CatalogSet { return c.Languages }))
+
+	// Feedback on generated songs
+	router.POST("/lyrics/:id/rating", rateLyrics(lyricsService))
+	router.GET("/lyrics/:id/export", exportLyrics(lyricsService))
+	router.GET("/lyrics/:id/chords", getChords(lyricsService))
+	router.POST("/lyrics/:id/translate", translateLyrics(lyricsService))
+
+	// Admin API, protected by admin.token
+	admin := router.Group("/admin", adminAuth(lyricsService))
+	admin.GET("/experiments", listExperiments(lyricsService))
+	admin.GET("/exemplars", listExemplars(lyricsService))
+	admin.POST("/exemplars", createExemplar(lyricsService))
+	admin.GET("/exemplars/:id", getExemplar(lyricsService))
+	admin.PUT("/exemplars/:id", updateExemplar(lyricsService))
+	admin.DELETE("/exemplars/:id", deleteExemplar(lyricsService))
+
 	// Create HTTP server
 	srv := &http.Server{
-		Addr:    ":" + port,
+		Addr:    ":" + cfg.Server.Port,
 		Handler: router,
 	}
 
 	// Start server in a goroutine
 	go func() {
-		zerologlog.Info().Str("port", port).Msg("Starting server")
+		zerologlog.Info().Str("port", cfg.Server.Port).Msg("Starting server")
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			zerologlog.Fatal().Err(err).Msg("Server failed to start")
 		}
 	}()
 
-	// Set up signal handling for graceful shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	// Set up signal handling for graceful shutdown and SIGHUP config reloads
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Wait for interrupt signal
-	<-quit
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		cfg = reloadConfig(*configPath, cfg, lyricsService)
+	}
 	zerologlog.Info().Msg("Received shutdown signal, gracefully shutting down server...")
 
 	// Create a context with timeout for shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
 	defer cancel()
 
 	// Attempt graceful shutdown
@@ -517,6 +977,11 @@ func main() {
 		return
 	}
 
+	// Flush pending spans
+	if err := shutdownTracing(ctx); err != nil {
+		zerologlog.Error().Err(err).Msg("Failed to flush traces")
+	}
+
 	zerologlog.Info().Msg("Server exited gracefully")
 }
 
@@ -525,7 +990,7 @@ func healthCheck(c *gin.Context) {
 	response := HealthResponse{
 		Status:    "healthy",
 		Timestamp: time.Now(),
-		Version:   "1.0.0",
+		Version:   buildVersion(),
 	}
 	c.JSON(http.StatusOK, response)
 }
@@ -537,76 +1002,83 @@ func generateLyrics(service *LyricsService) gin.HandlerFunc {
 
 		// Bind and validate request
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Error:   "invalid_request",
-				Message: err.Error(),
-			})
+			respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
 			return
 		}
 
-		// Validate genre
-		if !ValidGenres[strings.ToLower(req.Genre)] {
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Error:   "invalid_genre",
-				Message: "Unsupported genre. Supported genres: " + getValidOptions(ValidGenres),
-			})
+		settings := service.Settings()
+
+		// Validate genre, emotion and language against the catalog, resolving aliases
+		// to their canonical IDs
+		blend, err := resolveGenres(settings.Catalog.Genres, req)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_genre", errorMessage(err))
 			return
 		}
+		// The dominant genre labels metrics and metadata; blends are kept in Genres
+		req.Genre = blend[0].Genre
+		req.Genres = nil
+		if len(blend) > 1 {
+			req.Genres = blend
+		}
 
-		// Validate emotion
-		if !ValidEmotions[strings.ToLower(req.Emotion)] {
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Error:   "invalid_emotion",
-				Message: "Unsupported emotion. Supported emotions: " + getValidOptions(ValidEmotions),
-			})
+		emotion, ok := settings.Catalog.Emotions.Lookup(req.Emotion)
+		if !ok {
+			respondError(c, http.StatusBadRequest, "invalid_emotion",
+				"Unsupported emotion. Supported emotions: "+strings.Join(settings.Catalog.Emotions.IDs(), ", "))
 			return
 		}
-
-		// Validate language
-		if !ValidLanguages[strings.ToLower(req.Language)] {
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Error:   "invalid_language",
-				Message: "Unsupported language. Supported languages: " + getValidOptions(ValidLanguages),
-			})
+		req.Emotion = emotion.ID
+
+		// Apply the local safety policy before spending a gateway call
+		if keyword, blocked := settings.blockedKeyword(req.Keywords); blocked {
+			zerologlog.Warn().Str("keyword", keyword).Msg("Request blocked by local safety policy")
+			guardrailBlocksTotal.WithLabelValues("local_policy").Inc()
+			respondError(c, http.StatusBadRequest, "content_blocked",
+				"Your request contains content that violates our content safety policies. Please modify your keywords and try again with appropriate content.")
 			return
 		}
 
 		// Set default structure if not provided
 		if req.Structure.Verses == 0 {
-			req.Structure.Verses = 2
+			req.Structure.Verses = settings.Generation.DefaultVerses
 		}
 		if !req.Structure.Chorus {
 			req.Structure.Chorus = true
 		}
 
+		// Expand the emotion arc to one emotion per section of the final structure
+		if len(req.EmotionArc) > 0 {
+			arc, err := resolveEmotionArc(settings.Catalog.Emotions, req)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, "invalid_emotion_arc", errorMessage(err))
+				return
+			}
+			req.EmotionArc = arc
+		}
+
+		// Validate the language or language mix; a mix's sections need the final structure
+		language, mix, err := resolveLanguages(settings.Catalog.Languages, req)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_language", errorMessage(err))
+			return
+		}
+		req.Language, req.Languages = language, mix
+
+		// Size the song for the requested length
+		wordRange, err := resolveWordRange(req)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_length", errorMessage(err))
+			return
+		}
+		req.WordRange = &wordRange
+
 		// Generate lyrics
-		response, err := service.GenerateLyrics(c.Request.Context(), req)
+		ctx := withAPIKey(c.Request.Context(), c.GetHeader(apiKeyHeader))
+		response, err := service.generate(ctx, settings, req)
 		if err != nil {
 			zerologlog.Error().Err(err).Msg("Error generating lyrics")
-
-			// Provide specific error messages based on error type
-			switch err.Error() {
-			case "content_safety_violation":
-				c.JSON(http.StatusBadRequest, ErrorResponse{
-					Error:   "content_blocked",
-					Message: "Your request contains content that violates our content safety policies. Please modify your keywords and try again with appropriate content.",
-				})
-			case "content_filtered":
-				c.JSON(http.StatusBadRequest, ErrorResponse{
-					Error:   "content_filtered",
-					Message: "Your request was filtered for safety reasons. Please try different keywords or themes that are more appropriate.",
-				})
-			case "gateway_service_unavailable":
-				c.JSON(http.StatusServiceUnavailable, ErrorResponse{
-					Error:   "service_unavailable",
-					Message: "The AI service is temporarily unavailable. Please try again in a few moments.",
-				})
-			default:
-				c.JSON(http.StatusInternalServerError, ErrorResponse{
-					Error:   "generation_failed",
-					Message: "Failed to generate lyrics. Please try again.",
-				})
-			}
+			respondGenerationError(c, err, "Failed to generate lyrics. Please try again.")
 			return
 		}
 
@@ -614,85 +1086,251 @@ func generateLyrics(service *LyricsService) gin.HandlerFunc {
 	}
 }
 
+// respondGenerationError reports a failed model call with a message specific to the
+// error type, or the given message for unexpected failures
+func respondGenerationError(c *gin.Context, err error, failure string) {
+	switch err.Error() {
+	case "content_safety_violation":
+		respondError(c, http.StatusBadRequest, "content_blocked",
+			"Your request contains content that violates our content safety policies. Please modify your keywords and try again with appropriate content.")
+	case "content_filtered":
+		respondError(c, http.StatusBadRequest, "content_filtered",
+			"Your request was filtered for safety reasons. Please try different keywords or themes that are more appropriate.")
+	case "gateway_service_unavailable":
+		respondError(c, http.StatusServiceUnavailable, "service_unavailable",
+			"The AI service is temporarily unavailable. Please try again in a few moments.")
+	default:
+		respondError(c, http.StatusInternalServerError, "generation_failed", failure)
+	}
+}
+
 // GenerateLyrics generates song lyrics using OpenAI SDK with OAuth transport
 func (s *LyricsService) GenerateLyrics(ctx context.Context, req LyricsRequest) (*LyricsResponse, error) {
+	return s.generate(ctx, s.Settings(), req)
+}
+
+// generate generates song lyrics with the given settings, so that a request validated
+// against one snapshot is not generated with another after a reload
+func (s *LyricsService) generate(ctx context.Context, settings *ServiceSettings, req LyricsRequest) (resp *LyricsResponse, err error) {
+	// Record end-to-end latency per genre, labelled with the error kind on failure
+	start := time.Now()
+	defer func() {
+		outcome := "success"
+		if err != nil {
+			outcome = err.Error()
+		}
+		generationDuration.WithLabelValues(strings.ToLower(req.Genre), outcome).Observe(time.Since(start).Seconds())
+	}()
+
+	// Annotate the request span so slow or failed generations can be filtered by input
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attrModel.String(settings.Model),
+		attrGenre.String(strings.ToLower(req.Genre)),
+		attrEmotion.String(strings.ToLower(req.Emotion)),
+		attrLanguage.String(strings.ToLower(req.Language)),
+	)
+
+	// Apply the A/B experiment arm, if the request takes part in one
+	promptVersion, temperature := settings.PromptVersion, settings.Generation.Temperature
+	assignment := settings.assignExperiment(apiKeyFromContext(ctx), req)
+	if assignment != nil {
+		promptVersion, temperature = assignment.PromptVersion, assignment.Temperature
+		span.SetAttributes(attrExperiment.String(assignment.Experiment), attrExperimentArm.String(assignment.Arm))
+	}
+
 	// Create prompt
-	prompt := s.buildPrompt(req)
+	_, promptSpan := tracer().Start(ctx, "buildPrompt")
+	prompt, err := settings.buildPrompt(req, promptVersion)
+	if err != nil {
+		recordSpanError(promptSpan, err)
+		promptSpan.End()
+		zerologlog.Error().Err(err).Msg("Failed to render prompt")
+		return nil, fmt.Errorf("prompt_render_failed")
+	}
+	exemplars := s.exemplars.Select(settings.Catalog, req, settings.ExemplarTokenBudget, settings.MaxExemplars)
+	promptSpan.SetAttributes(attrPromptVersion.String(prompt.Version), attrExemplars.Int(len(exemplars)))
+	promptSpan.End()
+
+	messages := []openai.ChatCompletionMessageParamUnion{openai.SystemMessage(prompt.System)}
+	if len(exemplars) > 0 {
+		messages = append(messages, openai.SystemMessage(fewShotMessage(exemplars)))
+	}
+	messages = append(messages, openai.UserMessage(prompt.User))
 
 	zerologlog.Debug().
-		Str("model", s.model).
-		Str("prompt", sanitizeForLogging(prompt)).
+		Str("model", settings.Model).
+		Str("prompt_version", prompt.Version).
+		Str("prompt", sanitizeForLogging(prompt.User)).
 		Interface("request", req).
 		Msg("Sending request to OpenAI via AI Gateway")
 
-	// Use OpenAI SDK with automatic OAuth token injection via transport
-	completion, err := s.openaiClient.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Model: openai.ChatModelGPT3_5Turbo, // Default model, can be overridden via env
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.SystemMessage(promptSystem()),
-			openai.UserMessage(prompt),
-		},
-		MaxTokens:   openai.Int(1000),
-		Temperature: openai.Float(0.8),
-	})
-
+	maxTokens := settings.estimateMaxTokens(req)
+	completion, err := s.chatCompletion(ctx, settings, req, messages, maxTokens, temperature)
 	if err != nil {
-		// Check if this is a content safety violation
-		if strings.Contains(err.Error(), "446") || strings.Contains(err.Error(), "GUARDRAIL_INTERVENED") ||
-			strings.Contains(err.Error(), "AZURE_CONTENT_SAFETY") {
-			zerologlog.Warn().Err(err).
-				Str("model", s.model).
-				Interface("request", req).
-				Msg("Content safety guardrail blocked request")
-			return nil, fmt.Errorf("content_safety_violation")
+		if outcome := guardrailOutcome(err); outcome != "" {
+			span.SetAttributes(attrGuardrailOutcome.String(outcome))
 		}
+		return nil, err
+	}
+	span.SetAttributes(attrGuardrailOutcome.String("passed"))
 
-		// Check for generic gateway errors (502, 404, etc.)
-		if strings.Contains(err.Error(), "502") || strings.Contains(err.Error(), "Bad Gateway") {
-			zerologlog.Error().Err(err).
-				Str("model", s.model).
-				Msg("AI Gateway service unavailable")
-			return nil, fmt.Errorf("gateway_service_unavailable")
+	// Finish lyrics that were cut off at the token limit, or warn that they are partial
+	generatedText := completion.Choices[0].Message.Content
+	finishReason := completion.Choices[0].FinishReason
+	truncated := finishReason == "length"
+	continuations := 0
+	for finishReason == "length" && settings.Generation.Truncation == truncationContinue &&
+		continuations < settings.Generation.MaxContinuations {
+		followUp := append(slices.Clip(messages), openai.AssistantMessage(generatedText), openai.UserMessage(continuationPrompt))
+		continuation, err := s.chatCompletion(ctx, settings, req, followUp, maxTokens, temperature)
+		if err != nil {
+			zerologlog.Warn().Err(err).Msg("Failed to continue truncated lyrics")
+			break
 		}
+		continuations++
+		generatedText += continuation.Choices[0].Message.Content
+		finishReason = continuation.Choices[0].FinishReason
+	}
 
-		if strings.Contains(err.Error(), "The requested resource is not available") {
-			zerologlog.Warn().Err(err).
-				Str("model", s.model).
-				Interface("request", req).
-				Msg("Request blocked by content filtering")
-			return nil, fmt.Errorf("content_filtered")
+	_, parseSpan := tracer().Start(ctx, "parseLyrics")
+	lyrics := s.parseLyrics(generatedText, req)
+	parseSpan.SetAttributes(attribute.Int("songlyrics.sections", len(lyrics.Structure)))
+	parseSpan.End()
+
+	// Identify the language of each section, and regenerate once when some came back in
+	// another language than requested
+	candidates := settings.Catalog.Languages.IDs()
+	sectionLanguages, mismatched := checkSectionLanguages(lyrics.Sections, req, candidates)
+	languageRetries := 0
+	if len(mismatched) > 0 && settings.Generation.LanguageMismatch == languageMismatchRetry {
+		followUp := append(slices.Clip(messages), openai.AssistantMessage(generatedText), openai.UserMessage(languageRetryPrompt(mismatched)))
+		retry, err := s.chatCompletion(ctx, settings, req, followUp, maxTokens, temperature)
+		if err != nil {
+			zerologlog.Warn().Err(err).Msg("Failed to retry lyrics in the wrong language")
+		} else {
+			languageRetries++
+			retryText := retry.Choices[0].Message.Content
+			retryLyrics := s.parseLyrics(retryText, req)
+			retryLanguages, retryMismatched := checkSectionLanguages(retryLyrics.Sections, req, candidates)
+			// Keep the retry only if it is complete and closer to the requested languages
+			if retry.Choices[0].FinishReason != "length" && len(retryLyrics.Sections) >= len(lyrics.Sections) &&
+				len(retryMismatched) < len(mismatched) {
+				generatedText, finishReason, lyrics = retryText, retry.Choices[0].FinishReason, retryLyrics
+				sectionLanguages, mismatched = retryLanguages, retryMismatched
+				truncated, continuations = false, 0
+				if len(mismatched) == 0 {
+					languageMismatchesTotal.WithLabelValues(req.Language, "resolved").Inc()
+				}
+			}
 		}
-
-		zerologlog.Error().Err(err).
-			Str("model", s.model).
-			Msg("OpenAI SDK request failed")
-		return nil, fmt.Errorf("openai_request_failed")
 	}
-
-	// Validate response
-	if len(completion.Choices) == 0 {
-		zerologlog.Error().
-			Str("model", s.model).
-			Msg("OpenAI returned no choices")
-		return nil, fmt.Errorf("no response from OpenAI")
+	span.SetAttributes(attrLanguageRetries.Int(languageRetries))
+
+	// Compare the lyrics with earlier songs and the corpus, and regenerate once when
+	// they are a near-duplicate. This runs on the lyrics kept by the language check,
+	// so the verdict is about the song actually returned.
+	nearest := s.nearestSong(settings, lyrics.Sections)
+	duplicateRetries := 0
+	if settings.isDuplicate(nearest) && settings.Similarity.Action == similarityRegenerate {
+		followUp := append(slices.Clip(messages), openai.AssistantMessage(generatedText), openai.UserMessage(duplicateRetryPrompt))
+		retry, err := s.chatCompletion(ctx, settings, req, followUp, maxTokens, temperature)
+		if err != nil {
+			zerologlog.Warn().Err(err).Msg("Failed to regenerate near-duplicate lyrics")
+		} else {
+			duplicateRetries++
+			retryText := retry.Choices[0].Message.Content
+			retryLyrics := s.parseLyrics(retryText, req)
+			retryNearest, source := s.nearestSong(settings, retryLyrics.Sections), nearest.Source
+			retryLanguages, retryMismatched := checkSectionLanguages(retryLyrics.Sections, req, candidates)
+			// Keep the retry only if it is complete, further from any other song and no
+			// further from the requested languages
+			if retry.Choices[0].FinishReason != "length" && len(retryLyrics.Sections) >= len(lyrics.Sections) &&
+				(retryNearest == nil || retryNearest.Similarity < nearest.Similarity) && len(retryMismatched) <= len(mismatched) {
+				generatedText, finishReason, lyrics, nearest = retryText, retry.Choices[0].FinishReason, retryLyrics, retryNearest
+				sectionLanguages, mismatched = retryLanguages, retryMismatched
+				truncated, continuations = false, 0
+				if !settings.isDuplicate(nearest) {
+					nearDuplicatesTotal.WithLabelValues(source, "resolved").Inc()
+				}
+			}
+		}
+	}
+	span.SetAttributes(attrDuplicateRetries.Int(duplicateRetries))
+
+	// Flag what is still wrong with the lyrics finally kept. A kept retry is complete,
+	// so truncation is only reported for the first completion and its continuations.
+	span.SetAttributes(attrMaxTokens.Int(maxTokens), attrContinuations.Int(continuations))
+	var warnings []Warning
+	if truncated {
+		outcome := "continued"
+		if finishReason == "length" {
+			outcome = "partial"
+			warnings = append(warnings, Warning{
+				Code:    "lyrics_truncated",
+				Message: "The lyrics reached the token limit and may be incomplete. Try a shorter length or fewer sections.",
+			})
+		}
+		truncatedCompletionsTotal.WithLabelValues(settings.Model, outcome).Inc()
+	}
+	if len(mismatched) > 0 {
+		warnings = append(warnings, languageMismatchWarning(mismatched))
+		languageMismatchesTotal.WithLabelValues(req.Language, "flagged").Inc()
+	}
+	if settings.isDuplicate(nearest) {
+		warnings = append(warnings, duplicateWarning(nearest))
+		nearDuplicatesTotal.WithLabelValues(nearest.Source, "flagged").Inc()
 	}
 
-	generatedText := completion.Choices[0].Message.Content
-	lyrics := s.parseLyrics(generatedText, req)
+	if len(req.Languages) > 0 {
+		tagSectionLanguages(lyrics.Sections, req.Languages)
+	}
+	if req.Romanize {
+		if warning := romanizeSections(lyrics.Sections).Warning(); warning != nil {
+			warnings = append(warnings, *warning)
+		}
+	}
 	wordCount := s.countWords(generatedText)
 
 	lyricsResponse := &LyricsResponse{
 		ID:     uuid.New().String(),
 		Lyrics: lyrics,
 		Metadata: LyricsMetadata{
-			Genre:        req.Genre,
-			Emotion:      req.Emotion,
-			Language:     req.Language,
-			KeywordsUsed: req.Keywords,
-			CreatedAt:    time.Now(),
-			WordCount:    wordCount,
+			Genre:            req.Genre,
+			Emotion:          req.Emotion,
+			Language:         req.Language,
+			KeywordsUsed:     req.Keywords,
+			CreatedAt:        time.Now(),
+			WordCount:        wordCount,
+			Genres:           req.Genres,
+			Languages:        req.Languages,
+			SectionEmotions:  req.EmotionArc,
+			PromptVersion:    prompt.Version,
+			PromptOverride:   prompt.Override,
+			Exemplars:        exemplarIDs(exemplars),
+			TargetWords:      req.WordRange,
+			MaxTokens:        maxTokens,
+			FinishReason:     string(finishReason),
+			Continuations:    continuations,
+			SectionLanguages: sectionLanguages,
+			LanguageRetries:  languageRetries,
+			NearestMatch:     nearest,
+			DuplicateRetries: duplicateRetries,
+			ComplianceScore:  complianceScore(req, lyrics),
 		},
+		Warnings: warnings,
 	}
+	lyricsResponse.Quality = scoreQuality(settings.Catalog, *lyricsResponse)
+	qualityScore.WithLabelValues(strings.ToLower(req.Genre)).Observe(lyricsResponse.Quality.Score)
+	if req.IncludeChords {
+		lyricsResponse.Chords = suggestChords(settings.Catalog, req, lyrics.Sections)
+	}
+	if assignment != nil {
+		lyricsResponse.Metadata.Experiment = assignment.Experiment
+		lyricsResponse.Metadata.ExperimentArm = assignment.Arm
+		s.experiments.RecordGeneration(assignment.Experiment, assignment.Arm, lyricsResponse.Metadata.ComplianceScore)
+	}
+	s.store.Save(lyricsResponse, req)
 
 	zerologlog.Debug().
 		Str("response_id", lyricsResponse.ID).
@@ -707,53 +1345,148 @@ func (s *LyricsService) GenerateLyrics(ctx context.Context, req LyricsRequest) (
 	return lyricsResponse, nil
 }
 
-// buildPrompt creates the prompt for OpenAI based on the request
-func (s *LyricsService) buildPrompt(req LyricsRequest) string {
-	keywords := strings.Join(req.Keywords, ", ")
-
-	prompt := fmt.Sprintf(`Write song lyrics in %s with the following specifications:
-
-Genre: %s
-Emotion/Mood: %s
-Keywords to include: %s
-Number of verses: %d
-Include chorus: %t
-Include bridge: %t
-
-Requirements:
-- Creative and engaging lyrics that flow well
-- Natural incorporation of the provided keywords
-- Clear structure with labeled sections
-
-Please format the output with clear section labels like:
-[Title: Song Title Here]
-[Verse 1]
-...
-[Chorus]
-...
-[Verse 2]
-...
-[Bridge] (if requested)
-...
-
-Make sure the lyrics capture the %s emotion and fit the %s genre style.`,
-		req.Language, req.Genre, req.Emotion, keywords,
-		req.Structure.Verses, req.Structure.Chorus, req.Structure.Bridge,
-		req.Emotion, req.Genre,
+// chatCompletion sends one chat completion request through the gateway, recording its
+// latency, token usage and span. Gateway errors are classified for the caller.
+func (s *LyricsService) chatCompletion(ctx context.Context, settings *ServiceSettings, req LyricsRequest,
+	messages []openai.ChatCompletionMessageParamUnion, maxTokens int, temperature float64) (*openai.ChatCompletion, error) {
+	// Use OpenAI SDK with automatic OAuth token injection via transport
+	chatCtx, chatSpan := tracer().Start(ctx, "chat.completion",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrModel.String(settings.Model), attrMaxTokens.Int(maxTokens)),
 	)
+	defer chatSpan.End()
+
+	gatewayStart := time.Now()
+	completion, err := s.openaiClient.Chat.Completions.New(chatCtx, openai.ChatCompletionNewParams{
+		Model:       openai.ChatModel(settings.Model),
+		Messages:    messages,
+		MaxTokens:   openai.Int(int64(maxTokens)),
+		Temperature: openai.Float(temperature),
+	})
 
-	return prompt
+	gatewayOutcome := "success"
+	if err != nil {
+		gatewayOutcome = "error"
+	}
+	gatewayRequestDuration.WithLabelValues(settings.Model, gatewayOutcome).Observe(time.Since(gatewayStart).Seconds())
+
+	if err != nil {
+		genErr := s.classifyGatewayError(err, req, settings.Model)
+		if outcome := guardrailOutcome(genErr); outcome != "" {
+			chatSpan.SetAttributes(attrGuardrailOutcome.String(outcome))
+		}
+		recordSpanError(chatSpan, err)
+		return nil, genErr
+	}
+
+	chatSpan.SetAttributes(
+		attrPromptTokens.Int64(completion.Usage.PromptTokens),
+		attrCompletionTokens.Int64(completion.Usage.CompletionTokens),
+		attrGuardrailOutcome.String("passed"),
+	)
+
+	// Validate response
+	if len(completion.Choices) == 0 {
+		zerologlog.Error().
+			Str("model", settings.Model).
+			Msg("OpenAI returned no choices")
+		err = fmt.Errorf("no response from OpenAI")
+		recordSpanError(chatSpan, err)
+		return nil, err
+	}
+	chatSpan.SetAttributes(attrFinishReason.String(string(completion.Choices[0].FinishReason)))
+
+	genre := strings.ToLower(req.Genre)
+	promptTokensTotal.WithLabelValues(settings.Model, genre).Add(float64(completion.Usage.PromptTokens))
+	completionTokensTotal.WithLabelValues(settings.Model, genre).Add(float64(completion.Usage.CompletionTokens))
+	tokensTotal.WithLabelValues(settings.Model, genre).Add(float64(completion.Usage.TotalTokens))
+	return completion, nil
+}
+
+// classifyGatewayError maps a chat completion error to the generation error kinds
+// reported to clients, logging it and recording guardrail metrics
+func (s *LyricsService) classifyGatewayError(err error, req LyricsRequest, model string) error {
+	// Check if this is a content safety violation
+	if strings.Contains(err.Error(), "446") || strings.Contains(err.Error(), "GUARDRAIL_INTERVENED") ||
+		strings.Contains(err.Error(), "AZURE_CONTENT_SAFETY") {
+		zerologlog.Warn().Err(err).
+			Str("model", model).
+			Interface("request", req).
+			Msg("Content safety guardrail blocked request")
+
+		body := err.Error()
+		var apiErr *openai.Error
+		if errors.As(err, &apiErr) {
+			body = apiErr.RawJSON()
+		}
+		for _, category := range guardrailCategories(body) {
+			guardrailBlocksTotal.WithLabelValues(category).Inc()
+		}
+		return fmt.Errorf("content_safety_violation")
+	}
+
+	// Check for generic gateway errors (502, 404, etc.)
+	if strings.Contains(err.Error(), "502") || strings.Contains(err.Error(), "Bad Gateway") {
+		zerologlog.Error().Err(err).
+			Str("model", model).
+			Msg("AI Gateway service unavailable")
+		return fmt.Errorf("gateway_service_unavailable")
+	}
+
+	if strings.Contains(err.Error(), "The requested resource is not available") {
+		zerologlog.Warn().Err(err).
+			Str("model", model).
+			Interface("request", req).
+			Msg("Request blocked by content filtering")
+		guardrailBlocksTotal.WithLabelValues("content_filter").Inc()
+		return fmt.Errorf("content_filtered")
+	}
+
+	zerologlog.Error().Err(err).
+		Str("model", model).
+		Msg("OpenAI SDK request failed")
+	return fmt.Errorf("openai_request_failed")
+}
+
+// guardrailOutcome describes how the content guardrails treated a failed request
+func guardrailOutcome(err error) string {
+	switch err.Error() {
+	case "content_safety_violation":
+		return "blocked"
+	case "content_filtered":
+		return "filtered"
+	default:
+		return ""
+	}
+}
+
+// buildPrompt renders the prompts for the request with the given prompt version
+func (s *ServiceSettings) buildPrompt(req LyricsRequest, version string) (RenderedPrompt, error) {
+	prompts, ok := s.Prompts.Version(version)
+	if !ok {
+		return RenderedPrompt{}, fmt.Errorf("prompt version %q not loaded", version)
+	}
+	return prompts.Render(s.Catalog, req)
 }
 
 // parseLyrics parses the generated text into structured lyrics
 func (s *LyricsService) parseLyrics(text string, req LyricsRequest) GeneratedLyrics {
 	lines := strings.Split(text, "\n")
 	structure := make(map[string]string)
+	var sections []LyricsSection
 	title := "Untitled Song"
 
 	currentSection := ""
 	currentContent := []string{}
 
+	// Save the section being read, if it has any lines
+	saveSection := func() {
+		if currentSection != "" && len(currentContent) > 0 {
+			structure[currentSection] = strings.Join(currentContent, "\n")
+			sections = append(sections, LyricsSection{Name: normalizeSectionName(currentSection), Lines: currentContent})
+		}
+	}
+
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if line == "" {
@@ -762,15 +1495,13 @@ func (s *LyricsService) parseLyrics(text string, req LyricsRequest) GeneratedLyr
 
 		// Check if this is a section header
 		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
-			// Save previous section
-			if currentSection != "" && len(currentContent) > 0 {
-				structure[currentSection] = strings.Join(currentContent, "\n")
-			}
+			saveSection()
 
 			// Parse new section
-			sectionName := strings.ToLower(strings.Trim(line, "[]"))
+			header := strings.Trim(line, "[]")
+			sectionName := strings.ToLower(header)
 			if strings.HasPrefix(sectionName, "title:") {
-				title = strings.TrimSpace(strings.TrimPrefix(sectionName, "title:"))
+				title = strings.TrimSpace(header[len("title:"):])
 				currentSection = ""
 			} else {
 				currentSection = sectionName
@@ -782,18 +1513,18 @@ func (s *LyricsService) parseLyrics(text string, req LyricsRequest) GeneratedLyr
 	}
 
 	// Save last section
-	if currentSection != "" && len(currentContent) > 0 {
-		structure[currentSection] = strings.Join(currentContent, "\n")
-	}
+	saveSection()
 
 	// If no structured content found, use the whole text
 	if len(structure) == 0 {
 		structure["verse1"] = text
+		sections = []LyricsSection{{Name: "verse 1", Lines: nonEmptyLines(text)}}
 	}
 
 	return GeneratedLyrics{
 		Title:     title,
 		Structure: structure,
+		Sections:  sections,
 	}
 }
 
@@ -802,12 +1533,3 @@ func (s *LyricsService) countWords(text string) int {
 	words := strings.Fields(text)
 	return len(words)
 }
-
-// getValidOptions returns a comma-separated string of valid options
-func getValidOptions(validMap map[string]bool) string {
-	var options []string
-	for key := range validMap {
-		options = append(options, key)
-	}
-	return strings.Join(options, ", ")
-}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -30,7 +36,7 @@ func TestHealthCheck(t *testing.T) {
 	err := json.Unmarshal(w.Body.Bytes(), &response)
 	assert.NoError(t, err)
 	assert.Equal(t, "healthy", response.Status)
-	assert.Equal(t, "1.0.0", response.Version)
+	assert.Equal(t, buildVersion(), response.Version)
 }
 
 func TestValidateGenre(t *testing.T) {
@@ -43,11 +49,12 @@ func TestValidateGenre(t *testing.T) {
 		{"Valid genre - rock", "rock", true},
 		{"Invalid genre", "unknown", false},
 		{"Case insensitive", "POP", true},
+		{"Alias", "hiphop", true},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ValidGenres[strings.ToLower(tt.genre)]
+			_, result := DefaultCatalog().Genres.Lookup(tt.genre)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
@@ -67,7 +74,7 @@ func TestValidateEmotion(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ValidEmotions[strings.ToLower(tt.emotion)]
+			_, result := DefaultCatalog().Emotions.Lookup(tt.emotion)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
@@ -208,3 +215,212 @@ func TestCountWords(t *testing.T) {
 		})
 	}
 }
+
+// newTestTokenServer returns a token endpoint that counts requests and issues
+// tokens with the given lifetime; failing makes it respond with an OAuth error
+func newTestTokenServer(t *testing.T, expiresIn int, delay time.Duration, failing *atomic.Bool) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/json")
+		if failing != nil && failing.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(OAuthTokenResponse{Error: "invalid_client", ErrorDesc: "bad credentials"})
+			return
+		}
+		json.NewEncoder(w).Encode(OAuthTokenResponse{
+			AccessToken: fmt.Sprintf("token-%d", n),
+			TokenType:   "Bearer",
+			ExpiresIn:   expiresIn,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestOAuthClientDeduplicatesColdStart(t *testing.T) {
+	server, calls := newTestTokenServer(t, 3600, 50*time.Millisecond, nil)
+	client := NewOAuthClient(server.URL, "id", "secret", "")
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := client.GetAccessToken(context.Background())
+			assert.NoError(t, err)
+			tokens[i] = token
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	for _, token := range tokens {
+		assert.Equal(t, "token-1", token)
+	}
+	assert.Equal(t, int64(1), client.Stats().Refreshes)
+}
+
+func TestOAuthClientServesCurrentTokenWhenRenewalFails(t *testing.T) {
+	var failing atomic.Bool
+	server, _ := newTestTokenServer(t, 3600, 0, &failing)
+	client := NewOAuthClient(server.URL, "id", "secret", "")
+
+	token, err := client.GetAccessToken(context.Background())
+	assert.NoError(t, err)
+
+	failing.Store(true)
+	_, err = client.refresh(context.Background())
+	assert.Error(t, err)
+
+	current, err := client.GetAccessToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, token, current)
+
+	stats := client.Stats()
+	assert.Equal(t, int64(1), stats.Failures)
+	assert.Contains(t, stats.LastError, "invalid_client")
+}
+
+func TestOAuthClientBackgroundRenewal(t *testing.T) {
+	server, calls := newTestTokenServer(t, 1, 0, nil)
+	client := NewOAuthClient(server.URL, "id", "secret", "", WithRefreshFraction(0.2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.Start(ctx)
+
+	assert.Eventually(t, func() bool { return calls.Load() >= 2 }, 2*time.Second, 20*time.Millisecond)
+	token, err := client.GetAccessToken(context.Background())
+	assert.NoError(t, err)
+	assert.NotEqual(t, "token-1", token)
+}
+
+func TestOAuthClientBacksOffAfterExpiry(t *testing.T) {
+	var failing atomic.Bool
+	server, calls := newTestTokenServer(t, 1, 0, &failing)
+	client := NewOAuthClient(server.URL, "id", "secret", "", WithRefreshRetryInterval(100*time.Millisecond))
+
+	_, err := client.GetAccessToken(context.Background())
+	assert.NoError(t, err)
+	failing.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.Start(ctx)
+
+	// Renewals fail from 0.8s and the token expires at 1s; after that the loop must
+	// keep backing off instead of hammering the token endpoint
+	time.Sleep(2500 * time.Millisecond)
+	assert.LessOrEqual(t, calls.Load(), int32(10))
+	assert.GreaterOrEqual(t, client.Stats().Failures, int64(3))
+
+	client.mutex.Lock()
+	client.failStreak = 4
+	assert.Equal(t, 800*time.Millisecond, client.retryBackoff())
+	client.failStreak = 100
+	assert.Equal(t, maxRefreshBackoff, client.retryBackoff())
+	client.mutex.Unlock()
+}
+
+func TestOAuthTransportRetriesOnceWithNewToken(t *testing.T) {
+	tokenServer, tokenCalls := newTestTokenServer(t, 3600, 0, nil)
+	client := NewOAuthClient(tokenServer.URL, "id", "secret", "")
+
+	var gatewayCalls atomic.Int32
+	var bodies []string
+	var mu sync.Mutex
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gatewayCalls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+
+		// The first token is treated as revoked by the gateway
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	body := io.NopCloser(strings.NewReader(`{"hello":"world"}`))
+	req, _ := http.NewRequest("POST", gateway.URL, body)
+	resp, err := NewOAuthTransport(client).RoundTrip(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	// RoundTrip must not modify the caller's request
+	assert.Equal(t, body, req.Body)
+	assert.Nil(t, req.GetBody)
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), gatewayCalls.Load())
+	assert.Equal(t, int32(2), tokenCalls.Load())
+	assert.Equal(t, []string{`{"hello":"world"}`, `{"hello":"world"}`}, bodies)
+	assert.Equal(t, int64(1), client.Stats().Invalidations)
+}
+
+func TestOAuthTransportDoesNotLoopOnPersistent401(t *testing.T) {
+	tokenServer, _ := newTestTokenServer(t, 3600, 0, nil)
+	client := NewOAuthClient(tokenServer.URL, "id", "secret", "")
+
+	var gatewayCalls atomic.Int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gatewayCalls.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer gateway.Close()
+
+	httpClient := &http.Client{Transport: NewOAuthTransport(client)}
+	resp, err := httpClient.Get(gateway.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, int32(2), gatewayCalls.Load())
+}
+
+// newTestGateway starts a fake AI Gateway that answers chat completions with the
+// given content; the handler records each decoded request body
+func newTestGateway(t *testing.T, content string, requests *[]map[string]interface{}) *httptest.Server {
+	var mu sync.Mutex
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if requests != nil {
+			mu.Lock()
+			*requests = append(*requests, body)
+			mu.Unlock()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      "chatcmpl-test",
+			"object":  "chat.completion",
+			"created": 0,
+			"model":   "gpt-3.5-turbo",
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"message":       map[string]string{"role": "assistant", "content": content},
+				"finish_reason": "stop",
+			}},
+			"usage": map[string]int{"prompt_tokens": 10, "completion_tokens": 20, "total_tokens": 30},
+		})
+	}))
+	t.Cleanup(gateway.Close)
+	return gateway
+}
+
+// newTestLyricsService wires a LyricsService to a fake token endpoint and gateway
+func newTestLyricsService(t *testing.T, gatewayURL string) *LyricsService {
+	tokenServer, _ := newTestTokenServer(t, 3600, 0, nil)
+	oauthClient := NewOAuthClient(tokenServer.URL, "id", "secret", "")
+	return NewLyricsService(gatewayURL, "gpt-3.5-turbo", oauthClient)
+}
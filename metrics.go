@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// errorCodeKey is the gin context key under which handlers record the error code
+// of a failed request, so that it can be used as a metric label
+const errorCodeKey = "error_code"
+
+// metricsRegistry holds all service metrics exposed on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "songlyrics_http_requests_total",
+		Help: "HTTP requests by route, status code and API error code.",
+	}, []string{"route", "status", "error_code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "songlyrics_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	generationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "songlyrics_generation_duration_seconds",
+		Help:    "End-to-end lyrics generation latency by genre and outcome.",
+		Buckets: []float64{0.5, 1, 2, 3, 5, 8, 13, 20, 30},
+	}, []string{"genre", "outcome"})
+
+	gatewayRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "songlyrics_gateway_request_duration_seconds",
+		Help:    "AI Gateway chat completion latency by model and outcome.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 3, 5, 8, 13, 20, 30},
+	}, []string{"model", "outcome"})
+
+	promptTokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "songlyrics_prompt_tokens_total",
+		Help: "Prompt tokens consumed by model and genre.",
+	}, []string{"model", "genre"})
+
+	completionTokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "songlyrics_completion_tokens_total",
+		Help: "Completion tokens consumed by model and genre.",
+	}, []string{"model", "genre"})
+
+	tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "songlyrics_tokens_total",
+		Help: "Total tokens (prompt + completion) consumed by model and genre.",
+	}, []string{"model", "genre"})
+
+	guardrailBlocksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "songlyrics_guardrail_blocks_total",
+		Help: "Requests blocked by gateway guardrails, by content category.",
+	}, []string{"category"})
+
+	truncatedCompletionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "songlyrics_truncated_completions_total",
+		Help: "Generations that hit the token limit, by whether they were continued or returned partial.",
+	}, []string{"model", "outcome"})
+
+	nearDuplicatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "songlyrics_near_duplicates_total",
+		Help: "Generations that were near-duplicates, by the source of the match and whether a regeneration resolved them or they were flagged.",
+	}, []string{"source", "outcome"})
+
+	qualityScore = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "songlyrics_quality_score",
+		Help:    "Composite quality score of generated lyrics by genre.",
+		Buckets: []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1},
+	}, []string{"genre"})
+
+	languageMismatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "songlyrics_language_mismatches_total",
+		Help: "Generations with sections in another language than requested, by whether a retry resolved them or they were flagged.",
+	}, []string{"language", "outcome"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		generationDuration,
+		gatewayRequestDuration,
+		promptTokensTotal,
+		completionTokensTotal,
+		tokensTotal,
+		guardrailBlocksTotal,
+		truncatedCompletionsTotal,
+		languageMismatchesTotal,
+		qualityScore,
+		nearDuplicatesTotal,
+	)
+}
+
+// metricsHandler serves the registry in the Prometheus text format
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// metricsMiddleware records request counts and latency per route
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// Use the route template rather than the raw path to bound cardinality
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		httpRequestsTotal.WithLabelValues(route, strconv.Itoa(c.Writer.Status()), c.GetString(errorCodeKey)).Inc()
+		httpRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// respondError writes an API error response and records its code for metrics
+func respondError(c *gin.Context, status int, code, message string) {
+	c.Set(errorCodeKey, code)
+	c.JSON(status, ErrorResponse{
+		Error:   code,
+		Message: message,
+	})
+}
+
+// errorMessage turns a validation error into a message for clients, capitalized and
+// ending with a period like the messages written out in the handlers
+func errorMessage(err error) string {
+	message := err.Error()
+	if first, size := utf8.DecodeRuneInString(message); size > 0 {
+		message = string(unicode.ToUpper(first)) + message[size:]
+	}
+	if !strings.HasSuffix(message, ".") {
+		message += "."
+	}
+	return message
+}
+
+// oauthCollector exposes the refresh counters of an OAuthClient
+type oauthCollector struct {
+	client *OAuthClient
+
+	refreshes     *prometheus.Desc
+	failures      *prometheus.Desc
+	invalidations *prometheus.Desc
+	rotations     *prometheus.Desc
+	expiry        *prometheus.Desc
+}
+
+// RegisterOAuthMetrics exposes the client's token refresh statistics on /metrics
+func RegisterOAuthMetrics(client *OAuthClient) {
+	metricsRegistry.MustRegister(newOAuthCollector(client))
+}
+
+func newOAuthCollector(client *OAuthClient) *oauthCollector {
+	return &oauthCollector{
+		client:        client,
+		refreshes:     prometheus.NewDesc("songlyrics_oauth_token_refreshes_total", "Successful OAuth token requests.", nil, nil),
+		failures:      prometheus.NewDesc("songlyrics_oauth_token_refresh_failures_total", "Failed OAuth token requests.", nil, nil),
+		invalidations: prometheus.NewDesc("songlyrics_oauth_token_invalidations_total", "Tokens invalidated after being rejected by the gateway.", nil, nil),
+		rotations:     prometheus.NewDesc("songlyrics_oauth_credential_rotations_total", "Successful client credential rotations.", nil, nil),
+		expiry:        prometheus.NewDesc("songlyrics_oauth_token_expiry_timestamp_seconds", "Expiry time of the cached OAuth token.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *oauthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.refreshes
+	ch <- c.failures
+	ch <- c.invalidations
+	ch <- c.rotations
+	ch <- c.expiry
+}
+
+// Collect implements prometheus.Collector
+func (c *oauthCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.Stats()
+	ch <- prometheus.MustNewConstMetric(c.refreshes, prometheus.CounterValue, float64(stats.Refreshes))
+	ch <- prometheus.MustNewConstMetric(c.failures, prometheus.CounterValue, float64(stats.Failures))
+	ch <- prometheus.MustNewConstMetric(c.invalidations, prometheus.CounterValue, float64(stats.Invalidations))
+	ch <- prometheus.MustNewConstMetric(c.rotations, prometheus.CounterValue, float64(stats.Rotations))
+
+	expiry := 0.0
+	if !stats.ExpiresAt.IsZero() {
+		expiry = float64(stats.ExpiresAt.Unix())
+	}
+	ch <- prometheus.MustNewConstMetric(c.expiry, prometheus.GaugeValue, expiry)
+}
+
+// guardrailCategories extracts the content categories that triggered a guardrail
+// from an Azure Content Safety error body. Unparseable bodies yield "unknown".
+func guardrailCategories(body string) []string {
+	var resp AzureContentSafetyResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		return []string{"unknown"}
+	}
+
+	var categories []string
+	for _, category := range resp.Message.Assessments.Categories {
+		if strings.EqualFold(category.Result, "FAIL") ||
+			(category.Threshold > 0 && category.Severity >= category.Threshold) {
+			categories = append(categories, strings.ToLower(category.Category))
+		}
+	}
+	if len(categories) == 0 {
+		return []string{"unknown"}
+	}
+	return categories
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsMiddlewareRecordsErrorCodes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(metricsMiddleware())
+	router.POST("/generate", generateLyrics(&LyricsService{}))
+	router.GET("/metrics", metricsHandler())
+
+	counter := httpRequestsTotal.WithLabelValues("/generate", "400", "invalid_genre")
+	before := testutil.ToFloat64(counter)
+
+	body := `{"keywords":["love"],"genre":"polka","emotion":"happy","language":"english","structure":{"verses":2}}`
+	req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `songlyrics_http_requests_total{error_code="invalid_genre",route="/generate",status="400"}`)
+}
+
+func TestOAuthCollector(t *testing.T) {
+	server, _ := newTestTokenServer(t, 3600, 0, nil)
+	client := NewOAuthClient(server.URL, "id", "secret", "")
+	_, err := client.GetAccessToken(context.Background())
+	assert.NoError(t, err)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newOAuthCollector(client))
+
+	expected := `
+# HELP songlyrics_oauth_token_refreshes_total Successful OAuth token requests.
+# TYPE songlyrics_oauth_token_refreshes_total counter
+songlyrics_oauth_token_refreshes_total 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "songlyrics_oauth_token_refreshes_total"))
+}
+
+func TestGuardrailCategories(t *testing.T) {
+	body := `{"code":446,"type":"GUARDRAIL_INTERVENED","message":{"action":"GUARDRAIL_INTERVENED",
+		"interveningGuardrail":"AZURE_CONTENT_SAFETY","assessments":{"categories":[
+		{"category":"Hate","result":"PASS","severity":0,"threshold":4},
+		{"category":"Violence","result":"FAIL","severity":4,"threshold":4},
+		{"category":"SelfHarm","severity":6,"threshold":2}]}}}`
+
+	assert.Equal(t, []string{"violence", "selfharm"}, guardrailCategories(body))
+	assert.Equal(t, []string{"unknown"}, guardrailCategories("not json"))
+	assert.Equal(t, []string{"unknown"}, guardrailCategories(`{"message":{}}`))
+}
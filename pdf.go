@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Lyric sheet geometry, in points on an A4 page
+const (
+	pdfPageWidth    = 595.28
+	pdfPageHeight   = 841.89
+	pdfMargin       = 54.0
+	pdfColumnGap    = 28.0
+	pdfFooterHeight = 30.0
+	pdfTitleSize    = 20.0
+	pdfTextSize     = 11.0
+	pdfFooterSize   = 8.0
+	pdfLeading      = 1.4
+	pdfSectionGap   = 10.0
+	pdfWrapIndent   = 14.0
+)
+
+// pdfFont identifies one of the fonts of a lyric sheet; its resource name is /F1 to /F4
+type pdfFont int
+
+const (
+	pdfRegular pdfFont = iota
+	pdfBold
+	pdfItalic
+	pdfCJK
+)
+
+var pdfBaseFonts = []string{"Helvetica", "Helvetica-Bold", "Helvetica-Oblique"}
+
+// pdfCJKFont is one of the standard Adobe CJK fonts. They are not embedded: PDF
+// viewers supply a matching font, so Japanese and Korean sheets need no font files
+type pdfCJKFont struct {
+	name       string
+	ordering   string
+	supplement int
+	encoding   string
+	widths     string
+}
+
+var (
+	pdfJapaneseFont = pdfCJKFont{"HeiseiKakuGo-W5", "Japan1", 2, "UniJIS-UCS2-H", "/W [327 389 500]"}
+	pdfKoreanFont   = pdfCJKFont{"HYGoThic-Medium", "Korea1", 1, "UniKS-UCS2-H", ""}
+)
+
+// pdfRun is a stretch of text drawn in a single font
+type pdfRun struct {
+	font  pdfFont
+	text  []byte  // encoded for the font: Windows-1252 for Helvetica, UCS-2 for CJK
+	width float64 // in thousandths of the font size
+}
+
+// pdfRuns splits text into runs, switching to the CJK font for characters that
+// Helvetica cannot draw
+func pdfRuns(text string, font pdfFont) []pdfRun {
+	var runs []pdfRun
+	for _, r := range text {
+		run := pdfRun{font: font}
+		if b, ok := charmap.Windows1252.EncodeRune(r); ok && b >= ' ' {
+			run.text = []byte{b}
+			run.width = pdfLatinWidth(font, b)
+		} else {
+			if r > 0xFFFF { // UCS-2 only covers the Basic Multilingual Plane
+				r = '〓'
+			}
+			run.font = pdfCJK
+			run.text = []byte{byte(r >> 8), byte(r)}
+			run.width = 1000
+			if r >= 0xFF61 && r <= 0xFF9F { // half-width katakana
+				run.width = 500
+			}
+		}
+
+		if n := len(runs); n > 0 && runs[n-1].font == run.font {
+			runs[n-1].text = append(runs[n-1].text, run.text...)
+			runs[n-1].width += run.width
+		} else {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+func pdfLatinWidth(font pdfFont, b byte) float64 {
+	if font == pdfBold {
+		return float64(helveticaBoldWidths[b-' '])
+	}
+	return float64(helveticaWidths[b-' '])
+}
+
+// pdfTextWidth returns the width of text in points
+func pdfTextWidth(text string, font pdfFont, size float64) float64 {
+	width := 0.0
+	for _, run := range pdfRuns(text, font) {
+		width += run.width
+	}
+	return width * size / 1000
+}
+
+// pdfWrap breaks text into lines no wider than width, at spaces or between CJK
+// characters, and within words that are wider than a line
+func pdfWrap(text string, font pdfFont, size, width float64) []string {
+	var lines []string
+	line := ""
+	for _, token := range pdfTokens(text) {
+		if line != "" && pdfTextWidth(line+strings.TrimRight(token, " "), font, size) > width {
+			lines = append(lines, strings.TrimRight(line, " "))
+			line = ""
+		}
+		for line == "" && pdfTextWidth(strings.TrimRight(token, " "), font, size) > width {
+			runes := []rune(token)
+			cut := 1
+			for cut < len(runes) && pdfTextWidth(string(runes[:cut+1]), font, size) <= width {
+				cut++
+			}
+			lines = append(lines, string(runes[:cut]))
+			token = string(runes[cut:])
+		}
+		line += token
+	}
+	if line = strings.TrimRight(line, " "); line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// pdfTokens splits text into the units a line can break after: words with their
+// trailing spaces, and single CJK characters
+func pdfTokens(text string) []string {
+	var tokens []string
+	add := func(token string) {
+		// Spaces after a CJK character belong to it
+		if n := len(tokens); n > 0 && strings.TrimLeft(token, " ") == "" {
+			tokens[n-1] += token
+			return
+		}
+		tokens = append(tokens, token)
+	}
+
+	start := 0
+	for i, r := range text {
+		wide := unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+		if i > start && (wide || r != ' ' && text[i-1] == ' ') {
+			add(text[start:i])
+			start = i
+		}
+		if wide {
+			add(string(r))
+			start = i + utf8.RuneLen(r)
+		}
+	}
+	if start < len(text) {
+		add(text[start:])
+	}
+	return tokens
+}
+
+// pdfTruncate shortens text with an ellipsis to fit width
+func pdfTruncate(text string, font pdfFont, size, width float64) string {
+	if pdfTextWidth(text, font, size) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && pdfTextWidth(string(runes)+"…", font, size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return strings.TrimRight(string(runes), " ") + "…"
+}
+
+// drawText draws text with its baseline starting at (x, y)
+func drawText(page *bytes.Buffer, x, y float64, text string, font pdfFont, size float64) {
+	fmt.Fprintf(page, "BT %.2f %.2f Td", x, y)
+	for _, run := range pdfRuns(text, font) {
+		fmt.Fprintf(page, " /F%d %.1f Tf <%X> Tj", run.font+1, size, run.text)
+	}
+	page.WriteString(" ET\n")
+}
+
+// pdfLine is a line of a section, already wrapped to the column width
+type pdfLine struct {
+	text   string
+	font   pdfFont
+	indent float64
+}
+
+// pdfSheet flows sections down one or two columns over as many pages as needed
+type pdfSheet struct {
+	columns     int
+	columnWidth float64
+	pages       []*bytes.Buffer
+	column      int
+	top         float64 // where the columns start on the current page
+	y           float64 // baseline of the last line drawn
+}
+
+func newPDFSheet(columns int) *pdfSheet {
+	sheet := &pdfSheet{
+		columns:     columns,
+		columnWidth: (pdfPageWidth - 2*pdfMargin - float64(columns-1)*pdfColumnGap) / float64(columns),
+	}
+	sheet.newPage()
+	return sheet
+}
+
+func (s *pdfSheet) newPage() {
+	s.pages = append(s.pages, &bytes.Buffer{})
+	s.column = 0
+	s.top = pdfPageHeight - pdfMargin
+	s.y = s.top
+}
+
+// nextColumn moves to the top of the next column, or of the next page after the last column
+func (s *pdfSheet) nextColumn() {
+	if s.column++; s.column == s.columns {
+		s.newPage()
+		return
+	}
+	s.y = s.top
+}
+
+// fits reports whether height points fit between the last line and the footer
+func (s *pdfSheet) fits(height float64) bool {
+	return s.y-height >= pdfMargin+pdfFooterHeight
+}
+
+// title draws the title across the full width of the first page, above the columns
+func (s *pdfSheet) title(title string) {
+	page := s.pages[0]
+	for _, line := range pdfWrap(title, pdfBold, pdfTitleSize, pdfPageWidth-2*pdfMargin) {
+		s.y -= pdfTitleSize * 1.2
+		drawText(page, pdfMargin, s.y, line, pdfBold, pdfTitleSize)
+	}
+	s.y -= pdfTitleSize * 0.6
+	s.top = s.y
+}
+
+// section draws a block of lines, moving it to the next column when it does not
+// fit in the current one and it would fit in an empty column
+func (s *pdfSheet) section(lines []pdfLine) {
+	lineHeight := pdfTextSize * pdfLeading
+	gap := pdfSectionGap
+	if s.y == s.top {
+		gap = 0
+	}
+	height := float64(len(lines)) * lineHeight
+	columnHeight := pdfPageHeight - 2*pdfMargin - pdfFooterHeight
+	if !s.fits(gap+height) && height <= columnHeight {
+		s.nextColumn()
+		gap = 0
+	}
+	s.y -= gap
+
+	for _, line := range lines {
+		if !s.fits(lineHeight) {
+			s.nextColumn()
+		}
+		s.y -= lineHeight
+		x := pdfMargin + float64(s.column)*(s.columnWidth+pdfColumnGap) + line.indent
+		drawText(s.pages[len(s.pages)-1], x, s.y, line.text, line.font, pdfTextSize)
+	}
+}
+
+// footer draws the song's metadata and the page number at the bottom of every page
+func (s *pdfSheet) footer(metadata string) {
+	y := pdfMargin
+	for i, page := range s.pages {
+		number := fmt.Sprintf("%d / %d", i+1, len(s.pages))
+		numberWidth := pdfTextWidth(number, pdfRegular, pdfFooterSize)
+		fmt.Fprintf(page, "0.75 G 0.5 w %.2f %.2f m %.2f %.2f l S\n",
+			pdfMargin, y+pdfFooterSize+6, pdfPageWidth-pdfMargin, y+pdfFooterSize+6)
+		page.WriteString("0.4 g\n")
+		text := pdfTruncate(metadata, pdfRegular, pdfFooterSize, pdfPageWidth-2*pdfMargin-numberWidth-pdfColumnGap)
+		drawText(page, pdfMargin, y, text, pdfRegular, pdfFooterSize)
+		drawText(page, pdfPageWidth-pdfMargin-numberWidth, y, number, pdfRegular, pdfFooterSize)
+		page.WriteString("0 g\n")
+	}
+}
+
+// renderPDF lays out the song as a printable lyric sheet: the title, each section
+// under its label, a reference instead of the text of a repeated chorus, and the
+// song's metadata in the footer
+func renderPDF(song StoredLyrics, options exportOptions) []byte {
+	sheet := newPDFSheet(options.Columns)
+	sheet.title(song.Response.Lyrics.Title)
+
+	wrapWidth := sheet.columnWidth - pdfWrapIndent
+	var chorus []string
+	for _, section := range song.Response.Lyrics.Sections {
+		label := sectionLabel(section.Name)
+		if sectionKind(section.Name) == "chorus" {
+			if chorus != nil && slices.Equal(chorus, section.Lines) {
+				sheet.section([]pdfLine{{text: "Repeat " + label, font: pdfItalic}})
+				continue
+			}
+			chorus = section.Lines
+		}
+
+		lines := []pdfLine{{text: label, font: pdfBold}}
+		for j, lyric := range section.Lines {
+			for i, wrapped := range pdfWrap(lyric, pdfRegular, pdfTextSize, wrapWidth) {
+				line := pdfLine{text: wrapped, font: pdfRegular}
+				if i > 0 {
+					line.indent = pdfWrapIndent
+				}
+				lines = append(lines, line)
+			}
+			if romanized := section.romanizedLine(j); romanized != "" {
+				for _, wrapped := range pdfWrap(romanized, pdfItalic, pdfTextSize, wrapWidth) {
+					lines = append(lines, pdfLine{text: wrapped, font: pdfItalic, indent: pdfWrapIndent})
+				}
+			}
+		}
+		sheet.section(lines)
+	}
+
+	var values []string
+	for _, header := range exportHeaders(song) {
+		values = append(values, header[1])
+	}
+	sheet.footer(strings.Join(values, " · "))
+
+	return writePDF(sheet.pages, pdfFontFor(song), song)
+}
+
+// pdfFontFor picks the Korean CJK font for songs in or containing Korean, and the
+// Japanese one, which also covers kanji and kana, for everything else
+func pdfFontFor(song StoredLyrics) pdfCJKFont {
+	if song.Response.Metadata.Language == "korean" {
+		return pdfKoreanFont
+	}
+	for _, section := range song.Response.Lyrics.Sections {
+		for _, line := range section.Lines {
+			if strings.IndexFunc(line, func(r rune) bool { return unicode.Is(unicode.Hangul, r) }) >= 0 {
+				return pdfKoreanFont
+			}
+		}
+	}
+	return pdfJapaneseFont
+}
+
+// pdfDocument writes numbered objects and keeps their offsets for the cross-reference table
+type pdfDocument struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+// add writes the next object and returns its number
+func (d *pdfDocument) add(format string, args ...interface{}) int {
+	d.offsets = append(d.offsets, d.buf.Len())
+	fmt.Fprintf(&d.buf, "%d 0 obj\n", len(d.offsets))
+	fmt.Fprintf(&d.buf, format, args...)
+	d.buf.WriteString("\nendobj\n")
+	return len(d.offsets)
+}
+
+// addStream writes a compressed stream object and returns its number
+func (d *pdfDocument) addStream(data []byte) int {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(data)
+	w.Close()
+	return d.add("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.Bytes())
+}
+
+// writePDF assembles the page content streams into a PDF file. Objects are written
+// in order, so their numbers are known before they are referenced: the catalog,
+// the page tree, the fonts, then a page and its content per page, and the info
+func writePDF(pages []*bytes.Buffer, cjk pdfCJKFont, song StoredLyrics) []byte {
+	var d pdfDocument
+	d.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	const firstFont = 3
+	fonts := len(pdfBaseFonts) + 3 // the CJK font is a Type0 font, a CIDFont and a descriptor
+	firstPage := firstFont + fonts
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+
+	d.add("<< /Type /Catalog /Pages 2 0 R >>")
+	d.add("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+
+	var resources strings.Builder
+	for i, name := range pdfBaseFonts {
+		fmt.Fprintf(&resources, "/F%d %d 0 R ", i+1, d.add("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", name))
+	}
+	fmt.Fprintf(&resources, "/F%d %d 0 R", pdfCJK+1, d.add("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /%s /DescendantFonts [%d 0 R] >>",
+		cjk.name, cjk.encoding, len(d.offsets)+2))
+	d.add("<< /Type /Font /Subtype /CIDFontType0 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (%s) /Supplement %d >> /FontDescriptor %d 0 R /DW 1000 %s >>",
+		cjk.name, cjk.ordering, cjk.supplement, len(d.offsets)+2, cjk.widths)
+	d.add("<< /Type /FontDescriptor /FontName /%s /Flags 4 /FontBBox [-200 -331 1200 1000] /ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>", cjk.name)
+
+	for _, page := range pages {
+		d.add("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources.String(), len(d.offsets)+2)
+		d.addStream(page.Bytes())
+	}
+
+	info := fmt.Sprintf("/Title <FEFF%X> /Producer (songlyrics-api %s)", utf16BE(song.Response.Lyrics.Title), buildVersion())
+	if created := song.Response.Metadata.CreatedAt; !created.IsZero() {
+		info += " /CreationDate (D:" + created.UTC().Format("20060102150405") + "Z)"
+	}
+	infoObject := d.add("<< %s >>", info)
+
+	xref := d.buf.Len()
+	fmt.Fprintf(&d.buf, "xref\n0 %d\n0000000000 65535 f \n", len(d.offsets)+1)
+	for _, offset := range d.offsets {
+		fmt.Fprintf(&d.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&d.buf, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(d.offsets)+1, infoObject, xref)
+	return d.buf.Bytes()
+}
+
+// utf16BE encodes text as big-endian UTF-16, the encoding of PDF text strings
+func utf16BE(text string) []byte {
+	var encoded []byte
+	for _, unit := range utf16.Encode([]rune(text)) {
+		encoded = append(encoded, byte(unit>>8), byte(unit))
+	}
+	return encoded
+}
+
+// Glyph widths of Helvetica for Windows-1252 characters from the space onwards,
+// in thousandths of the font size. Helvetica-Oblique has the same widths
+var helveticaWidths = [224]uint16{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584, 350,
+	556, 350, 222, 556, 333, 1000, 556, 556, 333, 1000, 667, 333, 1000, 350, 611, 350,
+	350, 222, 222, 333, 333, 350, 556, 1000, 333, 1000, 500, 333, 944, 350, 500, 667,
+	278, 333, 556, 556, 556, 556, 260, 556, 333, 737, 370, 556, 584, 333, 737, 333,
+	400, 584, 333, 333, 333, 556, 537, 278, 333, 333, 365, 556, 834, 834, 834, 611,
+	667, 667, 667, 667, 667, 667, 1000, 722, 667, 667, 667, 667, 278, 278, 278, 278,
+	722, 722, 778, 778, 778, 778, 778, 584, 778, 722, 722, 722, 722, 667, 667, 611,
+	556, 556, 556, 556, 556, 556, 889, 500, 556, 556, 556, 556, 278, 278, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 584, 611, 556, 556, 556, 556, 500, 556, 500,
+}
+
+var helveticaBoldWidths = [224]uint16{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584, 350,
+	556, 350, 278, 556, 500, 1000, 556, 556, 333, 1000, 667, 333, 1000, 350, 611, 350,
+	350, 278, 278, 500, 500, 350, 556, 1000, 333, 1000, 556, 333, 944, 350, 500, 667,
+	278, 333, 556, 556, 556, 556, 280, 556, 333, 737, 370, 556, 584, 333, 737, 333,
+	400, 584, 333, 333, 333, 611, 556, 278, 333, 333, 365, 556, 834, 834, 834, 611,
+	722, 722, 722, 722, 722, 722, 1000, 722, 667, 667, 667, 667, 278, 278, 278, 278,
+	722, 722, 778, 778, 778, 778, 778, 584, 778, 722, 722, 722, 722, 667, 667, 611,
+	556, 556, 556, 556, 556, 556, 889, 556, 556, 556, 556, 556, 278, 278, 278, 278,
+	611, 611, 611, 611, 611, 611, 611, 584, 611, 611, 611, 611, 611, 556, 611, 556,
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	pdfStreamPattern = regexp.MustCompile(`(?s)stream\n(.*?)\nendstream`)
+	pdfXrefPattern   = regexp.MustCompile(`(?s)xref\n0 (\d+)\n(.*)trailer`)
+)
+
+// pdfContents checks the cross-reference table of a PDF and returns its decompressed page contents
+func pdfContents(t *testing.T, pdf []byte) []string {
+	require.True(t, bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")))
+	require.True(t, bytes.HasSuffix(pdf, []byte("%%EOF\n")))
+
+	xref := pdfXrefPattern.FindSubmatch(pdf)
+	require.NotNil(t, xref)
+	entries := strings.Split(strings.TrimSuffix(string(xref[2]), "\n"), "\n")
+	require.Equal(t, string(xref[1]), strconv.Itoa(len(entries)))
+	for i, entry := range entries[1:] {
+		require.Len(t, entry, 19) // 20 bytes with the newline
+		offset, err := strconv.Atoi(entry[:10])
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(pdf[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))), "object %d", i+1)
+	}
+
+	var contents []string
+	for _, stream := range pdfStreamPattern.FindAllSubmatch(pdf, -1) {
+		r, err := zlib.NewReader(bytes.NewReader(stream[1]))
+		require.NoError(t, err)
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		contents = append(contents, string(content))
+	}
+	return contents
+}
+
+// pdfHex returns text as drawn in a content stream with a Helvetica font
+func pdfHex(text string) string {
+	return fmt.Sprintf("<%X>", text)
+}
+
+func TestExportPDF(t *testing.T) {
+	service, id := testStoredSong(t, "Home Again")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/lyrics/:id/export", exportLyrics(service))
+	export := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := export("/lyrics/" + id + "/export?format=pdf&columns=2")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=home-again.pdf`, w.Header().Get("Content-Disposition"))
+	assert.Contains(t, w.Body.String(), "/Count 1")
+	assert.Contains(t, w.Body.String(), "/CreationDate (D:20250826103000Z)")
+
+	contents := pdfContents(t, w.Body.Bytes())
+	require.Len(t, contents, 1)
+	page := contents[0]
+	assert.Contains(t, page, "/F2 20.0 Tf "+pdfHex("Home Again"))
+	assert.Contains(t, page, "/F2 11.0 Tf "+pdfHex("Verse 1"))
+	assert.Contains(t, page, "/F1 11.0 Tf "+pdfHex("City lights"))
+	assert.Contains(t, page, "/F3 11.0 Tf "+pdfHex("Repeat Chorus"))
+	assert.Equal(t, 1, strings.Count(page, pdfHex("We are home")), "a repeated chorus is only referenced")
+	assert.Contains(t, page, "/F1 8.0 Tf "+pdfHex("1 / 1"))
+	assert.Contains(t, page, "/F1 8.0 Tf "+strings.TrimSuffix(pdfHex("folk 60% + electronic 40% \xb7 hopeful \xb7 english"), ">"))
+
+	// The second column starts halfway across the page
+	assert.NotContains(t, page, "BT 311.64")
+
+	w = export("/lyrics/" + id + "/export?format=pdf&columns=3")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_columns")
+}
+
+func TestPDFFlowsLongSongsOverColumnsAndPages(t *testing.T) {
+	var sections []LyricsSection
+	for i := 1; i <= 12; i++ {
+		sections = append(sections, LyricsSection{
+			Name:  fmt.Sprintf("verse %d", i),
+			Lines: []string{"One line of the verse", "Another line of the verse", "A third line", "And the last line of it"},
+		})
+	}
+	song := StoredLyrics{Response: LyricsResponse{Lyrics: GeneratedLyrics{Title: "Long Song", Sections: sections}}}
+
+	oneColumn := pdfContents(t, renderPDF(song, exportOptions{Columns: 1}))
+	twoColumns := pdfContents(t, renderPDF(song, exportOptions{Columns: 2}))
+	assert.Len(t, oneColumn, 2)
+	assert.Len(t, twoColumns, 1)
+	assert.Contains(t, twoColumns[0], "BT 311.64")
+
+	// Sections are kept together in one column
+	for _, page := range append(oneColumn, twoColumns...) {
+		for _, x := range []string{"BT 54.00 ", "BT 311.64 "} {
+			first, last := 0, 0
+			for _, line := range strings.Split(page, "\n") {
+				if strings.HasPrefix(line, x) && strings.Contains(line, pdfHex("One line of the verse")) {
+					first++
+				}
+				if strings.HasPrefix(line, x) && strings.Contains(line, pdfHex("And the last line of it")) {
+					last++
+				}
+			}
+			assert.Equal(t, first, last)
+		}
+	}
+}
+
+func TestPDFRunsSwitchToCJKFont(t *testing.T) {
+	runs := pdfRuns("夜明け — Go", pdfBold)
+	require.Len(t, runs, 2)
+	assert.Equal(t, pdfRun{pdfCJK, []byte{0x59, 0x1C, 0x66, 0x0E, 0x30, 0x51}, 3000}, runs[0])
+	assert.Equal(t, pdfRun{pdfBold, []byte(" \x97 Go"), 278 + 1000 + 278 + 778 + 611}, runs[1])
+
+	korean := StoredLyrics{Response: LyricsResponse{
+		Lyrics:   GeneratedLyrics{Title: "새벽", Sections: []LyricsSection{{Name: "verse 1", Lines: []string{"새벽이 오면"}}}},
+		Metadata: LyricsMetadata{Language: "korean"},
+	}}
+	pdf := renderPDF(korean, exportOptions{Columns: 1})
+	assert.Contains(t, string(pdf), "/BaseFont /HYGoThic-Medium /Encoding /UniKS-UCS2-H")
+	assert.Contains(t, pdfContents(t, pdf)[0], "/F4 11.0 Tf <C0C8BCBDC774> Tj /F1 11.0 Tf <20> Tj /F4 11.0 Tf <C624BA74> Tj")
+
+	korean.Response.Metadata.Language = "japanese"
+	korean.Response.Lyrics.Sections[0].Lines = []string{"夜明けの道"}
+	assert.Contains(t, string(renderPDF(korean, exportOptions{Columns: 1})), "/BaseFont /HeiseiKakuGo-W5 /Encoding /UniJIS-UCS2-H")
+}
+
+func TestPDFWrap(t *testing.T) {
+	assert.Equal(t, []string{"Walking down this", "winding road"}, pdfWrap("Walking down this winding road", pdfRegular, 11, 100))
+	assert.Equal(t, []string{"夜明けの道を", "歩く"}, pdfWrap("夜明けの道を歩く", pdfRegular, 10, 60))
+	assert.Equal(t, []string{"Supercalifragilis", "tic"}, pdfWrap("Supercalifragilistic", pdfRegular, 11, 80))
+	assert.Equal(t, []string{""}, pdfWrap("", pdfRegular, 11, 80))
+	assert.Equal(t, "Folk · hopeful · ci…", pdfTruncate("Folk · hopeful · city, home", pdfRegular, 8, 70))
+}
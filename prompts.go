@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// defaultPromptFS holds the built-in prompt versions used when no prompt directory
+// is configured
+//
+//go:embed prompts
+var defaultPromptFS embed.FS
+
+// defaultPromptVersion is the built-in version used unless configured otherwise
+const defaultPromptVersion = "v1"
+
+// Prompt template files. Every version directory has both; overrides may have either.
+const (
+	systemTemplateFile = "system.tmpl"
+	userTemplateFile   = "user.tmpl"
+)
+
+// Override scopes inside a version directory, e.g. v1/genre/k-pop/user.tmpl
+const (
+	genreScope    = "genre"
+	languageScope = "language"
+)
+
+// PromptData is the data available to prompt templates. For a language mix, Language
+// names every language and Languages lists the mix.
+type PromptData struct {
+	Language     string
+	Languages    []LanguageMix
+	Genre        string
+	Emotion      string
+	Keywords     []string
+	Verses       int
+	Chorus       bool
+	Bridge       bool
+	EmotionArc   []SectionEmotion
+	MaxIntensity int
+	StyleGuide   []string
+	// MinWords and MaxWords are the target length; zero when no target is set
+	MinWords int
+	MaxWords int
+}
+
+// RenderedPrompt is a rendered system and user prompt and the templates they came from
+type RenderedPrompt struct {
+	System  string
+	User    string
+	Version string
+	// Override is the scope that replaced a base template, e.g. "genre/k-pop"
+	Override string
+}
+
+// promptPair is a system and user template; either may be nil in an override
+type promptPair struct {
+	system *template.Template
+	user   *template.Template
+}
+
+// PromptSet is one named version of the prompt templates with its overrides
+type PromptSet struct {
+	Version   string
+	base      promptPair
+	overrides map[string]promptPair // keyed by "genre/<id>" or "language/<id>"
+}
+
+// PromptLibrary holds every prompt version found in the prompt directory
+type PromptLibrary struct {
+	versions map[string]*PromptSet
+}
+
+var (
+	defaultPrompts     *PromptLibrary
+	defaultPromptsOnce sync.Once
+)
+
+// DefaultPrompts returns the built-in prompt templates
+func DefaultPrompts() *PromptLibrary {
+	defaultPromptsOnce.Do(func() {
+		root, err := fs.Sub(defaultPromptFS, "prompts")
+		if err == nil {
+			defaultPrompts, err = loadPromptLibrary(root)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("invalid built-in prompts: %v", err))
+		}
+	})
+	return defaultPrompts
+}
+
+// LoadPrompts loads and validates every prompt version in dir, one subdirectory per
+// version; an empty dir returns the built-in prompts
+func LoadPrompts(dir string) (*PromptLibrary, error) {
+	if dir == "" {
+		return DefaultPrompts(), nil
+	}
+	return loadPromptLibrary(os.DirFS(dir))
+}
+
+func loadPromptLibrary(fsys fs.FS) (*PromptLibrary, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt directory: %w", err)
+	}
+
+	library := &PromptLibrary{versions: map[string]*PromptSet{}}
+	var errs []error
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		set, err := loadPromptSet(fsys, entry.Name())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		library.versions[set.Version] = set
+	}
+	if len(library.versions) == 0 && len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("no prompt versions found"))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return library, nil
+}
+
+func loadPromptSet(fsys fs.FS, version string) (*PromptSet, error) {
+	base, err := parsePromptPair(fsys, version)
+	if err != nil {
+		return nil, err
+	}
+	if base.system == nil || base.user == nil {
+		return nil, fmt.Errorf("prompt version %s: %s and %s are required", version, systemTemplateFile, userTemplateFile)
+	}
+	set := &PromptSet{Version: version, base: base, overrides: map[string]promptPair{}}
+
+	var errs []error
+	for _, scope := range []string{genreScope, languageScope} {
+		ids, err := fs.ReadDir(fsys, path.Join(version, scope))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, id := range ids {
+			if !id.IsDir() {
+				continue
+			}
+			pair, err := parsePromptPair(fsys, path.Join(version, scope, id.Name()))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			set.overrides[scope+"/"+normalizeCatalogKey(id.Name())] = pair
+		}
+	}
+
+	if err := set.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return set, nil
+}
+
+// parsePromptPair parses the templates present in dir
+func parsePromptPair(fsys fs.FS, dir string) (promptPair, error) {
+	var pair promptPair
+	var errs []error
+	for _, file := range []struct {
+		name   string
+		target **template.Template
+	}{
+		{systemTemplateFile, &pair.system},
+		{userTemplateFile, &pair.user},
+	} {
+		name := path.Join(dir, file.name)
+		data, err := fs.ReadFile(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tmpl, err := template.New(name).Funcs(promptFuncs).Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		*file.target = tmpl
+	}
+	return pair, errors.Join(errs...)
+}
+
+var promptFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"title": capitalize,
+	"percent": func(share float64) string {
+		return fmt.Sprintf("%.0f%%", share*100)
+	},
+}
+
+// capitalize upper-cases the first letter of s
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// samplePromptData is rendered against every template at load time
+func samplePromptData() PromptData {
+	return PromptData{
+		Language:     "english",
+		Genre:        "folk 60% + electronic 40%",
+		Emotion:      "hopeful",
+		Keywords:     []string{"river", "city lights"},
+		Verses:       2,
+		Chorus:       true,
+		Bridge:       true,
+		EmotionArc:   []SectionEmotion{{Section: "verse 1", Emotion: "melancholic", Intensity: 4}, {Section: "chorus", Emotion: "hopeful", Intensity: 3}},
+		Languages:    []LanguageMix{{Language: "english", Sections: []string{"verse 1", "verse 2", "bridge"}}, {Language: "spanish", Weight: 0.3}},
+		MaxIntensity: maxIntensity,
+		StyleGuide:   []string{"Genre (folk): Use simple, honest imagery."},
+		MinWords:     175,
+		MaxWords:     275,
+	}
+}
+
+// validate renders every template of the set against a sample request so broken
+// templates are rejected at load time rather than on the first request
+func (p *PromptSet) validate() error {
+	pairs := map[string]promptPair{"": p.base}
+	for scope, pair := range p.overrides {
+		pairs[scope] = pair
+	}
+
+	var errs []error
+	for scope, pair := range pairs {
+		for _, tmpl := range []*template.Template{pair.system, pair.user} {
+			if tmpl == nil {
+				continue
+			}
+			output, err := renderPrompt(tmpl, samplePromptData())
+			if err != nil {
+				errs = append(errs, err)
+			} else if output == "" {
+				errs = append(errs, fmt.Errorf("prompt template %s (%s) renders empty", tmpl.Name(), scope))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func renderPrompt(tmpl *template.Template, data PromptData) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Version returns the named prompt version
+func (l *PromptLibrary) Version(name string) (*PromptSet, bool) {
+	set, ok := l.versions[name]
+	return set, ok
+}
+
+// Versions returns the available version names in sorted order
+func (l *PromptLibrary) Versions() []string {
+	names := make([]string, 0, len(l.versions))
+	for name := range l.versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkCatalog reports overrides for genres or languages that are not in the catalog
+func (l *PromptLibrary) checkCatalog(catalog *Catalog) error {
+	var errs []error
+	for _, version := range l.Versions() {
+		for scope := range l.versions[version].overrides {
+			kind, id, _ := strings.Cut(scope, "/")
+			set := catalog.Genres
+			if kind == languageScope {
+				set = catalog.Languages
+			}
+			if entry, ok := set.Lookup(id); !ok || entry.ID != id {
+				errs = append(errs, fmt.Errorf("prompt version %s: override %s does not match a %s ID in the catalog", version, scope, kind))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Render renders the prompts for a request. Each template is taken from the most
+// specific override that provides it: the dominant genre, its root genre, the
+// language, and finally the base templates of the version.
+func (p *PromptSet) Render(catalog *Catalog, req LyricsRequest) (RenderedPrompt, error) {
+	var scopes []string
+	genre := req.genreBlend()[0].Genre
+	scopes = append(scopes, genreScope+"/"+genre)
+	if entry, ok := catalog.Genres.Lookup(genre); ok && entry.Parent != "" {
+		scopes = append(scopes, genreScope+"/"+entry.Parent)
+	}
+	scopes = append(scopes, languageScope+"/"+req.Language)
+
+	system, user := p.base.system, p.base.user
+	systemFound, userFound := false, false
+	rendered := RenderedPrompt{Version: p.Version}
+	for _, scope := range scopes {
+		pair, ok := p.overrides[scope]
+		if !ok {
+			continue
+		}
+		if pair.system != nil && !systemFound {
+			system, systemFound = pair.system, true
+		}
+		if pair.user != nil && !userFound {
+			user, userFound = pair.user, true
+		}
+		if rendered.Override == "" {
+			rendered.Override = scope
+		}
+	}
+
+	data := catalog.promptData(req)
+	var err error
+	if rendered.System, err = renderPrompt(system, data); err != nil {
+		return RenderedPrompt{}, err
+	}
+	if rendered.User, err = renderPrompt(user, data); err != nil {
+		return RenderedPrompt{}, err
+	}
+	return rendered, nil
+}
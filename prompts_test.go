@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePromptFiles creates a prompt directory from relative paths to file contents
+func writePromptFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	return dir
+}
+
+func TestPromptOverrides(t *testing.T) {
+	library, err := LoadPrompts(writePromptFiles(t, map[string]string{
+		"v1/system.tmpl":                 "base system",
+		"v1/user.tmpl":                   "base {{.Genre}}",
+		"v2/system.tmpl":                 "v2 system",
+		"v2/user.tmpl":                   "v2 {{.Genre}} in {{.Language}}",
+		"v2/genre/pop/user.tmpl":         "pop family {{.Genre}}",
+		"v2/genre/k-pop/system.tmpl":     "k-pop system",
+		"v2/language/japanese/user.tmpl": "japanese {{.Genre}}",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1", "v2"}, library.Versions())
+	assert.NoError(t, library.checkCatalog(DefaultCatalog()))
+
+	v2, ok := library.Version("v2")
+	require.True(t, ok)
+	render := func(genre, language string) RenderedPrompt {
+		rendered, err := v2.Render(DefaultCatalog(), LyricsRequest{Genre: genre, Emotion: "happy", Language: language})
+		require.NoError(t, err)
+		return rendered
+	}
+
+	// The sub-genre supplies the system prompt and inherits the user prompt of its root
+	rendered := render("k-pop", "japanese")
+	assert.Equal(t, RenderedPrompt{System: "k-pop system", User: "pop family k-pop (a style of pop)", Version: "v2", Override: "genre/k-pop"}, rendered)
+
+	rendered = render("rock", "japanese")
+	assert.Equal(t, "v2 system", rendered.System)
+	assert.Equal(t, "japanese rock", rendered.User)
+	assert.Equal(t, "language/japanese", rendered.Override)
+
+	rendered = render("rock", "english")
+	assert.Equal(t, "v2 rock in english", rendered.User)
+	assert.Empty(t, rendered.Override)
+}
+
+func TestLoadPromptsValidatesTemplates(t *testing.T) {
+	_, err := LoadPrompts(writePromptFiles(t, map[string]string{
+		"v1/system.tmpl":                "system",
+		"v1/user.tmpl":                  "{{.Mood}}",
+		"v1/language/english/user.tmpl": "{{if .Genre}}unclosed",
+		"v2/user.tmpl":                  "user only",
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't evaluate field Mood")
+	assert.Contains(t, err.Error(), "unexpected EOF")
+	assert.Contains(t, err.Error(), "prompt version v2: system.tmpl and user.tmpl are required")
+
+	library, err := LoadPrompts(writePromptFiles(t, map[string]string{
+		"v1/system.tmpl":           "system",
+		"v1/user.tmpl":             "user",
+		"v1/genre/polka/user.tmpl": "polka",
+	}))
+	require.NoError(t, err)
+	assert.ErrorContains(t, library.checkCatalog(DefaultCatalog()), "override genre/polka does not match")
+}
+
+func TestConfigSelectsPromptVersion(t *testing.T) {
+	clearConfigEnv(t)
+	dir := writePromptFiles(t, map[string]string{
+		"v1/system.tmpl": "system",
+		"v1/user.tmpl":   "user",
+	})
+
+	_, err := LoadConfig(writeConfigFile(t, "config.yaml", validYAMLConfig+"prompts:\n  dir: "+dir+"\n  version: v9\n"))
+	assert.ErrorContains(t, err, `prompts.version "v9" not found, available: v1`)
+
+	cfg, err := LoadConfig(writeConfigFile(t, "config.yaml", validYAMLConfig))
+	require.NoError(t, err)
+	assert.Equal(t, defaultPromptVersion, cfg.ServiceSettings().PromptVersion)
+}
+
+func TestPromptVersionRecordedInMetadata(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newTestGateway(t, "[Title: Song]\n[Verse 1]\nLine", &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+
+	req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(
+		`{"keywords":["love"],"genre":"pop","emotion":"happy","language":"english"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response LyricsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "v1", response.Metadata.PromptVersion)
+
+	require.Len(t, requests, 1)
+	raw, _ := json.Marshal(requests[0]["messages"])
+	assert.Contains(t, string(raw), "You are a professional songwriter")
+	assert.Contains(t, string(raw), "Write song lyrics in english")
+}
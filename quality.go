@@ -0,0 +1,405 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Quality sub-scores, as named in responses and in the catalog's quality_weights
+const (
+	qualityRhymeDensity          = "rhyme_density"
+	qualityLexicalDiversity      = "lexical_diversity"
+	qualityOriginality           = "originality"
+	qualityLineLengthConsistency = "line_length_consistency"
+	qualityRepetitionBalance     = "repetition_balance"
+	qualityKeywordIntegration    = "keyword_integration"
+)
+
+// qualityMetrics lists the sub-scores; each weighs 1 unless the genre says otherwise
+var qualityMetrics = []string{
+	qualityRhymeDensity,
+	qualityLexicalDiversity,
+	qualityOriginality,
+	qualityLineLengthConsistency,
+	qualityRepetitionBalance,
+	qualityKeywordIntegration,
+}
+
+// Quality scoring tuning
+const (
+	// diversityWindow is the number of words over which the type-token ratio is
+	// averaged, so that long songs are not penalized for their length
+	diversityWindow = 50
+	// clichePenalty is taken off originality for each cliché found
+	clichePenalty = 0.2
+	// verseKeywordCredit is the credit for a keyword that is only in the verses,
+	// against 1 for one in the title or chorus, where listeners remember it
+	verseKeywordCredit = 0.75
+)
+
+// cliches are overused lyric phrases per language, matched on whole words
+var cliches = map[string][]string{
+	"english": {
+		"heart of gold", "broken heart", "tears like rain", "set me free", "burning desire",
+		"end of time", "meant to be", "light up the sky", "dance the night away", "fire in my soul",
+		"hold me tight", "never let you go", "like a bird", "reach for the stars", "against all odds",
+		"shattered dreams", "walk this road alone", "you complete me", "all night long", "heart and soul",
+		"forever and ever", "love is blind", "by my side", "touch the sky", "lost without you",
+	},
+	"spanish": {
+		"corazón roto", "para siempre jamás", "hasta el fin del mundo", "mi media naranja",
+		"tocar el cielo", "sin ti no soy nada", "bajo la luna llena", "fuego en el corazón",
+	},
+	"portuguese": {
+		"coração partido", "para todo o sempre", "até o fim do mundo", "tocar o céu",
+		"sem você não sou nada", "fogo no coração",
+	},
+	"french": {
+		"cœur brisé", "pour toujours", "jusqu'au bout du monde", "toucher le ciel",
+		"sans toi je ne suis rien", "feu dans mon cœur",
+	},
+	"italian": {
+		"cuore spezzato", "per sempre", "fino alla fine del mondo", "toccare il cielo",
+		"senza te non sono niente", "fuoco nel cuore",
+	},
+	"german": {
+		"gebrochenes herz", "für immer und ewig", "bis ans ende der welt", "den himmel berühren",
+		"ohne dich bin ich nichts", "feuer im herzen",
+	},
+}
+
+// QualityScore rates the craft of a song from 0 to 1. Score is the weighted mean of
+// the sub-scores with the weights of its genre.
+type QualityScore struct {
+	Score float64 `json:"score"`
+	// RhymeDensity is the share of lines that rhyme with another line of their section
+	RhymeDensity float64 `json:"rhyme_density"`
+	// LexicalDiversity is the moving-average type-token ratio of the distinct sections
+	LexicalDiversity float64 `json:"lexical_diversity"`
+	// Originality drops with each cliché found, listed in Cliches
+	Originality float64  `json:"originality"`
+	Cliches     []string `json:"cliches,omitempty"`
+	// LineLengthConsistency is how evenly the lines of each section are sized in syllables
+	LineLengthConsistency float64 `json:"line_length_consistency"`
+	// RepetitionBalance rewards a chorus that returns and verses that do not repeat
+	RepetitionBalance float64 `json:"repetition_balance"`
+	// KeywordIntegration is the share of keywords used, with full credit in the title or chorus
+	KeywordIntegration float64            `json:"keyword_integration"`
+	Weights            map[string]float64 `json:"weights"`
+}
+
+// scoreQuality rates the lyrics of a response. It needs nothing but the lyrics and
+// metadata, so the same song always gets the same score.
+func scoreQuality(catalog *Catalog, response LyricsResponse) *QualityScore {
+	sections := distinctSections(response.Lyrics.Sections)
+	quality := &QualityScore{
+		RhymeDensity:          rhymeDensity(response, sections),
+		LexicalDiversity:      lexicalDiversity(sections),
+		LineLengthConsistency: lineLengthConsistency(response, sections),
+		RepetitionBalance:     repetitionBalance(response.Lyrics.Sections),
+		KeywordIntegration:    keywordIntegration(response.Lyrics, response.Metadata.KeywordsUsed),
+		Weights:               catalog.qualityWeights(genreBlendOf(response.Metadata)),
+	}
+	quality.Cliches = findCliches(sections, response)
+	quality.Originality = round2(max(0, 1-float64(len(quality.Cliches))*clichePenalty))
+	quality.total()
+	return quality
+}
+
+// total sets Score from the sub-scores and weights
+func (q *QualityScore) total() {
+	scores := map[string]float64{
+		qualityRhymeDensity:          q.RhymeDensity,
+		qualityLexicalDiversity:      q.LexicalDiversity,
+		qualityOriginality:           q.Originality,
+		qualityLineLengthConsistency: q.LineLengthConsistency,
+		qualityRepetitionBalance:     q.RepetitionBalance,
+		qualityKeywordIntegration:    q.KeywordIntegration,
+	}
+	sum, weights := 0.0, 0.0
+	for _, metric := range qualityMetrics {
+		sum += scores[metric] * q.Weights[metric]
+		weights += q.Weights[metric]
+	}
+	q.Score = 0
+	if weights > 0 {
+		q.Score = round2(sum / weights)
+	}
+}
+
+// qualityWeights returns the weight of each sub-score for a genre or blend: a genre's
+// own quality_weights, else those of its root genre, with 1 for any not given. A
+// blend mixes the weights of its genres by their shares.
+func (c *Catalog) qualityWeights(blend []GenreWeight) map[string]float64 {
+	weights := make(map[string]float64, len(qualityMetrics))
+	for _, genre := range blend {
+		share := genre.Weight
+		if share == 0 {
+			share = 1
+		}
+		var own map[string]float64
+		if entry, ok := c.Genres.Lookup(genre.Genre); ok {
+			own = entry.QualityWeights
+			if len(own) == 0 && entry.Parent != "" {
+				if parent, ok := c.Genres.Lookup(entry.Parent); ok {
+					own = parent.QualityWeights
+				}
+			}
+		}
+		for _, metric := range qualityMetrics {
+			weight, ok := own[metric]
+			if !ok {
+				weight = 1
+			}
+			weights[metric] += weight * share
+		}
+	}
+	for metric, weight := range weights {
+		weights[metric] = round2(weight)
+	}
+	return weights
+}
+
+// genreBlendOf returns the genres a song was written in, dominant first
+func genreBlendOf(metadata LyricsMetadata) []GenreWeight {
+	if len(metadata.Genres) > 0 {
+		return metadata.Genres
+	}
+	return []GenreWeight{{Genre: metadata.Genre, Weight: 1}}
+}
+
+// distinctSections drops the repeats of a section, such as the second chorus
+func distinctSections(sections []LyricsSection) []LyricsSection {
+	seen := map[string]bool{}
+	var distinct []LyricsSection
+	for _, section := range sections {
+		key := section.Name + "\n" + strings.Join(section.Lines, "\n")
+		if !seen[key] {
+			seen[key] = true
+			distinct = append(distinct, section)
+		}
+	}
+	return distinct
+}
+
+// rhymeDensity is the share of lines whose ending rhymes with another line in the
+// same section
+func rhymeDensity(response LyricsResponse, sections []LyricsSection) float64 {
+	rhymed, total := 0, 0
+	for _, section := range sections {
+		scheme := rhymeScheme(section.Lines, response.sectionLanguage(section))
+		for _, letter := range scheme {
+			if strings.Count(scheme, string(letter)) > 1 {
+				rhymed++
+			}
+		}
+		total += len(scheme)
+	}
+	if total == 0 {
+		return 0
+	}
+	return round2(float64(rhymed) / float64(total))
+}
+
+// lexicalDiversity is the type-token ratio averaged over a moving window of words,
+// or over the whole text when it is shorter than the window
+func lexicalDiversity(sections []LyricsSection) float64 {
+	var words []string
+	for _, section := range sections {
+		for _, line := range section.Lines {
+			words = append(words, qualityWords(line)...)
+		}
+	}
+	if len(words) == 0 {
+		return 0
+	}
+	window := min(diversityWindow, len(words))
+	sum := 0.0
+	for start := 0; start+window <= len(words); start++ {
+		types := map[string]bool{}
+		for _, word := range words[start : start+window] {
+			types[word] = true
+		}
+		sum += float64(len(types)) / float64(window)
+	}
+	return round2(sum / float64(len(words)-window+1))
+}
+
+// qualityWords splits a line into lowercase words; each kanji or kana counts as a
+// word since Japanese is written without spaces
+func qualityWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(line) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana):
+			flush()
+			words = append(words, string(r))
+		case unicode.IsLetter(r) || r == '\'':
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+// findCliches lists the clichés of the song's languages found in the lyrics
+func findCliches(sections []LyricsSection, response LyricsResponse) []string {
+	languages := map[string]bool{response.Metadata.Language: true}
+	var text strings.Builder
+	text.WriteString(" ")
+	for _, section := range sections {
+		languages[response.sectionLanguage(section)] = true
+		for _, line := range section.Lines {
+			text.WriteString(strings.Join(qualityWords(line), " ") + " ")
+		}
+	}
+	for _, language := range response.Metadata.Languages {
+		languages[language.Language] = true
+	}
+
+	var found []string
+	for _, language := range sortedKeys(languages) {
+		for _, phrase := range cliches[language] {
+			if strings.Contains(text.String(), " "+strings.Join(qualityWords(phrase), " ")+" ") {
+				found = append(found, phrase)
+			}
+		}
+	}
+	return found
+}
+
+// lineLengthConsistency is one minus the coefficient of variation of the syllable
+// counts of each section's lines, averaged over the sections by their line count
+func lineLengthConsistency(response LyricsResponse, sections []LyricsSection) float64 {
+	sum, lines := 0.0, 0
+	for _, section := range sections {
+		if len(section.Lines) < 2 {
+			continue
+		}
+		language := response.sectionLanguage(section)
+		counts := make([]float64, len(section.Lines))
+		mean := 0.0
+		for i, line := range section.Lines {
+			counts[i] = float64(syllableCount(line, language))
+			mean += counts[i]
+		}
+		mean /= float64(len(counts))
+		if mean == 0 {
+			continue
+		}
+		variance := 0.0
+		for _, count := range counts {
+			variance += (count - mean) * (count - mean)
+		}
+		deviation := math.Sqrt(variance / float64(len(counts)))
+		sum += max(0, 1-deviation/mean) * float64(len(counts))
+		lines += len(counts)
+	}
+	if lines == 0 {
+		return 1
+	}
+	return round2(sum / float64(lines))
+}
+
+// repetitionBalance averages how well the chorus returns (once is half credit) with
+// the share of verse lines that are not repeated elsewhere in the song
+func repetitionBalance(sections []LyricsSection) float64 {
+	choruses := 0
+	lineCounts := map[string]int{}
+	var verseLines []string
+	for _, section := range sections {
+		name := normalizeSectionName(section.Name)
+		if strings.HasPrefix(name, "chorus") {
+			choruses++
+		}
+		for _, line := range section.Lines {
+			key := strings.Join(qualityWords(line), " ")
+			if key == "" {
+				continue
+			}
+			lineCounts[key]++
+			if strings.HasPrefix(name, "verse") {
+				verseLines = append(verseLines, key)
+			}
+		}
+	}
+
+	var parts []float64
+	if choruses > 0 {
+		parts = append(parts, min(1, float64(choruses)/2))
+	}
+	if len(verseLines) > 0 {
+		unique := 0
+		for _, line := range verseLines {
+			if lineCounts[line] == 1 {
+				unique++
+			}
+		}
+		parts = append(parts, float64(unique)/float64(len(verseLines)))
+	}
+	if len(parts) == 0 {
+		return 1
+	}
+	sum := 0.0
+	for _, part := range parts {
+		sum += part
+	}
+	return round2(sum / float64(len(parts)))
+}
+
+// keywordIntegration credits each keyword found in the title or chorus fully and one
+// found only elsewhere in the lyrics partly
+func keywordIntegration(lyrics GeneratedLyrics, keywords []string) float64 {
+	if len(keywords) == 0 {
+		return 1
+	}
+	hook := strings.ToLower(lyrics.Title)
+	var body string
+	for _, section := range lyrics.Sections {
+		text := strings.ToLower(strings.Join(section.Lines, "\n"))
+		if strings.HasPrefix(normalizeSectionName(section.Name), "chorus") {
+			hook += "\n" + text
+		} else {
+			body += "\n" + text
+		}
+	}
+
+	credit := 0.0
+	for _, keyword := range keywords {
+		keyword = strings.ToLower(strings.TrimSpace(keyword))
+		switch {
+		case keyword == "":
+		case strings.Contains(hook, keyword):
+			credit++
+		case strings.Contains(body, keyword):
+			credit += verseKeywordCredit
+		}
+	}
+	return round2(credit / float64(len(keywords)))
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// round2 rounds a score to two decimals
+func round2(value float64) float64 {
+	return math.Round(value*100) / 100
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func qualitySong(text string, genre string, keywords ...string) LyricsResponse {
+	service := &LyricsService{}
+	return LyricsResponse{
+		Lyrics:   service.parseLyrics(text, LyricsRequest{}),
+		Metadata: LyricsMetadata{Genre: genre, Language: "english", KeywordsUsed: keywords},
+	}
+}
+
+func TestScoreQuality(t *testing.T) {
+	song := qualitySong("[Title: Harbor Lights]\n"+
+		"[Verse 1]\nThe harbor sleeps beneath the rain\nI walk the pier and call again\nThe boats are rocking on the tide\nThe lamps are burning far and wide\n"+
+		"[Chorus]\nHarbor lights, carry me home\nHarbor lights, I'm not alone\n"+
+		"[Verse 2]\nThe morning breaks on silver sails\nThe wind is humming through the nails\nI kept your letter by my side\nAnd held it close on every ride\n"+
+		"[Chorus]\nHarbor lights, carry me home\nHarbor lights, I'm not alone",
+		"folk", "harbor", "letter", "storm")
+
+	quality := scoreQuality(DefaultCatalog(), song)
+	assert.Equal(t, 0.8, quality.RhymeDensity)
+	assert.Equal(t, []string{"by my side"}, quality.Cliches)
+	assert.Equal(t, 0.8, quality.Originality)
+	assert.Equal(t, 1.0, quality.RepetitionBalance)
+	// harbor is in the title and chorus, letter only in a verse and storm missing
+	assert.Equal(t, 0.58, quality.KeywordIntegration)
+	assert.Greater(t, quality.LexicalDiversity, 0.7)
+	assert.Greater(t, quality.LineLengthConsistency, 0.8)
+	assert.Equal(t, 1.5, quality.Weights[qualityOriginality])
+	assert.Equal(t, 1.0, quality.Weights[qualityRhymeDensity])
+	assert.InDelta(t, 0.81, quality.Score, 0.05)
+
+	// Scoring is deterministic
+	assert.Equal(t, quality, scoreQuality(DefaultCatalog(), song))
+}
+
+func TestQualitySubScores(t *testing.T) {
+	assert.Equal(t, 0.0, rhymeDensity(LyricsResponse{}, []LyricsSection{{Lines: []string{"Open road", "Quiet sky"}}}))
+	assert.Equal(t, 0.38, lexicalDiversity([]LyricsSection{{Lines: []string{"la la la la", "oh oh yeah yeah"}}}))
+	assert.Equal(t, 1.0, lexicalDiversity([]LyricsSection{{Lines: []string{"夜明けの道"}}}))
+	assert.Equal(t, 1.0, lineLengthConsistency(LyricsResponse{}, []LyricsSection{{Lines: []string{"Hum along", "Sing along"}}}))
+	assert.Less(t, lineLengthConsistency(LyricsResponse{}, []LyricsSection{{Lines: []string{"Go", "Everything is waiting at the edge of the world"}}}), 0.3)
+
+	// A chorus heard once gets half credit, and verse lines repeated elsewhere count against
+	assert.Equal(t, 0.38, repetitionBalance([]LyricsSection{
+		{Name: "verse 1", Lines: []string{"We run", "We hide"}},
+		{Name: "chorus", Lines: []string{"We run"}},
+		{Name: "verse 2", Lines: []string{"We hide", "We stay"}},
+	}))
+	assert.Equal(t, 1.0, keywordIntegration(GeneratedLyrics{}, nil))
+}
+
+func TestQualityWeights(t *testing.T) {
+	catalog := DefaultCatalog()
+	weights := catalog.qualityWeights([]GenreWeight{{Genre: "hip-hop", Weight: 1}})
+	assert.Equal(t, 2.0, weights[qualityRhymeDensity])
+	assert.Equal(t, 1.0, weights[qualityOriginality])
+	assert.Len(t, weights, len(qualityMetrics))
+
+	// Sub-genres use their root genre's weights, and blends mix them by share
+	assert.Equal(t, catalog.qualityWeights([]GenreWeight{{Genre: "pop", Weight: 1}}), catalog.qualityWeights([]GenreWeight{{Genre: "k-pop", Weight: 1}}))
+	blend := catalog.qualityWeights([]GenreWeight{{"folk", 0.6}, {"electronic", 0.4}})
+	assert.Equal(t, 1.1, blend[qualityLexicalDiversity])
+	assert.Equal(t, 1.4, blend[qualityRepetitionBalance])
+
+	_, err := LoadCatalog(writeConfigFile(t, "catalog.yaml", `
+genres:
+  - {id: pop, display_names: {en: Pop}, quality_weights: {rhyme: 2, originality: -1}}
+emotions:
+  - {id: happy, display_names: {en: Happy}}
+languages:
+  - {id: english, display_names: {en: English}}
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `genres: "pop" has unknown quality weight "rhyme"`)
+	assert.Contains(t, err.Error(), `"pop" has negative quality weight originality -1`)
+}
+
+func TestGenerateLyricsScoresQuality(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newTestGateway(t, "[Title: Home]\n[Verse 1]\nCity lights are calling\nStars above are falling\n[Chorus]\nWe are home tonight", &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+	req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(`{"keywords":["home"],"genre":"pop","emotion":"happy","language":"english"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response LyricsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.NotNil(t, response.Quality)
+	assert.Equal(t, 1.0, response.Quality.KeywordIntegration)
+	assert.Equal(t, 1.5, response.Quality.Weights[qualityKeywordIntegration])
+	assert.Greater(t, response.Quality.Score, 0.0)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Hepburn romanization of hiragana; katakana is mapped onto hiragana first
+var kanaRomaji = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o",
+	'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go",
+	'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo",
+	'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do",
+	'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho",
+	'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po",
+	'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo",
+	'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro",
+	'わ': "wa", 'ゐ': "i", 'ゑ': "e", 'を': "o", 'ん': "n", 'ゔ': "vu",
+	'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o", 'ゎ': "wa",
+}
+
+// Small kana that combine with the kana before them, as in "きゃ" (kya) and "ファ" (fa)
+var (
+	smallYa     = map[rune]string{'ゃ': "a", 'ゅ': "u", 'ょ': "o"}
+	smallVowels = map[rune]string{'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o"}
+)
+
+// Particles written with kana that are read differently
+var particleRomaji = map[rune]string{'は': "wa", 'へ': "e", 'を': "o", 'の': "no", 'が': "ga", 'に': "ni", 'で': "de", 'と': "to", 'も': "mo"}
+
+var cjkPunctuation = map[rune]string{
+	'、': ",", '。': ".", '！': "!", '？': "?", '「': `"`, '」': `"`, '『': `"`, '』': `"`,
+	'（': "(", '）': ")", '～': "~", '・': " ", '…': "...", '　': " ",
+}
+
+// Common readings of kanji and kanji words found in lyrics. Readings depend on
+// context, so romanized kanji are best effort; kanji missing here are left as is.
+var kanjiReadings = map[string]string{
+	"明日": "ashita", "今日": "kyou", "昨日": "kinou", "未来": "mirai", "世界": "sekai", "永遠": "eien",
+	"笑顔": "egao", "季節": "kisetsu", "景色": "keshiki", "瞬間": "shunkan", "記憶": "kioku", "約束": "yakusoku",
+	"運命": "unmei", "奇跡": "kiseki", "勇気": "yuuki", "希望": "kibou", "自由": "jiyuu", "一人": "hitori",
+	"二人": "futari", "今": "ima", "夜明け": "yoake", "朝日": "asahi", "夕日": "yuuhi", "青空": "aozora",
+	"大切": "taisetsu", "最後": "saigo", "最初": "saisho", "東京": "toukyou", "桜": "sakura", "心": "kokoro",
+	"愛": "ai", "恋": "koi", "夢": "yume", "空": "sora", "光": "hikari", "夜": "yoru", "朝": "asa",
+	"星": "hoshi", "月": "tsuki", "日": "hi", "君": "kimi", "僕": "boku", "私": "watashi", "俺": "ore",
+	"涙": "namida", "花": "hana", "風": "kaze", "雨": "ame", "雪": "yuki", "海": "umi", "川": "kawa",
+	"道": "michi", "街": "machi", "声": "koe", "歌": "uta", "手": "te", "胸": "mune", "瞳": "hitomi",
+	"目": "me", "髪": "kami", "影": "kage", "色": "iro", "音": "oto", "時": "toki", "春": "haru",
+	"夏": "natsu", "秋": "aki", "冬": "fuyu", "虹": "niji", "鳥": "tori", "翼": "tsubasa", "扉": "tobira",
+	"窓": "mado", "家": "ie", "雲": "kumo", "森": "mori", "火": "hi", "水": "mizu", "嘘": "uso",
+	"人": "hito", "力": "chikara", "命": "inochi", "想い": "omoi", "思い": "omoi", "願い": "negai", "明": "a",
+	"歩": "aru", "走": "hashi", "泣": "na", "笑": "wara", "会": "a", "見": "mi", "行": "i", "帰": "kae",
+	"思": "omo", "想": "omo", "信": "shin", "忘": "wasu", "抱": "da", "輝": "kagaya", "響": "hibi",
+	"届": "todo", "生": "i", "歌う": "utau", "踊": "odo", "飛": "to", "咲": "sa", "叶": "kana",
+	"守": "mamo", "待": "ma", "消": "ki", "溢": "afu", "始": "haji", "終": "o", "探": "saga",
+	"知": "shi", "言": "i", "聞": "ki", "話": "hana", "遠": "too", "近": "chika", "強": "tsuyo",
+	"弱": "yowa", "優": "yasa", "新": "atara", "古": "furu", "長": "naga", "高": "taka", "深": "fuka",
+	"青": "ao", "赤": "aka", "白": "shiro", "黒": "kuro", "暗": "kura", "熱": "atsu", "冷": "tsume",
+	"寂": "sabi", "悲": "kana", "嬉": "ureshi", "楽": "tano", "恋し": "koishi", "一": "ichi", "何": "nani",
+}
+
+// maxKanjiWord is the length of the longest entry in kanjiReadings, in characters
+const maxKanjiWord = 3
+
+// Revised Romanization of Korean initial consonants, vowels and final consonants, in
+// Unicode Hangul syllable order
+var (
+	hangulInitials = []string{"g", "kk", "n", "d", "tt", "r", "m", "b", "pp", "s", "ss", "", "j", "jj", "ch", "k", "t", "p", "h"}
+	hangulVowels   = []string{"a", "ae", "ya", "yae", "eo", "e", "yeo", "ye", "o", "wa", "wae", "oe", "yo", "u", "wo", "we", "wi", "yu", "eu", "ui", "i"}
+	hangulFinals   = []string{"", "k", "k", "k", "n", "n", "n", "t", "l", "k", "m", "l", "l", "l", "p", "l", "m", "p", "p", "t", "t", "ng", "t", "t", "k", "t", "p", "t"}
+
+	// hangulLiaison splits a final consonant before a syllable starting with the
+	// silent ㅇ: what stays at the end of the syllable and what starts the next one
+	hangulLiaison = [][2]string{
+		{"", ""}, {"", "g"}, {"", "kk"}, {"k", "s"}, {"", "n"}, {"n", "j"}, {"", "n"}, {"", "d"},
+		{"", "r"}, {"l", "g"}, {"l", "m"}, {"l", "b"}, {"l", "s"}, {"l", "t"}, {"l", "p"}, {"", "r"},
+		{"", "m"}, {"", "b"}, {"p", "s"}, {"", "s"}, {"", "ss"}, {"ng", ""}, {"", "j"}, {"", "ch"},
+		{"", "k"}, {"", "t"}, {"", "p"}, {"", ""},
+	}
+)
+
+const (
+	hangulBase       = 0xAC00
+	hangulLast       = 0xD7A3
+	hangulSilent     = 11 // ㅇ as an initial
+	hangulInitialN   = 2  // ㄴ
+	hangulInitialR   = 5  // ㄹ
+	hangulInitialM   = 6  // ㅁ
+	hangulFinalH     = 27 // ㅎ as a final
+	hangulFinalCount = 28
+)
+
+// aspirated maps the initials that a preceding ㅎ aspirates to their romanization
+var aspirated = map[string]string{"g": "k", "d": "t", "j": "ch"}
+
+// Romanization reports what a song's romanization covered
+type Romanization struct {
+	// KanjiLines is the number of lines with kanji, which are romanized best effort
+	KanjiLines int
+	// UnknownKanji is the number of kanji left as is for lack of a reading
+	UnknownKanji int
+}
+
+// romanizeSections adds a romanized line for every line of Japanese or Korean text,
+// leaving it empty for lines that need none
+func romanizeSections(sections []LyricsSection) Romanization {
+	var result Romanization
+	for i := range sections {
+		romanized := make([]string, len(sections[i].Lines))
+		needed := false
+		for j, line := range sections[i].Lines {
+			if !hasCJK(line) {
+				continue
+			}
+			text, kanji, unknown := romanizeLine(line)
+			if text != line {
+				romanized[j] = text
+				needed = true
+			}
+			if kanji {
+				result.KanjiLines++
+			}
+			result.UnknownKanji += unknown
+		}
+		if needed {
+			sections[i].Romanized = romanized
+		}
+	}
+	return result
+}
+
+// romanizedLine returns the romanization of the section's i-th line, or "" if it has none
+func (s LyricsSection) romanizedLine(i int) string {
+	if i < len(s.Romanized) {
+		return s.Romanized[i]
+	}
+	return ""
+}
+
+// Warning returns the warning that kanji were romanized best effort, if any were
+func (r Romanization) Warning() *Warning {
+	if r.KanjiLines == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("Kanji in %d lines were romanized from common readings, which may not fit the context.", r.KanjiLines)
+	if r.UnknownKanji > 0 {
+		message += fmt.Sprintf(" %d kanji had no known reading and were left as is.", r.UnknownKanji)
+	}
+	return &Warning{Code: "romanization_best_effort", Message: message}
+}
+
+// romanizeLine romanizes the Japanese and Korean text of a line, leaving other text
+// as is. It reports whether the line had kanji and how many had no known reading.
+func romanizeLine(line string) (text string, kanji bool, unknownKanji int) {
+	var b strings.Builder
+	for _, token := range japaneseTokens([]rune(line)) {
+		switch {
+		case unicode.Is(unicode.Han, token[0]):
+			kanji = true
+			romaji, unknown := romanizeKanji(token)
+			unknownKanji += unknown
+			writeWord(&b, romaji)
+		case isKana(token[0]):
+			if reading, ok := particleRomaji[token[0]]; ok && len(token) == 1 && b.Len() > 0 {
+				writeWord(&b, reading)
+			} else {
+				writeWord(&b, romanizeKana(token))
+			}
+		case isHangulSyllable(token[0]):
+			b.WriteString(romanizeHangul(token))
+		default:
+			for _, r := range token {
+				if punctuation, ok := cjkPunctuation[r]; ok {
+					b.WriteString(punctuation)
+				} else {
+					b.WriteRune(r)
+				}
+			}
+		}
+	}
+	return strings.TrimSpace(strings.Join(strings.Fields(b.String()), " ")), kanji, unknownKanji
+}
+
+// writeWord writes a romanized Japanese word, separated from a preceding word
+func writeWord(b *strings.Builder, word string) {
+	if s := b.String(); s != "" && !strings.HasSuffix(s, " ") && !strings.HasSuffix(s, `"`) && !strings.HasSuffix(s, "(") {
+		b.WriteString(" ")
+	}
+	b.WriteString(word)
+}
+
+// hasCJK reports whether text has kana, kanji or Hangul to romanize
+func hasCJK(text string) bool {
+	return strings.IndexFunc(text, func(r rune) bool {
+		return isKana(r) || unicode.Is(unicode.Han, r) || isHangulSyllable(r)
+	}) >= 0
+}
+
+// isHangulSyllable reports whether r is a precomposed Hangul syllable; lone jamo
+// are left as is
+func isHangulSyllable(r rune) bool {
+	return r >= hangulBase && r <= hangulLast
+}
+
+func isKana(r rune) bool {
+	return unicode.In(r, unicode.Hiragana, unicode.Katakana) || r == 'ー'
+}
+
+// japaneseTokens splits text into runs of kanji with their okurigana, runs of kana,
+// runs of Hangul and runs of anything else. Japanese has no spaces, so words are
+// split where kana is followed by kanji or katakana, and a particle such as "の" or
+// "を" that precedes them is split off on its own.
+func japaneseTokens(runes []rune) [][]rune {
+	class := func(r rune) int {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			return 1
+		case unicode.Is(unicode.Hiragana, r):
+			return 2
+		case unicode.Is(unicode.Katakana, r) || r == 'ー':
+			return 3
+		case isHangulSyllable(r):
+			return 4
+		default:
+			return 0
+		}
+	}
+
+	var tokens [][]rune
+	start := 0
+	for i := 1; i <= len(runes); i++ {
+		if i < len(runes) {
+			previous, current := class(runes[i-1]), class(runes[i])
+			// Okurigana stays with its kanji, so only kana to kanji or katakana, and
+			// changes to or from other scripts, start a new token. を is only ever a
+			// particle, so kana after it starts a new word too.
+			joined := (previous == current || previous == 1 && current == 2) && runes[i-1] != 'を'
+			if joined {
+				continue
+			}
+		}
+		token := runes[start:i]
+		// Split a trailing particle off a kana run that is followed by a new word
+		if n := len(token); n > 1 && i < len(runes) && class(token[n-1]) == 2 && class(runes[i]) != 0 {
+			if _, ok := particleRomaji[token[n-1]]; ok {
+				tokens = append(tokens, token[:n-1], token[n-1:])
+				start = i
+				continue
+			}
+		}
+		tokens = append(tokens, token)
+		start = i
+	}
+	return tokens
+}
+
+// romanizeKanji reads a run of kanji and okurigana from the longest matching entries
+// of kanjiReadings, and returns how many kanji were left as is
+func romanizeKanji(token []rune) (string, int) {
+	var b strings.Builder
+	unknown := 0
+	for i := 0; i < len(token); {
+		if !unicode.Is(unicode.Han, token[i]) {
+			end := i
+			for end < len(token) && !unicode.Is(unicode.Han, token[end]) {
+				end++
+			}
+			b.WriteString(romanizeKana(token[i:end]))
+			i = end
+			continue
+		}
+
+		matched := false
+		for length := min(maxKanjiWord, len(token)-i); length > 0; length-- {
+			if reading, ok := kanjiReadings[string(token[i:i+length])]; ok {
+				b.WriteString(reading)
+				i += length
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			b.WriteRune(token[i])
+			unknown++
+			i++
+		}
+	}
+	return b.String(), unknown
+}
+
+// romanizeKana writes kana in Hepburn romanization: small ゃゅょ form digraphs, a
+// small っ doubles the next consonant, ー repeats the previous vowel and ん is written
+// "n'" before a vowel or y
+func romanizeKana(kana []rune) string {
+	var b strings.Builder
+	geminate := false
+	for i := 0; i < len(kana); i++ {
+		r := kana[i]
+		if r >= 'ァ' && r <= 'ヶ' {
+			r -= 'ァ' - 'ぁ'
+		}
+
+		switch {
+		case r == 'っ':
+			geminate = true
+			continue
+		case r == 'ー':
+			if s := b.String(); s != "" {
+				b.WriteByte(s[len(s)-1])
+			}
+			continue
+		}
+
+		romaji, ok := kanaRomaji[r]
+		if !ok {
+			b.WriteRune(kana[i])
+			continue
+		}
+		if i+1 < len(kana) {
+			next := kana[i+1]
+			if next >= 'ァ' && next <= 'ヶ' {
+				next -= 'ァ' - 'ぁ'
+			}
+			if vowel, ok := smallYa[next]; ok && strings.HasSuffix(romaji, "i") && len(romaji) > 1 {
+				if stem := strings.TrimSuffix(romaji, "i"); stem == "sh" || stem == "ch" || stem == "j" {
+					romaji = stem + vowel
+				} else {
+					romaji = stem + "y" + vowel
+				}
+				i++
+			} else if vowel, ok := smallVowels[next]; ok && r != next {
+				stem := strings.TrimRight(romaji, "aiueo")
+				if stem == "" {
+					stem = "w"
+				}
+				romaji = stem + vowel
+				i++
+			}
+		}
+
+		if geminate {
+			if strings.HasPrefix(romaji, "ch") {
+				b.WriteString("t")
+			} else if !strings.ContainsAny(romaji[:1], "aiueon") {
+				b.WriteByte(romaji[0])
+			}
+			geminate = false
+		}
+		if r == 'ん' && i+1 < len(kana) {
+			if next, ok := kanaRomaji[kana[i+1]]; ok && strings.ContainsAny(next[:1], "aiueoy") {
+				romaji = "n'"
+			}
+		}
+		b.WriteString(romaji)
+	}
+	return b.String()
+}
+
+// romanizeHangul writes a run of Hangul syllables in Revised Romanization, carrying
+// final consonants over to a following silent ㅇ and applying the common sound
+// changes between syllables
+func romanizeHangul(syllables []rune) string {
+	type jamo struct{ initial, vowel, final int }
+	parts := make([]jamo, len(syllables))
+	for i, r := range syllables {
+		index := int(r - hangulBase)
+		parts[i] = jamo{index / (21 * hangulFinalCount), index / hangulFinalCount % 21, index % hangulFinalCount}
+	}
+
+	var b strings.Builder
+	onset := ""
+	for i, part := range parts {
+		if i == 0 {
+			onset = hangulInitials[part.initial]
+		}
+		coda := hangulFinals[part.final]
+		nextOnset := ""
+		if i+1 < len(parts) {
+			next := parts[i+1]
+			nextOnset = hangulInitials[next.initial]
+			switch {
+			case next.initial == hangulSilent && part.final != 0:
+				coda, nextOnset = hangulLiaison[part.final][0], hangulLiaison[part.final][1]
+			case part.final == hangulFinalH && aspirated[nextOnset] != "":
+				// ㅎ aspirates the consonant that follows, as in 좋다 (jota)
+				coda, nextOnset = "", aspirated[nextOnset]
+			case next.initial == hangulInitialN || next.initial == hangulInitialM:
+				// Nasalization, as in 합니다 (hamnida)
+				switch coda {
+				case "k":
+					coda = "ng"
+				case "t":
+					coda = "n"
+				case "p":
+					coda = "m"
+				}
+			case next.initial == hangulInitialR:
+				switch coda {
+				case "l", "n":
+					coda, nextOnset = "l", "l"
+				case "m", "ng":
+					nextOnset = "n"
+				}
+			}
+		}
+		b.WriteString(onset + hangulVowels[part.vowel] + coda)
+		onset = nextOnset
+	}
+	return b.String()
+}
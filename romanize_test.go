@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRomanizeKana(t *testing.T) {
+	tests := map[string]string{
+		"さくら":      "sakura",
+		"きみをまってる":  "kimi o matteru",
+		"ずっといっしょ":  "zuttoissho",
+		"ちょっとまって":  "chottomatte",
+		"まっちゃ":     "matcha",
+		"しんや":      "shin'ya",
+		"コーヒーとケーキ": "koohii to keeki",
+		"ファンタジー":   "fantajii",
+		"ウィンター":    "wintaa",
+		"こえ、きこえる！": "koe, kikoeru!",
+		"「ゆめ」":     `"yume"`,
+	}
+	for kana, want := range tests {
+		got, kanji, _ := romanizeLine(kana)
+		assert.Equal(t, want, got, kana)
+		assert.False(t, kanji, kana)
+	}
+}
+
+func TestRomanizeHangul(t *testing.T) {
+	tests := map[string]string{
+		"사랑해요":         "saranghaeyo",
+		"별빛 아래 우리는 함께": "byeolbit arae urineun hamkke",
+		"좋아":           "joa",
+		"좋다":           "jota",
+		"합니다":          "hamnida",
+		"읽어요":          "ilgeoyo",
+		"신라":           "silla",
+		"종로":           "jongno",
+		"Love 너를":      "Love neoreul",
+	}
+	for hangul, want := range tests {
+		got, _, _ := romanizeLine(hangul)
+		assert.Equal(t, want, got, hangul)
+	}
+}
+
+func TestRomanizeKanjiIsBestEffort(t *testing.T) {
+	got, kanji, unknown := romanizeLine("夜明けの道を歩いていく")
+	assert.Equal(t, "yoake no michi o aruiteiku", got)
+	assert.True(t, kanji)
+	assert.Zero(t, unknown)
+
+	got, _, unknown = romanizeLine("君は鬱")
+	assert.Equal(t, "kimi wa 鬱", got)
+	assert.Equal(t, 1, unknown)
+
+	sections := []LyricsSection{
+		{Name: "verse 1", Lines: []string{"君の声", "Hello"}},
+		{Name: "chorus", Lines: []string{"Oh oh"}},
+	}
+	result := romanizeSections(sections)
+	assert.Equal(t, []string{"kimi no koe", ""}, sections[0].Romanized)
+	assert.Nil(t, sections[1].Romanized)
+	require.NotNil(t, result.Warning())
+	assert.Equal(t, "romanization_best_effort", result.Warning().Code)
+
+	assert.Nil(t, romanizeSections([]LyricsSection{{Name: "verse 1", Lines: []string{"さくら"}}}).Warning())
+}
+
+func TestExportIncludesRomanizedLines(t *testing.T) {
+	service := &LyricsService{store: NewLyricsStore(10)}
+	lyrics := service.parseLyrics("[Title: Sakura]\n[Verse 1]\nさくら さくら\n[Chorus]\nHey", LyricsRequest{})
+	romanizeSections(lyrics.Sections)
+	response := &LyricsResponse{ID: "song-1", Lyrics: lyrics, Metadata: LyricsMetadata{Language: "japanese"}}
+	service.store.Save(response, LyricsRequest{})
+	song, _ := service.store.Get("song-1")
+
+	assert.Contains(t, renderChordPro(song), "{start_of_verse: Verse 1}\nさくら さくら\nsakura sakura\n{end_of_verse}\n")
+	assert.Contains(t, renderMarkdown(song), "\n## Verse 1\n\nさくら さくら  \n*sakura sakura*  \n\n## Chorus\n\nHey  \n")
+	assert.Contains(t, renderPlainText(song), "[Verse 1]\nさくら さくら\nsakura sakura\n")
+	assert.Contains(t, renderLRC(song), "[00:00.00]さくら さくら\n[00:00.00]sakura sakura\n[00:00.00]\n[00:00.00]Hey\n")
+	assert.Contains(t, pdfContents(t, renderPDF(song, exportOptions{Columns: 1}))[0], "/F3 11.0 Tf "+pdfHex("sakura sakura"))
+}
+
+func TestGenerateLyricsRomanizes(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newTestGateway(t, "[Title: 夢]\n[Verse 1]\n君の夢\n[Chorus]\n사랑해요", &requests)
+	service := newTestLyricsService(t, gateway.URL)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+	generate := func(body string) LyricsResponse {
+		req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response LyricsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := generate(`{"keywords":["dream"],"genre":"pop","emotion":"hopeful","language":"japanese"}`)
+	assert.Nil(t, response.Lyrics.Sections[0].Romanized)
+	// The Korean chorus is flagged in a Japanese song, and the retry repeats it
+	require.Len(t, response.Warnings, 1)
+	assert.Equal(t, "language_mismatch", response.Warnings[0].Code)
+
+	response = generate(`{"keywords":["dream"],"genre":"pop","emotion":"hopeful","language":"japanese","romanize":true}`)
+	assert.Equal(t, []string{"kimi no yume"}, response.Lyrics.Sections[0].Romanized)
+	assert.Equal(t, []string{"saranghaeyo"}, response.Lyrics.Sections[1].Romanized)
+	// The same lyrics again are only flagged as a near-duplicate by default
+	var codes []string
+	for _, warning := range response.Warnings {
+		codes = append(codes, warning.Code)
+	}
+	assert.Equal(t, []string{"language_mismatch", "near_duplicate", "romanization_best_effort"}, codes)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	zerologlog "github.com/rs/zerolog/log"
+)
+
+// ClientCredentials holds the secrets used to authenticate at the token endpoint
+type ClientCredentials struct {
+	ClientID     string
+	ClientSecret string
+	SigningKey   crypto.Signer
+	SigningKeyID string
+}
+
+// Credentials returns the credentials currently used by the client
+func (o *OAuthClient) Credentials() ClientCredentials {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	return o.credentials
+}
+
+// RotateCredentials validates the new credentials by fetching a token with them and
+// only then swaps them in, together with the new token. Requests already in flight
+// keep the token they were sent with; on failure the old credentials stay active.
+func (o *OAuthClient) RotateCredentials(ctx context.Context, creds ClientCredentials) error {
+	tokenResp, err := o.requestNewToken(ctx, creds)
+	if err != nil {
+		return fmt.Errorf("new credentials rejected by token endpoint: %w", err)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.credentials = creds
+	o.storeToken(tokenResp)
+	o.rotations++
+
+	zerologlog.Info().
+		Str("client_id", sanitizeForLogging(creds.ClientID)).
+		Msg("Rotated OAuth client credentials")
+
+	return nil
+}
+
+// CredentialWatcher polls mounted secret files and rotates the OAuth client
+// credentials when their contents change
+type CredentialWatcher struct {
+	oauthClient    *OAuthClient
+	clientIDFile   string
+	secretFile     string
+	privateKeyFile string
+	interval       time.Duration
+
+	// Fingerprints of the file contents behind the active credentials
+	fingerprints map[string][]byte
+}
+
+// NewCredentialWatcher creates a watcher for the given files; empty paths are ignored
+func NewCredentialWatcher(oauthClient *OAuthClient, clientIDFile, secretFile, privateKeyFile string, interval time.Duration) *CredentialWatcher {
+	w := &CredentialWatcher{
+		oauthClient:    oauthClient,
+		clientIDFile:   clientIDFile,
+		secretFile:     secretFile,
+		privateKeyFile: privateKeyFile,
+		interval:       interval,
+		fingerprints:   map[string][]byte{},
+	}
+	for _, path := range w.files() {
+		if sum, err := fileFingerprint(path); err == nil {
+			w.fingerprints[path] = sum
+		}
+	}
+	return w
+}
+
+// Enabled reports whether any credential is loaded from a file
+func (w *CredentialWatcher) Enabled() bool {
+	return len(w.files()) > 0
+}
+
+// Run polls the secret files until ctx is cancelled
+func (w *CredentialWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.check(ctx); err != nil {
+				zerologlog.Error().Err(err).Msg("Credential rotation failed, keeping current credentials")
+			}
+		}
+	}
+}
+
+// check rotates the credentials if any watched file changed. Fingerprints are only
+// updated after a successful rotation, so a rejected secret is retried on the next poll.
+func (w *CredentialWatcher) check(ctx context.Context) error {
+	changed := map[string][]byte{}
+	for _, path := range w.files() {
+		sum, err := fileFingerprint(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, w.fingerprints[path]) {
+			changed[path] = sum
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	creds := w.oauthClient.Credentials()
+	if w.clientIDFile != "" {
+		value, err := readTrimmedFile(w.clientIDFile)
+		if err != nil {
+			return err
+		}
+		creds.ClientID = value
+	}
+	if w.secretFile != "" {
+		value, err := readTrimmedFile(w.secretFile)
+		if err != nil {
+			return err
+		}
+		creds.ClientSecret = value
+	}
+	if w.privateKeyFile != "" {
+		if _, ok := changed[w.privateKeyFile]; ok {
+			key, err := LoadPrivateKeyPEM(w.privateKeyFile)
+			if err != nil {
+				return err
+			}
+			creds.SigningKey = key
+		}
+	}
+
+	zerologlog.Info().Int("changed_files", len(changed)).Msg("Detected credential file change, validating new credentials")
+
+	if err := w.oauthClient.RotateCredentials(ctx, creds); err != nil {
+		return err
+	}
+	for path, sum := range changed {
+		w.fingerprints[path] = sum
+	}
+	return nil
+}
+
+// files returns the configured secret files
+func (w *CredentialWatcher) files() []string {
+	var files []string
+	for _, path := range []string{w.clientIDFile, w.secretFile, w.privateKeyFile} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+func readTrimmedFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func fileFingerprint(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret file: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSecretCheckingTokenServer issues a token named after the secret it accepts
+func newSecretCheckingTokenServer(t *testing.T, accepted *atomic.Value) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("client_secret") != accepted.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(OAuthTokenResponse{Error: "invalid_client"})
+			return
+		}
+		json.NewEncoder(w).Encode(OAuthTokenResponse{
+			AccessToken: "token-for-" + r.PostForm.Get("client_secret"),
+			ExpiresIn:   3600,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRotateCredentialsValidatesBeforeSwapping(t *testing.T) {
+	var accepted atomic.Value
+	accepted.Store("old")
+	server := newSecretCheckingTokenServer(t, &accepted)
+	client := NewOAuthClient(server.URL, "id", "old", "")
+
+	token, err := client.GetAccessToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-for-old", token)
+
+	// The provider does not know the new secret yet: keep the old one
+	err = client.RotateCredentials(context.Background(), ClientCredentials{ClientID: "id", ClientSecret: "new"})
+	assert.Error(t, err)
+	assert.Equal(t, "old", client.Credentials().ClientSecret)
+
+	accepted.Store("new")
+	err = client.RotateCredentials(context.Background(), ClientCredentials{ClientID: "id", ClientSecret: "new"})
+	assert.NoError(t, err)
+	assert.Equal(t, "new", client.Credentials().ClientSecret)
+
+	token, err = client.GetAccessToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-for-new", token)
+	assert.Equal(t, int64(1), client.Stats().Rotations)
+}
+
+func TestCredentialWatcherRotatesOnFileChange(t *testing.T) {
+	var accepted atomic.Value
+	accepted.Store("old")
+	server := newSecretCheckingTokenServer(t, &accepted)
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("old"), 0o600))
+
+	client := NewOAuthClient(server.URL, "id", "old", "")
+	watcher := NewCredentialWatcher(client, "", secretFile, "", 0)
+	assert.True(t, watcher.Enabled())
+
+	// Unchanged file: nothing to do
+	assert.NoError(t, watcher.check(context.Background()))
+	assert.Equal(t, int64(0), client.Stats().Rotations)
+
+	// Rejected secret is retried on the next poll
+	require.NoError(t, os.WriteFile(secretFile, []byte("new\n"), 0o600))
+	assert.Error(t, watcher.check(context.Background()))
+	assert.Equal(t, "old", client.Credentials().ClientSecret)
+
+	accepted.Store("new")
+	assert.NoError(t, watcher.check(context.Background()))
+	assert.Equal(t, "new", client.Credentials().ClientSecret)
+	assert.Equal(t, int64(1), client.Stats().Rotations)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLyricsSignatureSimilarity(t *testing.T) {
+	song := []LyricsSection{
+		{Name: "verse 1", Lines: []string{"The harbor sleeps beneath the rain", "I walk the pier and call again"}},
+		{Name: "chorus", Lines: []string{"Harbor lights, carry me home", "Harbor lights, I'm not alone"}},
+	}
+	edited := []LyricsSection{
+		{Name: "verse 1", Lines: []string{"The harbor sleeps beneath the rain", "I walk the pier and call your name"}},
+		{Name: "chorus", Lines: []string{"Harbor lights, carry me home", "Harbor lights, I'm not alone"}},
+		{Name: "chorus", Lines: []string{"Harbor lights, carry me home", "Harbor lights, I'm not alone"}},
+	}
+	other := []LyricsSection{{Name: "verse 1", Lines: []string{"Neon signs are flashing bright", "We dance until the morning light"}}}
+
+	signature := lyricsSignature(song)
+	assert.Equal(t, 1.0, signature.similarity(lyricsSignature(song)))
+	assert.Greater(t, signature.similarity(lyricsSignature(edited)), 0.6)
+	assert.Less(t, signature.similarity(lyricsSignature(other)), 0.1)
+	assert.Nil(t, lyricsSignature([]LyricsSection{{Lines: []string{"...", ""}}}))
+	assert.Zero(t, signature.similarity(nil))
+}
+
+func TestLyricsStoreNearest(t *testing.T) {
+	store := NewLyricsStore(2)
+	song := func(id string, lines ...string) *LyricsResponse {
+		return &LyricsResponse{ID: id, Lyrics: GeneratedLyrics{Title: id, Sections: []LyricsSection{{Name: "verse 1", Lines: lines}}}}
+	}
+	harbor := []string{"The harbor sleeps beneath the rain", "I walk the pier and call again"}
+	store.Save(song("a", harbor...), LyricsRequest{})
+	store.Save(song("b", "Neon signs are flashing bright", "We dance until the morning light"), LyricsRequest{})
+
+	match := store.Nearest(lyricsSignature([]LyricsSection{{Lines: harbor}}))
+	require.NotNil(t, match)
+	assert.Equal(t, SimilarMatch{Source: matchSourceGenerated, ID: "a", Title: "a", Similarity: 1}, *match)
+	assert.Nil(t, store.Nearest(lyricsSignature([]LyricsSection{{Lines: []string{"Something else entirely", "Nothing in common here"}}})))
+
+	// The most recent song wins a tie, and evicted songs leave the index
+	store.Save(song("c", harbor...), LyricsRequest{})
+	assert.Equal(t, "c", store.Nearest(lyricsSignature([]LyricsSection{{Lines: harbor}})).ID)
+	store.Save(song("d", "Quiet fields under winter snow"), LyricsRequest{})
+	store.Save(song("e", "Another quiet song of spring"), LyricsRequest{})
+	assert.Nil(t, store.Nearest(lyricsSignature([]LyricsSection{{Lines: harbor}})))
+	assert.Len(t, store.bands, 2*lshBands)
+}
+
+func TestLoadCorpus(t *testing.T) {
+	corpus, err := LoadCorpus(writeConfigFile(t, "corpus.yaml", `
+songs:
+  - id: harbor
+    title: Harbor Lights
+    artist: The Pier
+    lyrics: |
+      [Verse 1]
+      The harbor sleeps beneath the rain
+      I walk the pier and call again
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 1, corpus.Len())
+	match := corpus.Nearest(lyricsSignature([]LyricsSection{{Lines: []string{"The harbor sleeps beneath the rain", "I walk the pier and call again"}}}))
+	require.NotNil(t, match)
+	assert.Equal(t, SimilarMatch{Source: matchSourceCorpus, ID: "harbor", Title: "Harbor Lights", Artist: "The Pier", Similarity: 1}, *match)
+
+	corpus, err = LoadCorpus("")
+	require.NoError(t, err)
+	assert.Nil(t, corpus.Nearest(lyricsSignature([]LyricsSection{{Lines: []string{"Anything at all"}}})))
+
+	_, err = LoadCorpus(writeConfigFile(t, "corpus.yaml", `
+songs:
+  - {lyrics: "No id here"}
+  - {id: a, lyrics: "First song"}
+  - {id: a, lyrics: "Second song"}
+  - {id: b, lyrics: "[Chorus]"}
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "songs[0]: id is required")
+	assert.Contains(t, err.Error(), `songs[2]: id "a" is used twice`)
+	assert.Contains(t, err.Error(), `songs[3]: "b" has no lyrics`)
+}
+
+func TestGenerateLyricsRegeneratesNearDuplicates(t *testing.T) {
+	first := "[Title: Harbor]\n[Verse 1]\nThe harbor sleeps beneath the rain\nI walk the pier and call again\n[Chorus]\nHarbor lights, carry me home"
+	fresh := "[Title: Neon]\n[Verse 1]\nNeon signs are flashing bright\nWe dance until the morning light\n[Chorus]\nCity hearts, carry me home"
+	known := "[Title: Known]\n[Verse 1]\nOld river rolling to the sea\nCarry my troubles far from me\n[Chorus]\nRoll on, roll on"
+	var requests []map[string]interface{}
+	gateway := newSequenceGateway(t, []gatewayReply{{first, "stop"}, {first, "stop"}, {fresh, "stop"}, {known, "stop"}}, &requests)
+	service := newTestLyricsService(t, gateway.URL)
+	settings := *service.Settings()
+	settings.Similarity.Action = similarityRegenerate
+	service.ApplySettings(&settings)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate", generateLyrics(service))
+	generate := func() LyricsResponse {
+		req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(`{"keywords":["harbor"],"genre":"folk","emotion":"peaceful","language":"english"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response LyricsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	original := generate()
+	assert.Nil(t, original.Metadata.NearestMatch)
+
+	// The same lyrics again are regenerated, and the new ones kept
+	response := generate()
+	require.Len(t, requests, 3)
+	messages := requests[2]["messages"].([]interface{})
+	assert.Equal(t, duplicateRetryPrompt, messages[len(messages)-1].(map[string]interface{})["content"])
+	assert.Equal(t, "Neon", response.Lyrics.Title)
+	assert.Equal(t, 1, response.Metadata.DuplicateRetries)
+	assert.False(t, service.Settings().isDuplicate(response.Metadata.NearestMatch))
+	assert.Empty(t, response.Warnings)
+
+	// In warn mode a corpus match is returned with a warning
+	corpus, err := LoadCorpus(writeConfigFile(t, "corpus.yaml", `
+songs:
+  - id: river
+    title: Old River
+    artist: Traditional
+    lyrics: |
+      Old river rolling to the sea
+      Carry my troubles far from me
+      Roll on, roll on
+`))
+	require.NoError(t, err)
+	settings = *service.Settings()
+	settings.Similarity.Action = similarityWarn
+	settings.Corpus = corpus
+	service.ApplySettings(&settings)
+	response = generate()
+	assert.Len(t, requests, 4)
+	require.NotNil(t, response.Metadata.NearestMatch)
+	assert.Equal(t, SimilarMatch{Source: matchSourceCorpus, ID: "river", Title: "Old River", Artist: "Traditional", Similarity: 1}, *response.Metadata.NearestMatch)
+	require.Len(t, response.Warnings, 1)
+	assert.Equal(t, "near_duplicate", response.Warnings[0].Code)
+	assert.Contains(t, response.Warnings[0].Message, `100% similar to "Old River" by Traditional (corpus)`)
+}
+
+func TestGenerateLyricsChecksDuplicatesAfterLanguageRetry(t *testing.T) {
+	first := "[Title: Harbor]\n[Verse 1]\nThe harbor sleeps beneath the rain\nI walk the pier and call again\n[Chorus]\nHarbor lights, carry me home"
+	spanish := "[Title: Mar]\n[Verse 1]\nQuiero estar contigo\nEn la orilla del mar hasta el amanecer\n[Chorus]\nLuces del puerto, llévame a casa esta noche"
+	fresh := "[Title: Neon]\n[Verse 1]\nNeon signs are flashing bright\nWe dance until the morning light\n[Chorus]\nCity hearts, carry me home"
+	var requests []map[string]interface{}
+	gateway := newSequenceGateway(t, []gatewayReply{{first, "stop"}, {spanish, "stop"}, {first, "stop"}, {fresh, "stop"}}, &requests)
+	service := newTestLyricsService(t, gateway.URL)
+	settings := *service.Settings()
+	settings.Similarity.Action = similarityRegenerate
+	service.ApplySettings(&settings)
+
+	_, err := service.GenerateLyrics(context.Background(), LyricsRequest{Keywords: []string{"harbor"}, Genre: "folk", Emotion: "peaceful", Language: "english"})
+	require.NoError(t, err)
+
+	// The language retry brings back the stored song, which is then regenerated
+	// instead of being returned without a warning
+	response, err := service.GenerateLyrics(context.Background(), LyricsRequest{Keywords: []string{"harbor"}, Genre: "folk", Emotion: "peaceful", Language: "english"})
+	require.NoError(t, err)
+	require.Len(t, requests, 4)
+	messages := requests[3]["messages"].([]interface{})
+	assert.Equal(t, duplicateRetryPrompt, messages[len(messages)-1].(map[string]interface{})["content"])
+	assert.Equal(t, "Neon", response.Lyrics.Title)
+	assert.Equal(t, 1, response.Metadata.LanguageRetries)
+	assert.Equal(t, 1, response.Metadata.DuplicateRetries)
+	assert.Empty(t, response.Warnings)
+}
+
+func TestConfigValidatesSimilarity(t *testing.T) {
+	clearConfigEnv(t)
+
+	_, err := LoadConfig(writeConfigFile(t, "config.yaml", validYAMLConfig+
+		"similarity:\n  threshold: 1.5\n  action: drop\n  corpus_file: /nonexistent/corpus.yaml\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "similarity.threshold must be between 0 and 1, got 1.5")
+	assert.Contains(t, err.Error(), `similarity.action must be "regenerate" or "warn", got "drop"`)
+	assert.Contains(t, err.Error(), "similarity.corpus_file: failed to read /nonexistent/corpus.yaml")
+
+	t.Setenv("SIMILARITY_CORPUS_FILE", writeConfigFile(t, "corpus.yaml", "songs:\n  - {id: a, lyrics: \"Some words here\"}\n"))
+	cfg, err := LoadConfig(writeConfigFile(t, "config.yaml", validYAMLConfig))
+	require.NoError(t, err)
+	settings := cfg.ServiceSettings()
+	assert.Equal(t, 1, settings.Corpus.Len())
+	assert.Equal(t, 0.6, settings.Similarity.Threshold)
+	assert.Equal(t, similarityWarn, settings.Similarity.Action)
+	assert.True(t, strings.HasSuffix(settings.Similarity.CorpusFile, "corpus.yaml"))
+}
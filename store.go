@@ -0,0 +1,171 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultStoreCapacity is the number of songs kept when no capacity is configured
+const defaultStoreCapacity = 10000
+
+// StoredLyrics is a generated song together with the request that produced it
+type StoredLyrics struct {
+	Response LyricsResponse
+	Request  LyricsRequest
+	Rating   int
+	RatedAt  time.Time
+
+	// signature is the MinHash of the lyrics, used to find near-duplicates, and
+	// saved orders songs by when they were stored
+	signature *minHashSignature
+	saved     uint64
+}
+
+// LyricsStore keeps the most recently generated songs in memory, evicting the
+// oldest once capacity is reached
+type LyricsStore struct {
+	mutex    sync.RWMutex
+	capacity int
+	songs    map[string]*StoredLyrics
+	order    []string
+	saves    uint64
+
+	// bands is the LSH index of the signatures: the IDs of the songs whose signature
+	// has the same values in a band, keyed by the hash of the band
+	bands map[uint64][]string
+}
+
+// NewLyricsStore creates a store holding up to capacity songs
+func NewLyricsStore(capacity int) *LyricsStore {
+	if capacity <= 0 {
+		capacity = defaultStoreCapacity
+	}
+	return &LyricsStore{
+		capacity: capacity,
+		songs:    map[string]*StoredLyrics{},
+		bands:    map[uint64][]string{},
+	}
+}
+
+// Save stores a generated song
+func (s *LyricsStore) Save(resp *LyricsResponse, req LyricsRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if previous, exists := s.songs[resp.ID]; exists {
+		s.unindex(resp.ID, previous.signature)
+	} else {
+		s.order = append(s.order, resp.ID)
+	}
+	s.saves++
+	song := &StoredLyrics{Response: *resp, Request: req, signature: lyricsSignature(resp.Lyrics.Sections), saved: s.saves}
+	s.songs[resp.ID] = song
+	s.index(resp.ID, song.signature)
+
+	for len(s.order) > s.capacity {
+		s.unindex(s.order[0], s.songs[s.order[0]].signature)
+		delete(s.songs, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// index adds a song to the LSH buckets of its signature; callers hold the write lock
+func (s *LyricsStore) index(id string, signature *minHashSignature) {
+	for _, key := range signature.bandKeys() {
+		s.bands[key] = append(s.bands[key], id)
+	}
+}
+
+// unindex removes a song from the LSH buckets of its signature; callers hold the
+// write lock
+func (s *LyricsStore) unindex(id string, signature *minHashSignature) {
+	for _, key := range signature.bandKeys() {
+		ids := slices.DeleteFunc(s.bands[key], func(other string) bool { return other == id })
+		if len(ids) == 0 {
+			delete(s.bands, key)
+		} else {
+			s.bands[key] = ids
+		}
+	}
+}
+
+// Get returns a copy of the stored song
+func (s *LyricsStore) Get(id string) (StoredLyrics, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	song, ok := s.songs[id]
+	if !ok {
+		return StoredLyrics{}, false
+	}
+	return *song, true
+}
+
+// Rate records a user rating for a song and returns the song with the rating it
+// replaced (0 if it was not rated before)
+func (s *LyricsStore) Rate(id string, rating int) (song StoredLyrics, previous int, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, ok := s.songs[id]
+	if !ok {
+		return StoredLyrics{}, 0, false
+	}
+	previous = stored.Rating
+	stored.Rating = rating
+	stored.RatedAt = time.Now()
+	return *stored, previous, true
+}
+
+// AddTranslation links a translation to the stored song it was made from
+func (s *LyricsStore) AddTranslation(id string, link TranslationLink) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, ok := s.songs[id]
+	if !ok {
+		return false
+	}
+	metadata := &stored.Response.Metadata
+	metadata.Translations = append(slices.Clip(metadata.Translations), link)
+	return true
+}
+
+// Nearest returns the stored song most similar to the signature, the most recent
+// one on a tie, or nil when none is found. Only the songs sharing an LSH band with
+// the signature are compared, so the cost grows with the number of similar songs
+// rather than with the size of the store; see lshBands for the odds of a miss.
+func (s *LyricsStore) Nearest(signature *minHashSignature) *SimilarMatch {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var nearest *StoredLyrics
+	var nearestID string
+	best := 0.0
+	compared := map[string]bool{}
+	for _, key := range signature.bandKeys() {
+		for _, id := range s.bands[key] {
+			if compared[id] {
+				continue
+			}
+			compared[id] = true
+			song := s.songs[id]
+			similarity := signature.similarity(song.signature)
+			if similarity > best || (similarity == best && nearest != nil && song.saved > nearest.saved) {
+				nearest, nearestID, best = song, id, similarity
+			}
+		}
+	}
+	if nearest == nil || best == 0 {
+		return nil
+	}
+	return &SimilarMatch{Source: matchSourceGenerated, ID: nearestID, Title: nearest.Response.Lyrics.Title, Similarity: best}
+}
+
+// Len returns the number of stored songs
+func (s *LyricsStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.songs)
+}
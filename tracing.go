@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the instrumentation scope of all spans created by the service
+const tracerName = "songlyrics-api"
+
+// tracer returns the service tracer from the global provider, so spans are no-ops
+// until InitTracing installs a real provider
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Span attribute keys for lyrics generation
+const (
+	attrModel            = attribute.Key("gen_ai.request.model")
+	attrMaxTokens        = attribute.Key("gen_ai.request.max_tokens")
+	attrPromptTokens     = attribute.Key("gen_ai.usage.input_tokens")
+	attrCompletionTokens = attribute.Key("gen_ai.usage.output_tokens")
+	attrFinishReason     = attribute.Key("gen_ai.response.finish_reason")
+	attrGuardrailOutcome = attribute.Key("songlyrics.guardrail.outcome")
+	attrGenre            = attribute.Key("songlyrics.genre")
+	attrEmotion          = attribute.Key("songlyrics.emotion")
+	attrLanguage         = attribute.Key("songlyrics.language")
+	attrPromptVersion    = attribute.Key("songlyrics.prompt.version")
+	attrExperiment       = attribute.Key("songlyrics.experiment")
+	attrExperimentArm    = attribute.Key("songlyrics.experiment.arm")
+	attrExemplars        = attribute.Key("songlyrics.prompt.exemplars")
+	attrContinuations    = attribute.Key("songlyrics.continuations")
+	attrLanguageRetries  = attribute.Key("songlyrics.language_retries")
+	attrDuplicateRetries = attribute.Key("songlyrics.duplicate_retries")
+	attrTokenCacheHit    = attribute.Key("oauth.token.cache_hit")
+)
+
+// InitTracing configures the global tracer provider and W3C propagator from the
+// OTEL_TRACES_EXPORTER environment variable: "otlp" (configured through the
+// standard OTEL_EXPORTER_OTLP_* variables), "stdout" for local development, or
+// "none" (the default). The returned function flushes and stops the provider.
+func InitTracing(ctx context.Context, version string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName := strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")); exporterName {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q (supported: otlp, stdout, none)", exporterName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override these defaults
+	res, err := resource.Merge(
+		resource.NewSchemaless(
+			semconv.ServiceName(tracerName),
+			semconv.ServiceVersion(version),
+		),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a server span per request, continuing any W3C trace
+// context sent by the caller
+func tracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		ctx, span := tracer().Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if code := c.GetString(errorCodeKey); code != "" {
+			span.SetAttributes(attribute.String("songlyrics.error_code", code))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, c.GetString(errorCodeKey))
+		}
+	}
+}
+
+// recordSpanError marks the span as failed
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// useSpanRecorder installs a tracer provider that records spans in memory
+func useSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previousProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+func TestGenerateLyricsTracing(t *testing.T) {
+	recorder := useSpanRecorder(t)
+
+	var traceparent string
+	completions := newTestGateway(t, "[Title: Night Drive]\n[Verse 1]\nCity lights", nil)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		completions.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer gateway.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(tracingMiddleware())
+	router.POST("/generate", generateLyrics(newTestLyricsService(t, gateway.URL)))
+
+	body := `{"keywords":["night"],"genre":"pop","emotion":"happy","language":"english","structure":{"verses":1}}`
+	req, _ := http.NewRequest("POST", "/generate", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"POST /generate", "buildPrompt", "chat.completion", "OAuthClient.GetAccessToken", "parseLyrics"} {
+		assert.Contains(t, spans, name)
+	}
+
+	root := spans["POST /generate"]
+	chat := spans["chat.completion"]
+	assert.Equal(t, root.SpanContext().TraceID(), chat.SpanContext().TraceID())
+	assert.Contains(t, chat.Attributes(), attrPromptTokens.Int64(10))
+	assert.Contains(t, chat.Attributes(), attrCompletionTokens.Int64(20))
+	assert.Contains(t, chat.Attributes(), attrGuardrailOutcome.String("passed"))
+	assert.Contains(t, root.Attributes(), attribute.String("songlyrics.genre", "pop"))
+
+	// The gateway receives the trace context of the chat completion span
+	assert.Contains(t, traceparent, chat.SpanContext().TraceID().String())
+}
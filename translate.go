@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/openai/openai-go/v2"
+	zerologlog "github.com/rs/zerolog/log"
+	"golang.org/x/text/unicode/norm"
+)
+
+// translationSystemPrompt sets up the model as a translator of singable lyrics
+const translationSystemPrompt = "You translate song lyrics so that they can be sung to the same melody. " +
+	"Keep the meaning, imagery and emotion, but favour singability over a literal translation: " +
+	"give each line the same number of syllables as the source line and keep the rhyme scheme where the target language allows it. " +
+	"Reply with the translated lines only, numbered like the source lines, without notes or explanations."
+
+const (
+	// maxSyllableDeviation is the difference in syllables from the source line above
+	// which a translated line is reported as hard to sing to the same melody
+	maxSyllableDeviation = 2
+	// lineNumberTokens covers the numbering of each line in the model's reply
+	lineNumberTokens = 4
+)
+
+// TranslateRequest asks for a singable translation of a stored song
+type TranslateRequest struct {
+	Language string `json:"language" binding:"required"`
+	// Romanize adds romanized lines when translating into Japanese or Korean
+	Romanize bool `json:"romanize,omitempty"`
+}
+
+// TranslationLink points from a song to one of its translations
+type TranslationLink struct {
+	ID       string `json:"id"`
+	Language string `json:"language"`
+}
+
+// TranslationReport compares a translation with its source line by line
+type TranslationReport struct {
+	SourceID       string              `json:"source_id"`
+	SourceLanguage string              `json:"source_language"`
+	Sections       []TranslatedSection `json:"sections"`
+	// Kept lists the sections of a mixed-language song that were already in the target
+	// language and are kept as written
+	Kept []string `json:"kept_sections,omitempty"`
+	// MeanDeviation is the mean absolute difference in syllables per line, and
+	// MaxDeviation the largest
+	MeanDeviation float64 `json:"mean_syllable_deviation"`
+	MaxDeviation  int     `json:"max_syllable_deviation"`
+}
+
+// TranslatedSection is one distinct section of a translation; repeated choruses are
+// reported once
+type TranslatedSection struct {
+	Section           string           `json:"section"`
+	SourceRhymeScheme string           `json:"source_rhyme_scheme"`
+	RhymeScheme       string           `json:"rhyme_scheme"`
+	Lines             []TranslatedLine `json:"lines"`
+}
+
+// TranslatedLine is a source line with its translation. Deviation is the translation's
+// syllable count minus the source's.
+type TranslatedLine struct {
+	Source          string `json:"source"`
+	Translation     string `json:"translation"`
+	SourceSyllables int    `json:"source_syllables"`
+	Syllables       int    `json:"syllables"`
+	Deviation       int    `json:"deviation"`
+}
+
+// translateLyrics handles POST /lyrics/:id/translate, saving the translation as a new
+// song linked to the original
+func translateLyrics(service *LyricsService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req TranslateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		catalog := service.Settings().Catalog
+		language, ok := catalog.Languages.Lookup(req.Language)
+		if !ok {
+			respondError(c, http.StatusBadRequest, "invalid_language",
+				"Unsupported language. Supported languages: "+strings.Join(catalog.Languages.IDs(), ", "))
+			return
+		}
+
+		song, ok := service.store.Get(c.Param("id"))
+		if !ok {
+			respondError(c, http.StatusNotFound, "not_found", "No lyrics found with this ID.")
+			return
+		}
+		if song.Response.inLanguage(language.ID) {
+			respondError(c, http.StatusBadRequest, "same_language",
+				fmt.Sprintf("The song is already in %s. Choose another language.", language.ID))
+			return
+		}
+
+		ctx := withAPIKey(c.Request.Context(), c.GetHeader(apiKeyHeader))
+		response, err := service.TranslateLyrics(ctx, song, language, req.Romanize)
+		if err != nil {
+			zerologlog.Error().Err(err).Str("id", song.Response.ID).Msg("Error translating lyrics")
+			respondGenerationError(c, err, "Failed to translate lyrics. Please try again.")
+			return
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// TranslateLyrics translates a stored song section by section into the given
+// language, asking the model to keep each line's syllable count and each section's
+// rhyme scheme, and saves the translation linked to the original
+func (s *LyricsService) TranslateLyrics(ctx context.Context, song StoredLyrics, language CatalogEntry, romanize bool) (*LyricsResponse, error) {
+	settings := s.Settings()
+	source := song.Response
+	sourceLanguage := source.Metadata.Language
+	// The translation is in a single language, whatever mix the source was written in
+	req := song.Request
+	req.Language, req.Languages = language.ID, nil
+
+	translate := func(description string, lines []string, from string) ([]string, *openai.ChatCompletion, error) {
+		messages := []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(translationSystemPrompt),
+			openai.UserMessage(translationPrompt(description, lines, from, language)),
+		}
+		completion, err := s.chatCompletion(ctx, settings, req, messages,
+			translationMaxTokens(settings, language, lines), settings.Generation.Temperature)
+		if err != nil {
+			return nil, nil, err
+		}
+		return parseTranslatedLines(completion.Choices[0].Message.Content, len(lines)), completion, nil
+	}
+
+	// A title in the target language already, as in a mixed song, is kept
+	lyrics := GeneratedLyrics{Title: source.Lyrics.Title, Structure: map[string]string{}}
+	var completion *openai.ChatCompletion
+	if sourceLanguage != language.ID {
+		title, titleCompletion, err := translate("the title of the song", []string{source.Lyrics.Title}, sourceLanguage)
+		if err != nil {
+			return nil, err
+		}
+		completion = titleCompletion
+		if translatedTitle := strings.Join(title, " "); translatedTitle != "" {
+			lyrics.Title = translatedTitle
+		}
+	}
+
+	report := &TranslationReport{SourceID: source.ID, SourceLanguage: sourceLanguage}
+	var warnings []Warning
+	translated := map[string][]string{}
+	totalDeviation, lineCount, offBeat := 0, 0, 0
+	for _, section := range source.Lyrics.Sections {
+		// Repeated sections, such as a chorus sung twice, are translated once
+		key := section.Name + "\n" + strings.Join(section.Lines, "\n")
+		lines, done := translated[key]
+		if !done && source.sectionLanguage(section) == language.ID {
+			// Sections of a mixed song already in the target language are kept as written
+			lines = section.Lines
+			translated[key] = lines
+			report.Kept = append(report.Kept, section.Name)
+		} else if !done {
+			var err error
+			description := fmt.Sprintf("the %s of the song %q", section.Name, source.Lyrics.Title)
+			lines, completion, err = translate(description, section.Lines, source.sectionLanguage(section))
+			if err != nil {
+				return nil, err
+			}
+			translated[key] = lines
+
+			reported := TranslatedSection{
+				Section:           section.Name,
+				SourceRhymeScheme: rhymeScheme(section.Lines, source.sectionLanguage(section)),
+				RhymeScheme:       rhymeScheme(lines, language.ID),
+			}
+			for i, line := range section.Lines {
+				compared := TranslatedLine{Source: line, SourceSyllables: syllableCount(line, source.sectionLanguage(section))}
+				if i < len(lines) {
+					compared.Translation = lines[i]
+					compared.Syllables = syllableCount(lines[i], language.ID)
+				}
+				compared.Deviation = compared.Syllables - compared.SourceSyllables
+				reported.Lines = append(reported.Lines, compared)
+
+				deviation := max(compared.Deviation, -compared.Deviation)
+				report.MaxDeviation = max(report.MaxDeviation, deviation)
+				totalDeviation += deviation
+				lineCount++
+				if deviation > maxSyllableDeviation {
+					offBeat++
+				}
+			}
+			report.Sections = append(report.Sections, reported)
+
+			if len(lines) < len(section.Lines) {
+				warnings = append(warnings, Warning{
+					Code: "translation_incomplete",
+					Message: fmt.Sprintf("The %s has %d of its %d lines translated.",
+						section.Name, len(lines), len(section.Lines)),
+				})
+			}
+		}
+
+		if _, exists := lyrics.Structure[section.Name]; !exists {
+			lyrics.Structure[section.Name] = strings.Join(lines, "\n")
+		}
+		lyrics.Sections = append(lyrics.Sections, LyricsSection{Name: section.Name, Lines: lines})
+	}
+	if lineCount > 0 {
+		report.MeanDeviation = math.Round(float64(totalDeviation)/float64(lineCount)*100) / 100
+	}
+	if offBeat > 0 {
+		warnings = append(warnings, Warning{
+			Code: "syllable_deviation",
+			Message: fmt.Sprintf("%d of %d lines differ from the source by more than %d syllables and may not fit the melody.",
+				offBeat, lineCount, maxSyllableDeviation),
+		})
+	}
+	if romanize {
+		if warning := romanizeSections(lyrics.Sections).Warning(); warning != nil {
+			warnings = append(warnings, *warning)
+		}
+	}
+
+	wordCount := 0
+	for _, section := range lyrics.Sections {
+		for _, line := range section.Lines {
+			wordCount += s.countWords(line)
+		}
+	}
+	finishReason := ""
+	if completion != nil {
+		finishReason = string(completion.Choices[0].FinishReason)
+	}
+	response := &LyricsResponse{
+		ID:     uuid.New().String(),
+		Lyrics: lyrics,
+		Metadata: LyricsMetadata{
+			Genre:           source.Metadata.Genre,
+			Emotion:         source.Metadata.Emotion,
+			Language:        language.ID,
+			KeywordsUsed:    source.Metadata.KeywordsUsed,
+			CreatedAt:       time.Now(),
+			WordCount:       wordCount,
+			Genres:          source.Metadata.Genres,
+			SectionEmotions: source.Metadata.SectionEmotions,
+			PromptVersion:   source.Metadata.PromptVersion,
+			MaxTokens:       settings.Generation.MaxTokens,
+			FinishReason:    finishReason,
+			// Keywords are translated with the lyrics, so the source's score carries over
+			ComplianceScore: source.Metadata.ComplianceScore,
+			TranslatedFrom:  source.ID,
+		},
+		// The translation is sung to the same music
+		Chords:      source.Chords,
+		Translation: report,
+		Warnings:    warnings,
+	}
+	response.Quality = scoreQuality(settings.Catalog, *response)
+	if source.Quality != nil {
+		// Translated keywords cannot be matched, so the source's integration carries over
+		response.Quality.KeywordIntegration = source.Quality.KeywordIntegration
+		response.Quality.total()
+	}
+	s.store.Save(response, req)
+	s.store.AddTranslation(source.ID, TranslationLink{ID: response.ID, Language: language.ID})
+
+	zerologlog.Debug().
+		Str("response_id", response.ID).
+		Str("source_id", source.ID).
+		Str("language", language.ID).
+		Float64("mean_syllable_deviation", report.MeanDeviation).
+		Msg("Successfully translated lyrics")
+	return response, nil
+}
+
+// translationPrompt asks for the lines of one section, numbered and annotated with
+// their syllable counts, with the section's rhyme scheme
+func translationPrompt(description string, lines []string, sourceLanguage string, language CatalogEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Translate %s from %s into %s.\n", description, sourceLanguage, language.ID)
+	if language.StyleGuide != "" {
+		fmt.Fprintf(&b, "Style guide for %s: %s\n", language.ID, language.StyleGuide)
+	}
+	if len(lines) > 1 {
+		fmt.Fprintf(&b, "Rhyme scheme: %s (lines with the same letter rhyme; keep these rhymes where you can).\n",
+			rhymeScheme(lines, sourceLanguage))
+	}
+	fmt.Fprintf(&b, "Write exactly %d numbered lines, matching the syllable count of each source line:\n\n", len(lines))
+	for i, line := range lines {
+		fmt.Fprintf(&b, "%d. %s (%d syllables)\n", i+1, line, syllableCount(line, sourceLanguage))
+	}
+	return b.String()
+}
+
+// translationMaxTokens sizes a translation completion from the length of the source
+// lines in the target language's tokens per word
+func translationMaxTokens(settings *ServiceSettings, language CatalogEntry, lines []string) int {
+	tokensPerWord := defaultTokensPerWord
+	if language.TokensPerWord > 0 {
+		tokensPerWord = language.TokensPerWord
+	}
+	words := 0
+	for _, line := range lines {
+		words += len(strings.Fields(line))
+	}
+	estimate := int(math.Ceil(float64(words)*tokensPerWord*tokenHeadroom)) + len(lines)*lineNumberTokens + sectionLabelTokens
+	return min(estimate, settings.Generation.MaxTokens)
+}
+
+var (
+	lineNumberPattern   = regexp.MustCompile(`^\d+[.)]\s*`)
+	syllableNotePattern = regexp.MustCompile(`\s*\(\d+ syllables?\)$`)
+)
+
+// translationQuotes are stripped from translated titles
+const translationQuotes = `"“”«»`
+
+// parseTranslatedLines reads up to want numbered lines from the model's reply,
+// dropping the numbering and any echoed syllable counts
+func parseTranslatedLines(reply string, want int) []string {
+	var lines []string
+	for _, line := range nonEmptyLines(reply) {
+		if len(lines) == want {
+			break
+		}
+		line = lineNumberPattern.ReplaceAllString(line, "")
+		line = syllableNotePattern.ReplaceAllString(line, "")
+		if want == 1 {
+			// Titles tend to come back quoted
+			line = strings.Trim(line, translationQuotes)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// syllableCount estimates the number of sung syllables in a line. Every CJK
+// character counts as one, so Japanese kanji with longer readings are undercounted.
+func syllableCount(line, language string) int {
+	_, all := syllablePositions(line, language)
+	return len(all)
+}
+
+// rhymeScheme labels the lines of a section by their rhyme, e.g. "ABAB" or "AABB"
+func rhymeScheme(lines []string, language string) string {
+	letters := map[string]byte{}
+	var scheme []byte
+	for i, line := range lines {
+		key := rhymeKey(line, language)
+		if key == "" {
+			// Lines without words rhyme with nothing
+			key = fmt.Sprint(i)
+		}
+		letter, ok := letters[key]
+		if !ok {
+			letter = byte('A' + min(len(letters), 25))
+			letters[key] = letter
+		}
+		scheme = append(scheme, letter)
+	}
+	return string(scheme)
+}
+
+// rhymeKey returns the sound a line ends on: the last vowel group of its last word and
+// the consonants after it, without accents or doubled letters. Japanese and Korean lines are compared by
+// the romanization of their last syllable.
+func rhymeKey(line, language string) string {
+	fields := strings.FieldsFunc(line, func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' })
+	if len(fields) == 0 {
+		return ""
+	}
+	word := []rune(fields[len(fields)-1])
+	if last := word[len(word)-1]; isWide(last) {
+		romaji, _, _ := romanizeLine(string(last))
+		word = []rune(romaji)
+	}
+
+	var plain []rune
+	for _, r := range norm.NFD.String(strings.ToLower(string(word))) {
+		// "free" rhymes with "me"
+		if !unicode.Is(unicode.Mn, r) && (len(plain) == 0 || plain[len(plain)-1] != r) {
+			plain = append(plain, r)
+		}
+	}
+	syllables := wordSyllables(plain, language)
+	start := lastVowel(plain, syllables[len(syllables)-1])
+	// Outside English, an unstressed i or u before another vowel is a glide, so
+	// "canción" rhymes with "corazón"
+	if language != "english" && start+1 < len(plain) && strings.ContainsRune("iu", plain[start]) &&
+		strings.ContainsRune(vowels, plain[start+1]) {
+		start++
+	}
+	return string(plain[start:])
+}
+
+// lastVowel returns the index of the first vowel at or after the start of a syllable,
+// or the start itself if the syllable has none
+func lastVowel(word []rune, start int) int {
+	if i := slices.IndexFunc(word[start:], func(r rune) bool { return strings.ContainsRune(vowels, r) }); i >= 0 {
+		return start + i
+	}
+	return start
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRhymeScheme(t *testing.T) {
+	assert.Equal(t, "AABB", rhymeScheme([]string{"I see the light", "Into the night", "Cold as a stone", "Never alone"}, "english"))
+	assert.Equal(t, "ABAB", rhymeScheme([]string{"Mi corazón", "bajo la luna", "esta canción", "como ninguna"}, "spanish"))
+	assert.Equal(t, "AA", rhymeScheme([]string{"Set me free", "Come with me"}, "english"))
+	assert.Equal(t, "AB", rhymeScheme([]string{"...", "..."}, "english"))
+}
+
+func TestParseTranslatedLines(t *testing.T) {
+	assert.Equal(t, []string{"Luces de ciudad", "Zumban"},
+		parseTranslatedLines("1. Luces de ciudad (5 syllables)\n\n2) Zumban\n3. Extra", 2))
+	assert.Equal(t, []string{"Otra vez en casa"}, parseTranslatedLines(`"Otra vez en casa"`, 1))
+}
+
+func TestTranslateLyrics(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newSequenceGateway(t, []gatewayReply{
+		{`"Otra vez en casa"`, "stop"},
+		{"1. Luces de ciudad\n2. Zumban", "stop"},
+		{"1. Somos hogar", "stop"},
+		{"1. Llega la mañana que nos despierta", "stop"},
+		{"1. Se apaga", "stop"},
+	}, &requests)
+	service := newTestLyricsService(t, gateway.URL)
+	service.settings.Store(&ServiceSettings{Catalog: DefaultCatalog(), Generation: service.Settings().Generation})
+
+	stored, id := testStoredSong(t, "Home Again")
+	song, _ := stored.store.Get(id)
+	service.store.Save(&song.Response, song.Request)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/lyrics/:id/translate", translateLyrics(service))
+	translate := func(id, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/lyrics/"+id+"/translate", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := translate(id, `{"language":"español"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response LyricsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	// The title and each distinct section are translated in turn; the repeated chorus is reused
+	require.Len(t, requests, 5)
+	assert.Equal(t, "Otra vez en casa", response.Lyrics.Title)
+	assert.Equal(t, []string{"Luces de ciudad", "Zumban"}, response.Lyrics.Sections[0].Lines)
+	assert.Equal(t, []string{"Somos hogar"}, response.Lyrics.Sections[3].Lines)
+	assert.Equal(t, "spanish", response.Metadata.Language)
+	assert.Equal(t, id, response.Metadata.TranslatedFrom)
+
+	prompt := requests[1]["messages"].([]interface{})[1].(map[string]interface{})["content"].(string)
+	assert.Contains(t, prompt, "Translate the verse 1 of the song \"Home Again\" from english into spanish.")
+	assert.Contains(t, prompt, "Rhyme scheme: AB")
+	assert.Contains(t, prompt, "1. City lights (3 syllables)\n2. Hum along (3 syllables)\n")
+
+	report := response.Translation
+	require.NotNil(t, report)
+	assert.Equal(t, "english", report.SourceLanguage)
+	require.Len(t, report.Sections, 4)
+	assert.Equal(t, TranslatedLine{Source: "City lights", Translation: "Luces de ciudad", SourceSyllables: 3, Syllables: 5, Deviation: 2},
+		report.Sections[0].Lines[0])
+	assert.Equal(t, -1, report.Sections[0].Lines[1].Deviation)
+	assert.Equal(t, 7, report.MaxDeviation)
+	assert.Equal(t, 2.4, report.MeanDeviation)
+	require.Len(t, response.Warnings, 1)
+	assert.Equal(t, "syllable_deviation", response.Warnings[0].Code)
+
+	// Both songs are stored and linked
+	translation, ok := service.store.Get(response.ID)
+	require.True(t, ok)
+	assert.Equal(t, "Otra vez en casa", translation.Response.Lyrics.Title)
+	original, _ := service.store.Get(id)
+	assert.Equal(t, []TranslationLink{{ID: response.ID, Language: "spanish"}}, original.Response.Metadata.Translations)
+
+	assert.Equal(t, http.StatusBadRequest, translate(id, `{"language":"english"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, translate(id, `{"language":"klingon"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, translate(id, `{}`).Code)
+	assert.Equal(t, http.StatusNotFound, translate("missing", `{"language":"spanish"}`).Code)
+	assert.Len(t, requests, 5)
+}
+
+// testMixedSong stores a song with a Spanish verse and an English chorus
+func testMixedSong(service *LyricsService) string {
+	mix := []LanguageMix{{Language: "spanish", Sections: []string{"verse 1"}}, {Language: "english", Sections: []string{"chorus"}}}
+	response := &LyricsResponse{
+		ID: "mixed-1",
+		Lyrics: GeneratedLyrics{Title: "Dos Mundos", Sections: []LyricsSection{
+			{Name: "verse 1", Lines: []string{"Quiero estar contigo"}, Language: "spanish"},
+			{Name: "chorus", Lines: []string{"We are home tonight"}, Language: "english"},
+		}},
+		Metadata: LyricsMetadata{Genre: "pop", Emotion: "happy", Language: "spanish", Languages: mix},
+	}
+	service.store.Save(response, LyricsRequest{Genre: "pop", Emotion: "happy", Language: "spanish", Languages: mix})
+	return response.ID
+}
+
+func TestTranslateMixedLyrics(t *testing.T) {
+	var requests []map[string]interface{}
+	gateway := newSequenceGateway(t, []gatewayReply{
+		{`"Deux Mondes"`, "stop"},
+		{"1. Je veux rester avec toi", "stop"},
+		{"1. Nous sommes chez nous ce soir", "stop"},
+		{`"Two Worlds"`, "stop"},
+		{"1. I want to be with you", "stop"},
+	}, &requests)
+	service := newTestLyricsService(t, gateway.URL)
+	id := testMixedSong(service)
+
+	song, _ := service.store.Get(id)
+	language, _ := DefaultCatalog().Languages.Lookup("french")
+	response, err := service.TranslateLyrics(context.Background(), song, language, false)
+	require.NoError(t, err)
+	require.Len(t, requests, 3)
+
+	// The translation is stored as a single-language song
+	translation, ok := service.store.Get(response.ID)
+	require.True(t, ok)
+	assert.Equal(t, "french", translation.Request.Language)
+	assert.Empty(t, translation.Request.Languages)
+	assert.Empty(t, translation.Response.Metadata.Languages)
+	assert.Empty(t, response.Translation.Kept)
+
+	// Into one of its own languages, only the sections in the other language are translated
+	language, _ = DefaultCatalog().Languages.Lookup("english")
+	response, err = service.TranslateLyrics(context.Background(), song, language, false)
+	require.NoError(t, err)
+	require.Len(t, requests, 5)
+	assert.Equal(t, "Two Worlds", response.Lyrics.Title)
+	assert.Equal(t, []string{"I want to be with you"}, response.Lyrics.Sections[0].Lines)
+	assert.Equal(t, []string{"We are home tonight"}, response.Lyrics.Sections[1].Lines)
+	assert.Equal(t, []string{"chorus"}, response.Translation.Kept)
+	require.Len(t, response.Translation.Sections, 1)
+	assert.Equal(t, "verse 1", response.Translation.Sections[0].Section)
+	for _, request := range requests[3:] {
+		prompt := request["messages"].([]interface{})[1].(map[string]interface{})["content"].(string)
+		assert.NotContains(t, prompt, "We are home tonight")
+	}
+
+	// A song wholly in the target language cannot be translated into it
+	assert.False(t, song.Response.inLanguage("spanish"))
+	single := song.Response
+	single.Metadata.Languages = nil
+	assert.True(t, single.inLanguage("spanish"))
+}